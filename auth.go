@@ -0,0 +1,214 @@
+package texto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Subprotocol is the WebSocket subprotocol selected by the server when a client offers it. Browser clients passing
+// their token through the Sec-WebSocket-Protocol header must also offer this subprotocol.
+const Subprotocol = "texto"
+
+// TokenSubprotocolPrefix prefixes the token when it is transmitted through the Sec-WebSocket-Protocol header.
+const TokenSubprotocolPrefix = "texto.token."
+
+var (
+	// ErrMissingToken is returned by an Authenticator when the request doesn't carry any token.
+	ErrMissingToken = errors.New("missing authentication token")
+	// ErrInvalidToken is returned by an Authenticator when the token is malformed or its signature is invalid.
+	ErrInvalidToken = errors.New("invalid authentication token")
+	// ErrExpiredToken is returned by an Authenticator when the token is expired or not valid yet.
+	ErrExpiredToken = errors.New("expired authentication token")
+)
+
+// An Authenticator verifies the identity of the user opening a connection.
+type Authenticator interface {
+	// Authenticate returns the ID of the user authenticated by the given request.
+	Authenticate(r *http.Request) (uuid.UUID, error)
+}
+
+// RequestToken extracts the authentication token from the given request. The token is looked up, in order, in the
+// Authorization header using the Bearer scheme, in the token query parameter, and in the Sec-WebSocket-Protocol header
+// as a subprotocol prefixed by TokenSubprotocolPrefix. It returns an empty string if no token was found.
+func RequestToken(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	if token := r.URL.Query().Get("token"); len(token) != 0 {
+		return token
+	}
+	for _, header := range r.Header["Sec-Websocket-Protocol"] {
+		for _, protocol := range strings.Split(header, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if strings.HasPrefix(protocol, TokenSubprotocolPrefix) {
+				return strings.TrimPrefix(protocol, TokenSubprotocolPrefix)
+			}
+		}
+	}
+	return ""
+}
+
+// JWTClaims are the registered JSON Web Token claims understood by the JWTAuthenticator.
+type JWTClaims struct {
+	// The subject of the token, which must be the UUID of the user.
+	Subject string `json:"sub"`
+	// The issuer of the token.
+	Issuer string `json:"iss,omitempty"`
+	// The audience of the token.
+	Audience JWTAudience `json:"aud,omitempty"`
+	// The expiration time of the token, as a UNIX timestamp.
+	ExpiresAt int64 `json:"exp,omitempty"`
+	// The time before which the token must not be accepted, as a UNIX timestamp.
+	NotBefore int64 `json:"nbf,omitempty"`
+	// The time at which the token was issued, as a UNIX timestamp.
+	IssuedAt int64 `json:"iat,omitempty"`
+}
+
+// A JWTAudience is the audience of a token, which can either be a single string or an array of strings.
+type JWTAudience []string
+
+// UnmarshalJSON accepts both a single string and an array of strings.
+func (a *JWTAudience) UnmarshalJSON(input []byte) error {
+	var single string
+	if err := json.Unmarshal(input, &single); err == nil {
+		*a = JWTAudience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(input, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// contains reports whether the audience includes the given value.
+func (a JWTAudience) contains(value string) bool {
+	for _, audience := range a {
+		if audience == value {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// jwtAlgorithms maps the supported signing algorithms to their hash functions.
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// A JWTAuthenticator authenticates users using JSON Web Tokens signed with HMAC (HS256, HS384 or HS512). The subject
+// of the token is used as the user ID.
+type JWTAuthenticator struct {
+	// The secret key used to sign the tokens.
+	Secret []byte
+	// If not empty, the iss claim of the tokens must match this value.
+	Issuer string
+	// If not empty, the aud claim of the tokens must contain this value.
+	Audience string
+	// Leeway is the tolerated clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+}
+
+// Authenticate verifies the token carried by the given request and returns its subject.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (uuid.UUID, error) {
+	token := RequestToken(r)
+	if len(token) == 0 {
+		return uuid.Nil, ErrMissingToken
+	}
+	claims, err := a.Verify(token)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	userID, err := uuid.FromString(claims.Subject)
+	if err != nil {
+		return uuid.Nil, ErrInvalidToken
+	}
+	return userID, nil
+}
+
+// Verify checks the signature and the claims of the given token, and returns its claims.
+func (a *JWTAuthenticator) Verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	header := new(jwtHeader)
+	if err := decodeJWTSegment(parts[0], header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	hashFunc, ok := jwtAlgorithms[header.Algorithm]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac := hmac.New(hashFunc, a.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidToken
+	}
+	claims := new(JWTClaims)
+	if err := decodeJWTSegment(parts[1], claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	if claims.ExpiresAt != 0 && now.Add(-a.Leeway).Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	if claims.NotBefore != 0 && now.Add(a.Leeway).Unix() < claims.NotBefore {
+		return nil, ErrExpiredToken
+	}
+	if len(a.Issuer) != 0 && claims.Issuer != a.Issuer {
+		return nil, ErrInvalidToken
+	}
+	if len(a.Audience) != 0 && !claims.Audience.contains(a.Audience) {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// Sign creates a new HS256 token holding the given claims.
+func (a *JWTAuthenticator) Sign(claims JWTClaims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// decodeJWTSegment decodes a base64url encoded JSON segment of a token into v.
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,112 @@
+package texto
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/texto", nil)
+	assert.Equal(t, "", RequestToken(r))
+
+	r = httptest.NewRequest("GET", "/v1/texto", nil)
+	r.Header.Set("Authorization", "Bearer header.token.value")
+	assert.Equal(t, "header.token.value", RequestToken(r))
+
+	r = httptest.NewRequest("GET", "/v1/texto?token=query.token.value", nil)
+	assert.Equal(t, "query.token.value", RequestToken(r))
+
+	r = httptest.NewRequest("GET", "/v1/texto", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", "texto, texto.token.protocol.token.value")
+	assert.Equal(t, "protocol.token.value", RequestToken(r))
+}
+
+func TestJWTAuthenticator_Verify(t *testing.T) {
+	authenticator := &JWTAuthenticator{
+		Secret:   []byte("secret"),
+		Issuer:   "texto",
+		Audience: "chat",
+	}
+	userID := uuid.NewV4()
+	valid, err := authenticator.Sign(JWTClaims{
+		Subject:   userID.String(),
+		Issuer:    "texto",
+		Audience:  JWTAudience{"chat", "other"},
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	assert.Nil(t, err)
+	claims, err := authenticator.Verify(valid)
+	if assert.Nil(t, err) {
+		assert.Equal(t, userID.String(), claims.Subject)
+	}
+
+	expired, _ := authenticator.Sign(JWTClaims{
+		Subject:   userID.String(),
+		Issuer:    "texto",
+		Audience:  JWTAudience{"chat"},
+		ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+	})
+	_, err = authenticator.Verify(expired)
+	assert.Equal(t, ErrExpiredToken, err)
+
+	notYetValid, _ := authenticator.Sign(JWTClaims{
+		Subject:   userID.String(),
+		Issuer:    "texto",
+		Audience:  JWTAudience{"chat"},
+		NotBefore: time.Now().Add(time.Hour).Unix(),
+	})
+	_, err = authenticator.Verify(notYetValid)
+	assert.Equal(t, ErrExpiredToken, err)
+
+	wrongIssuer, _ := authenticator.Sign(JWTClaims{
+		Subject:  userID.String(),
+		Issuer:   "someone-else",
+		Audience: JWTAudience{"chat"},
+	})
+	_, err = authenticator.Verify(wrongIssuer)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	forged, _ := (&JWTAuthenticator{Secret: []byte("not-the-secret")}).Sign(JWTClaims{
+		Subject:  userID.String(),
+		Issuer:   "texto",
+		Audience: JWTAudience{"chat"},
+	})
+	_, err = authenticator.Verify(forged)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	parts := strings.Split(valid, ".")
+	unsigned := "eyJhbGciOiJub25lIn0." + parts[1] + "."
+	_, err = authenticator.Verify(unsigned)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	_, err = authenticator.Verify("garbage")
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestJWTAuthenticator_Authenticate(t *testing.T) {
+	authenticator := &JWTAuthenticator{Secret: []byte("secret")}
+	userID := uuid.NewV4()
+	token, _ := authenticator.Sign(JWTClaims{Subject: userID.String()})
+
+	r := httptest.NewRequest("GET", "/v1/texto", nil)
+	_, err := authenticator.Authenticate(r)
+	assert.Equal(t, ErrMissingToken, err)
+
+	r = httptest.NewRequest("GET", "/v1/texto", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	authenticated, err := authenticator.Authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, authenticated)
+
+	invalidSubject, _ := authenticator.Sign(JWTClaims{Subject: "john.doe"})
+	r = httptest.NewRequest("GET", "/v1/texto", nil)
+	r.Header = http.Header{"Authorization": {"Bearer " + invalidSubject}}
+	_, err = authenticator.Authenticate(r)
+	assert.Equal(t, ErrInvalidToken, err)
+}
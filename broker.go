@@ -3,7 +3,11 @@ package texto
 import (
 	"context"
 	"encoding/json"
-	"sync"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/satori/go.uuid"
@@ -22,128 +26,1057 @@ type Broker interface {
 	Poll(ctx context.Context) error
 }
 
+// A RoomBroker is a Broker able to manage rooms, in which messages are transmitted to all the members.
+type RoomBroker interface {
+	Broker
+	// CreateRoom creates a new room, whose only member is the given user.
+	CreateRoom(roomID uuid.UUID, ownerID uuid.UUID) error
+	// JoinRoom adds the given user to the members of an existing room.
+	JoinRoom(roomID uuid.UUID, userID uuid.UUID) error
+	// LeaveRoom removes the given user from the members of a room. A room is deleted when its last member leaves.
+	LeaveRoom(roomID uuid.UUID, userID uuid.UUID) error
+	// RoomMembers returns the IDs of the members of a room. It returns an empty slice if the room doesn't exist.
+	RoomMembers(roomID uuid.UUID) ([]uuid.UUID, error)
+	// SendRoom transmits the given message to all the members of its room except its sender, in a single step. It
+	// returns ErrUnknownRoom if the room doesn't exist, and ErrNotRoomMember if the sender isn't one of its members.
+	SendRoom(message *BrokerMessage) error
+}
+
+var (
+	// ErrUnknownRoom is returned by a RoomBroker when the requested room doesn't exist.
+	ErrUnknownRoom = errors.New("unknown room")
+	// ErrNotRoomMember is returned by a RoomBroker when the user isn't a member of the requested room.
+	ErrNotRoomMember = errors.New("not a member of the room")
+	// ErrRoomRecipient is returned by the Send method of a RoomBroker when the recipient is a room, in which case the
+	// message must be sent using SendRoom.
+	ErrRoomRecipient = errors.New("recipient is a room")
+	// ErrUnknownSession is returned by a ResumeBroker when the requested session doesn't exist or expired.
+	ErrUnknownSession = errors.New("unknown session")
+	// ErrSendPending is returned by a DedupBroker when the claimed message is being sent.
+	ErrSendPending = errors.New("message being sent")
+	// ErrSessionResumed is returned by a ResumeBroker when the session was resumed by another Client.
+	ErrSessionResumed = errors.New("session resumed by another connection")
+	// ErrSubscriptionClosed is reported by a HealthChecker when the Broker doesn't receive the messages from the other
+	// nodes.
+	ErrSubscriptionClosed = errors.New("broker subscription closed")
+)
+
+// A PresenceBroker is a Broker able to track the presence of users across all nodes.
+type PresenceBroker interface {
+	Broker
+	// Heartbeat signals that the session of the given Client is still alive. It must be called at least every
+	// HeartbeatInterval, otherwise the session is considered closed.
+	Heartbeat(client *Client) error
+	// SubscribePresence subscribes the given Client to the presence events of the given users, and returns their
+	// current presence. The subscriptions of a Client are removed when it is unregistered.
+	SubscribePresence(client *Client, userIDs []uuid.UUID) ([]PresenceMessagePayload, error)
+	// UnsubscribePresence unsubscribes the given Client from the presence events of the given users.
+	UnsubscribePresence(client *Client, userIDs []uuid.UUID) error
+}
+
+// A SequenceBroker is a Broker able to number the messages of each conversation, consistently across all nodes.
+type SequenceBroker interface {
+	Broker
+	// NextSequence returns the next sequence number of the given conversation. The sequence numbers of a conversation
+	// start at 1 and increase by 1 with each call.
+	NextSequence(conversationID uuid.UUID) (uint64, error)
+}
+
+// A DedupBroker is a Broker able to remember the messages sent by the users for a while, so that the retries of a
+// message aren't transmitted twice, whatever the node they are sent to.
+type DedupBroker interface {
+	Broker
+	// ClaimSentMessage claims the message of the given ID sent by the given user before it is transmitted, so that its
+	// retries aren't transmitted concurrently. The claim expires after ttl unless the message is recorded. It returns
+	// the acknowledgement of the message if it was already sent, or ErrSendPending if it is being sent.
+	ClaimSentMessage(senderID uuid.UUID, messageID uuid.UUID, ttl time.Duration) (*AckMessagePayload, error)
+	// RecordSentMessage records the acknowledgement of the claimed message of the given ID sent by the given user, once
+	// it was transmitted, for the given duration.
+	RecordSentMessage(senderID uuid.UUID, messageID uuid.UUID, ack AckMessagePayload, ttl time.Duration) error
+	// ForgetSentMessage removes the claim or the acknowledgement of the message of the given ID sent by the given user,
+	// when the message couldn't be sent.
+	ForgetSentMessage(senderID uuid.UUID, messageID uuid.UUID) error
+}
+
+// A ResumeBroker is a Broker able to keep the sessions and the last messages transmitted to them for a while, so that
+// a session can be resumed on another connection, on any node, after its connection is lost.
+type ResumeBroker interface {
+	Broker
+	// SaveSession creates or refreshes the given session, which expires after ttl. It returns ErrSessionResumed if the
+	// session is held by another owner.
+	SaveSession(session SessionState, ttl time.Duration) error
+	// BufferMessage appends the given message to the buffer of the given session, which keeps its last size messages,
+	// and refreshes the session. It returns the sequence number of the message in the session, or ErrSessionResumed if
+	// the session is held by another owner.
+	BufferMessage(session SessionState, message *BrokerMessage, size int, ttl time.Duration) (uint64, error)
+	// LoadSession returns the session of the given token, or ErrUnknownSession if it doesn't exist or expired.
+	LoadSession(token string) (SessionState, error)
+	// ResumeSession gives the session of the given token and user to the given owner, and returns it along with the
+	// buffered messages whose sequence number is greater than after. It returns ErrUnknownSession if the session
+	// doesn't exist, expired or belongs to another user.
+	ResumeSession(token string, userID uuid.UUID, owner string, after uint64, ttl time.Duration) (SessionState, []BufferedMessage, error)
+	// CloseSession deletes the given session and its buffer, unless the session is held by another owner.
+	CloseSession(session SessionState) error
+}
+
+// A SessionState describes a session which can be resumed after its connection is lost.
+type SessionState struct {
+	// The secret given to the user to resume the session.
+	Token     string
+	UserID    uuid.UUID
+	SessionID uuid.UUID
+	// Owner identifies the Client holding the session. It changes when the session is resumed.
+	Owner string
+}
+
+// A BufferedMessage is a message transmitted to a session, kept to be transmitted again if the session is resumed.
+type BufferedMessage struct {
+	// The position of the message in the messages transmitted to the session, starting at 1.
+	Sequence uint64
+	Message  *BrokerMessage
+}
+
+// HeartbeatInterval is the interval at which Clients signal that their session is still alive to a PresenceBroker.
+const HeartbeatInterval = 30 * time.Second
+
 // A BrokerMessage is sent between Brokers to transmit the messages to the right user.
 type BrokerMessage struct {
+	// The kind of the message: empty for text messages, DeliveredKind or ReadKind for receipts, and sentKind for the
+	// notifications of the messages sent from another session of the recipient.
+	Kind string `json:",omitempty"`
+	// The ID of the message sent by the user. For receipts, the ID of the message they refer to.
+	MessageID   uuid.UUID
 	SenderID    uuid.UUID
 	RecipientID uuid.UUID
-	Text        string
+	// If the message was sent to a room, RoomID is the ID of this room. Otherwise, it is uuid.Nil.
+	RoomID uuid.UUID
+	Text   string
+	// The time at which the message was accepted by the server that received it.
+	SentAt time.Time
+	// The position of the message in its conversation, if the Broker is a SequenceBroker. Otherwise, it is zero.
+	Sequence uint64 `json:",omitempty"`
+
+	// If not nil, written is called once the message was written on the WebSocket connection of the recipient.
+	written func()
 }
 
 // RedisBrokerPrefix is the prefix used for all keys registered by the RedisBroker.
 const RedisBrokerPrefix = "texto:"
 
+const (
+	// DefaultMailboxTTL is the default duration for which undelivered messages are kept.
+	DefaultMailboxTTL = 7 * 24 * time.Hour
+	// DefaultMailboxSize is the default maximum number of undelivered messages kept for a single user.
+	DefaultMailboxSize = 100
+	// DefaultPresenceTTL is the default duration after which a session that didn't send any heartbeat is considered
+	// closed.
+	DefaultPresenceTTL = 3 * HeartbeatInterval
+)
+
+// redisSendScriptSource publishes a message on the recipient's channel if they have at least one open session, or
+// stores it in their mailbox otherwise. The message is also stored in the mailbox when no node received it, as when the
+// node hosting the sessions stopped before they expired. Only the last ARGV[3] messages are kept in the mailbox, which
+// expires after ARGV[4] seconds. ARGV[5] is the current UNIX time, used to discard the expired sessions. It returns 1
+// if the message was published and 0 if it was stored. If the recipient is the room KEYS[3], nothing is sent and -1 is
+// returned.
+const redisSendScriptSource = `
+if redis.call("EXISTS", KEYS[3]) == 1 then
+	return -1
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[5])
+if redis.call("ZCARD", KEYS[1]) > 0 and redis.call("PUBLISH", ARGV[1], ARGV[2]) > 0 then
+	return 1
+end
+redis.call("RPUSH", KEYS[2], ARGV[2])
+redis.call("LTRIM", KEYS[2], -tonumber(ARGV[3]), -1)
+redis.call("EXPIRE", KEYS[2], ARGV[4])
+return 0
+`
+
+// redisJoinScriptSource adds the user ARGV[1] to the members of the room KEYS[1], if the room exists.
+const redisJoinScriptSource = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("SADD", KEYS[1], ARGV[1])
+return 1
+`
+
+// redisRegisterScriptSource adds the session ARGV[1] to the open sessions of a user for ARGV[3] seconds, and returns
+// the content of their mailbox, emptying it. ARGV[2] is the current UNIX time. If the user had no open session, the
+// ARGV[5] presence event is published on the ARGV[4] channel. The sessions are kept twice as long as they are open, so
+// that the expired ones are still found by redisExpireScriptSource.
+const redisRegisterScriptSource = `
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+if redis.call("ZCARD", KEYS[1]) == 0 then
+	redis.call("PUBLISH", ARGV[4], ARGV[5])
+end
+redis.call("ZADD", KEYS[1], tonumber(ARGV[2]) + tonumber(ARGV[3]), ARGV[1])
+redis.call("EXPIRE", KEYS[1], 2 * tonumber(ARGV[3]))
+local messages = redis.call("LRANGE", KEYS[2], 0, -1)
+redis.call("DEL", KEYS[2])
+return messages
+`
+
+// redisUnregisterScriptSource removes the session ARGV[1] from the open sessions of a user. ARGV[2] is the current
+// UNIX time. If the user has no open session left, it is stored as their last seen time and the ARGV[4] presence event
+// is published on the ARGV[3] channel.
+const redisUnregisterScriptSource = `
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+if redis.call("ZCARD", KEYS[1]) == 0 then
+	redis.call("SET", KEYS[2], ARGV[2])
+	redis.call("PUBLISH", ARGV[3], ARGV[4])
+end
+return 0
+`
+
+// redisHeartbeatScriptSource extends the lifetime of the session ARGV[1] to ARGV[2] + ARGV[3] seconds, and returns
+// the content of the mailbox KEYS[2], emptying it. The mailbox of a connected user holds the messages no node received.
+const redisHeartbeatScriptSource = `
+redis.call("ZADD", KEYS[1], tonumber(ARGV[2]) + tonumber(ARGV[3]), ARGV[1])
+redis.call("EXPIRE", KEYS[1], 2 * tonumber(ARGV[3]))
+local messages = redis.call("LRANGE", KEYS[2], 0, -1)
+redis.call("DEL", KEYS[2])
+return messages
+`
+
+// redisExpireScriptSource removes the sessions of a user that expired before ARGV[1], the current UNIX time. If
+// it removed the last one, it is stored as their last seen time and the ARGV[3] presence event is published on the
+// ARGV[2] channel. It returns the number of removed sessions.
+const redisExpireScriptSource = `
+local expired = redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if expired > 0 and redis.call("ZCARD", KEYS[1]) == 0 then
+	redis.call("SET", KEYS[2], ARGV[1])
+	redis.call("PUBLISH", ARGV[2], ARGV[3])
+end
+return expired
+`
+
+// redisClaimSentScriptSource stores the pending marker ARGV[1] of a message in KEYS[1] for ARGV[2] milliseconds, unless
+// the marker or the acknowledgement of the message was already stored, in which case it is returned.
+const redisClaimSentScriptSource = `
+local existing = redis.call("GET", KEYS[1])
+if existing then
+	return existing
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return false
+`
+
+// redisSaveSessionScriptSource stores the session of the owner ARGV[1], user ARGV[2] and ID ARGV[3] in the hash
+// KEYS[1], unless it is held by another owner, and makes it and its buffer KEYS[2] expire after ARGV[4] milliseconds.
+const redisSaveSessionScriptSource = `
+local owner = redis.call("HGET", KEYS[1], "owner")
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call("HMSET", KEYS[1], "owner", ARGV[1], "user", ARGV[2], "session", ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+redis.call("PEXPIRE", KEYS[2], ARGV[4])
+return 1
+`
+
+// redisBufferMessageScriptSource saves the session as redisSaveSessionScriptSource, then numbers the message ARGV[6]
+// and appends it to the buffer KEYS[2], which keeps the last ARGV[5] messages. It returns the number of the message.
+const redisBufferMessageScriptSource = `
+local owner = redis.call("HGET", KEYS[1], "owner")
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call("HMSET", KEYS[1], "owner", ARGV[1], "user", ARGV[2], "session", ARGV[3])
+local sequence = redis.call("HINCRBY", KEYS[1], "sequence", 1)
+redis.call("RPUSH", KEYS[2], sequence .. " " .. ARGV[6])
+redis.call("LTRIM", KEYS[2], -tonumber(ARGV[5]), -1)
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+redis.call("PEXPIRE", KEYS[2], ARGV[4])
+return sequence
+`
+
+// redisResumeSessionScriptSource gives the session KEYS[1] of the user ARGV[2] to the owner ARGV[1], makes it and its
+// buffer KEYS[2] expire after ARGV[3] milliseconds, and returns the ID of the session and the buffered messages.
+const redisResumeSessionScriptSource = `
+local session = redis.call("HMGET", KEYS[1], "user", "session")
+if not session[1] or session[1] ~= ARGV[2] then
+	return false
+end
+redis.call("HSET", KEYS[1], "owner", ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+redis.call("PEXPIRE", KEYS[2], ARGV[3])
+return {session[2], redis.call("LRANGE", KEYS[2], 0, -1)}
+`
+
+// redisCloseSessionScriptSource deletes the session KEYS[1] and its buffer KEYS[2], if they are held by ARGV[1].
+const redisCloseSessionScriptSource = `
+local owner = redis.call("HGET", KEYS[1], "owner")
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+return 1
+`
+
+var (
+	redisSendScript          = redis.NewScript(3, redisSendScriptSource)
+	redisRegisterScript      = redis.NewScript(2, redisRegisterScriptSource)
+	redisUnregisterScript    = redis.NewScript(2, redisUnregisterScriptSource)
+	redisHeartbeatScript     = redis.NewScript(2, redisHeartbeatScriptSource)
+	redisExpireScript        = redis.NewScript(2, redisExpireScriptSource)
+	redisJoinScript          = redis.NewScript(1, redisJoinScriptSource)
+	redisClaimSentScript     = redis.NewScript(1, redisClaimSentScriptSource)
+	redisSaveSessionScript   = redis.NewScript(2, redisSaveSessionScriptSource)
+	redisBufferMessageScript = redis.NewScript(2, redisBufferMessageScriptSource)
+	redisResumeSessionScript = redis.NewScript(2, redisResumeSessionScriptSource)
+	redisCloseSessionScript  = redis.NewScript(2, redisCloseSessionScriptSource)
+)
+
 // A RedisBroker transmits messages between users using Redis as its backend.
 type RedisBroker struct {
-	Log        *logrus.Logger
-	clients    sync.Map
-	conn       redis.Conn
-	pubSubConn redis.PubSubConn
+	Log *logrus.Logger
+	// MailboxTTL is the duration for which messages sent to offline users are kept.
+	MailboxTTL time.Duration
+	// MailboxSize is the maximum number of messages kept for an offline user. Older messages are discarded first.
+	MailboxSize int
+	// PresenceTTL is the duration after which a session that didn't send any heartbeat is considered closed.
+	PresenceTTL time.Duration
+	// ReconnectMinDelay is the delay before the first attempt to reconnect the subscriber after a failure. It doubles
+	// after each failed attempt, up to ReconnectMaxDelay.
+	ReconnectMinDelay time.Duration
+	// ReconnectMaxDelay is the maximum delay between two attempts to reconnect the subscriber.
+	ReconnectMaxDelay time.Duration
+	// Routing is the strategy used to receive the messages intended for the users connected to this node.
+	Routing      RedisRouting
+	clients      clientRegistry
+	presence     presenceRegistry
+	subscription redisSubscription
+	// pool provides the connections used to send commands to Redis.
+	pool *redis.Pool
+	// dial opens a new connection to the Redis server, used by the subscriber.
+	dial func(options ...redis.DialOption) (redis.Conn, error)
+	// subscribed is set to 1 while the subscriber is subscribed to the channels. It must be accessed atomically.
+	subscribed int32
 }
 
-// NewRedisBroker creates a new RedisBroker instance, connecting to the Redis server using the given TCP address.
+const (
+	// DefaultReconnectMinDelay is the default value of RedisBroker.ReconnectMinDelay.
+	DefaultReconnectMinDelay = 100 * time.Millisecond
+	// DefaultReconnectMaxDelay is the default value of RedisBroker.ReconnectMaxDelay.
+	DefaultReconnectMaxDelay = 30 * time.Second
+)
+
+// NewRedisBroker creates a new RedisBroker instance, connecting to Redis using the given address. It is either a TCP
+// address, or a redis://, rediss://, sentinel:// or redis+cluster:// URL.
 func NewRedisBroker(log *logrus.Logger, addr string) (*RedisBroker, error) {
-	redisConn, err := redis.Dial("tcp", addr)
+	dial, err := newRedisDialer(addr)
 	if err != nil {
 		return nil, err
 	}
-	pubSubConn, err := redis.Dial("tcp", addr)
+	return newRedisBroker(log, dial)
+}
+
+// newRedisBroker creates a new RedisBroker instance opening its connections using the given function, and checks that
+// the Redis server is reachable.
+func newRedisBroker(log *logrus.Logger, dial func(options ...redis.DialOption) (redis.Conn, error)) (*RedisBroker, error) {
+	b := &RedisBroker{
+		Log:               log,
+		MailboxTTL:        DefaultMailboxTTL,
+		MailboxSize:       DefaultMailboxSize,
+		PresenceTTL:       DefaultPresenceTTL,
+		ReconnectMinDelay: DefaultReconnectMinDelay,
+		ReconnectMaxDelay: DefaultReconnectMaxDelay,
+		pool:              newRedisPool(dial),
+		dial:              dial,
+	}
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		b.pool.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// newRedisPool returns a pool of connections opened using the given function. Connections that were idle for more than
+// a minute are checked before being reused.
+func newRedisPool(dial func(options ...redis.DialOption) (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return dial()
+		},
+		TestOnBorrow: func(conn redis.Conn, idleSince time.Time) error {
+			if time.Since(idleSince) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
+
+// sessionsKey returns the key of the sorted set storing the IDs of the open sessions of the given user, across all
+// nodes. Each session is scored by the UNIX time at which it expires if no heartbeat is received.
+//
+// The keys of a user are hash tagged with their ID, so that they are stored on the same node of a Redis Cluster and can
+// be used by the same script.
+func sessionsKey(id uuid.UUID) string {
+	return RedisBrokerPrefix + "sessions:{" + id.String() + "}"
+}
+
+// lastSeenKey returns the key storing the UNIX time at which the last session of the given user was closed.
+func lastSeenKey(id uuid.UUID) string {
+	return RedisBrokerPrefix + "lastseen:{" + id.String() + "}"
+}
+
+// messageChannel returns the channel on which the messages intended for the given user are published.
+func messageChannel(id uuid.UUID) string {
+	return RedisBrokerPrefix + id.String()
+}
+
+// presenceChannelPrefix prefixes the channels on which the presence events of users are published.
+const presenceChannelPrefix = RedisBrokerPrefix + "presence:"
+
+// presenceChannel returns the channel on which the presence events of the given user are published.
+func presenceChannel(id uuid.UUID) string {
+	return presenceChannelPrefix + id.String()
+}
+
+// mailboxKey returns the key of the list storing the undelivered messages of the given user.
+func mailboxKey(id uuid.UUID) string {
+	return RedisBrokerPrefix + "mailbox:{" + id.String() + "}"
+}
+
+// sequenceKey returns the key of the counter numbering the messages of the given conversation.
+func sequenceKey(conversationID uuid.UUID) string {
+	return RedisBrokerPrefix + "seq:{" + conversationID.String() + "}"
+}
+
+// nextRedisSequence increments the counter numbering the messages of the given conversation, and returns its value.
+func nextRedisSequence(pool *redis.Pool, conversationID uuid.UUID) (uint64, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	return redis.Uint64(conn.Do("INCR", sequenceKey(conversationID)))
+}
+
+// NextSequence returns the next sequence number of the given conversation, shared by all the nodes.
+func (b *RedisBroker) NextSequence(conversationID uuid.UUID) (uint64, error) {
+	return nextRedisSequence(b.pool, conversationID)
+}
+
+// sentKey returns the key storing the acknowledgement of the message of the given ID sent by the given user.
+func sentKey(senderID uuid.UUID, messageID uuid.UUID) string {
+	return RedisBrokerPrefix + "sent:{" + senderID.String() + "}:" + messageID.String()
+}
+
+// redisPendingSend is the value of the key of a claimed message, until its acknowledgement is recorded.
+const redisPendingSend = "pending"
+
+// claimRedisSentMessage claims the given message in Redis, and returns its acknowledgement if it was already sent.
+func claimRedisSentMessage(pool *redis.Pool, senderID uuid.UUID, messageID uuid.UUID, ttl time.Duration) (*AckMessagePayload, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	reply, err := redisClaimSentScript.Do(conn, sentKey(senderID, messageID), redisPendingSend, int64(ttl/time.Millisecond))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, err := redis.Bytes(reply, err)
 	if err != nil {
 		return nil, err
 	}
-	return &RedisBroker{
-		Log:        log,
-		conn:       redisConn,
-		pubSubConn: redis.PubSubConn{Conn: pubSubConn},
-	}, nil
+	if string(data) == redisPendingSend {
+		return nil, ErrSendPending
+	}
+	ack := new(AckMessagePayload)
+	if err := json.Unmarshal(data, ack); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// recordRedisSentMessage stores the acknowledgement of the given message in Redis, replacing its claim.
+func recordRedisSentMessage(pool *redis.Pool, senderID uuid.UUID, messageID uuid.UUID, ack AckMessagePayload, ttl time.Duration) error {
+	marshaled, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", sentKey(senderID, messageID), marshaled, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+// forgetRedisSentMessage removes the claim or the acknowledgement of the given message from Redis.
+func forgetRedisSentMessage(pool *redis.Pool, senderID uuid.UUID, messageID uuid.UUID) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", sentKey(senderID, messageID))
+	return err
+}
+
+// ClaimSentMessage claims the given message for all the nodes, and returns its acknowledgement if it was already sent.
+func (b *RedisBroker) ClaimSentMessage(senderID uuid.UUID, messageID uuid.UUID, ttl time.Duration) (*AckMessagePayload, error) {
+	return claimRedisSentMessage(b.pool, senderID, messageID, ttl)
+}
+
+// RecordSentMessage records the acknowledgement of the given message for all the nodes.
+func (b *RedisBroker) RecordSentMessage(senderID uuid.UUID, messageID uuid.UUID, ack AckMessagePayload, ttl time.Duration) error {
+	return recordRedisSentMessage(b.pool, senderID, messageID, ack, ttl)
+}
+
+// ForgetSentMessage removes the claim or the acknowledgement of the given message.
+func (b *RedisBroker) ForgetSentMessage(senderID uuid.UUID, messageID uuid.UUID) error {
+	return forgetRedisSentMessage(b.pool, senderID, messageID)
+}
+
+// resumeKey returns the key of the hash storing the resumable session of the given token. The keys of a session are
+// hash tagged with its token.
+func resumeKey(token string) string {
+	return RedisBrokerPrefix + "resume:{" + token + "}"
+}
+
+// resumeBufferKey returns the key of the list storing the last messages transmitted to the session of the given token,
+// each prefixed by its sequence number and a space.
+func resumeBufferKey(token string) string {
+	return resumeKey(token) + ":buffer"
+}
+
+// saveRedisSession stores the given session in Redis.
+func saveRedisSession(pool *redis.Pool, session SessionState, ttl time.Duration) error {
+	conn := pool.Get()
+	defer conn.Close()
+	saved, err := redis.Int(redisSaveSessionScript.Do(
+		conn,
+		resumeKey(session.Token),
+		resumeBufferKey(session.Token),
+		session.Owner,
+		session.UserID.String(),
+		session.SessionID.String(),
+		int64(ttl/time.Millisecond),
+	))
+	if err == nil && saved == 0 {
+		err = ErrSessionResumed
+	}
+	return err
+}
+
+// bufferRedisMessage appends the given message to the buffer of the given session stored in Redis.
+func bufferRedisMessage(pool *redis.Pool, session SessionState, message *BrokerMessage, size int, ttl time.Duration) (uint64, error) {
+	marshaled, err := json.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	sequence, err := redis.Uint64(redisBufferMessageScript.Do(
+		conn,
+		resumeKey(session.Token),
+		resumeBufferKey(session.Token),
+		session.Owner,
+		session.UserID.String(),
+		session.SessionID.String(),
+		int64(ttl/time.Millisecond),
+		size,
+		marshaled,
+	))
+	if err == nil && sequence == 0 {
+		err = ErrSessionResumed
+	}
+	return sequence, err
+}
+
+// loadRedisSession returns the session of the given token stored in Redis.
+func loadRedisSession(pool *redis.Pool, token string) (SessionState, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redis.Strings(conn.Do("HMGET", resumeKey(token), "owner", "user", "session"))
+	if err != nil {
+		return SessionState{}, err
+	}
+	return parseRedisSession(token, values[0], values[1], values[2])
+}
+
+// parseRedisSession returns the session of the given token, owner, user and session ID read from Redis.
+func parseRedisSession(token string, owner string, userID string, sessionID string) (SessionState, error) {
+	session := SessionState{Token: token, Owner: owner}
+	var err error
+	if session.UserID, err = uuid.FromString(userID); err != nil {
+		return SessionState{}, ErrUnknownSession
+	}
+	if session.SessionID, err = uuid.FromString(sessionID); err != nil {
+		return SessionState{}, ErrUnknownSession
+	}
+	return session, nil
+}
+
+// resumeRedisSession gives the session of the given token stored in Redis to the given owner, and returns its buffered
+// messages.
+func resumeRedisSession(pool *redis.Pool, token string, userID uuid.UUID, owner string, after uint64, ttl time.Duration) (SessionState, []BufferedMessage, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(redisResumeSessionScript.Do(
+		conn,
+		resumeKey(token),
+		resumeBufferKey(token),
+		owner,
+		userID.String(),
+		int64(ttl/time.Millisecond),
+	))
+	if err == redis.ErrNil {
+		return SessionState{}, nil, ErrUnknownSession
+	}
+	if err != nil {
+		return SessionState{}, nil, err
+	}
+	if len(reply) != 2 {
+		return SessionState{}, nil, ErrUnknownSession
+	}
+	sessionID, err := redis.String(reply[0], nil)
+	if err != nil {
+		return SessionState{}, nil, err
+	}
+	entries, err := redis.ByteSlices(reply[1], nil)
+	if err != nil {
+		return SessionState{}, nil, err
+	}
+	session, err := parseRedisSession(token, owner, userID.String(), sessionID)
+	if err != nil {
+		return SessionState{}, nil, err
+	}
+	var messages []BufferedMessage
+	for _, entry := range entries {
+		parts := strings.SplitN(string(entry), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		sequence, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || sequence <= after {
+			continue
+		}
+		message := new(BrokerMessage)
+		if err := json.Unmarshal([]byte(parts[1]), message); err != nil {
+			return SessionState{}, nil, err
+		}
+		messages = append(messages, BufferedMessage{Sequence: sequence, Message: message})
+	}
+	return session, messages, nil
+}
+
+// closeRedisSession deletes the given session from Redis.
+func closeRedisSession(pool *redis.Pool, session SessionState) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := redisCloseSessionScript.Do(conn, resumeKey(session.Token), resumeBufferKey(session.Token), session.Owner)
+	return err
+}
+
+// SaveSession creates or refreshes the given session, shared by all the nodes.
+func (b *RedisBroker) SaveSession(session SessionState, ttl time.Duration) error {
+	return saveRedisSession(b.pool, session, ttl)
+}
+
+// BufferMessage appends the given message to the buffer of the given session, shared by all the nodes.
+func (b *RedisBroker) BufferMessage(session SessionState, message *BrokerMessage, size int, ttl time.Duration) (uint64, error) {
+	return bufferRedisMessage(b.pool, session, message, size, ttl)
+}
+
+// LoadSession returns the session of the given token.
+func (b *RedisBroker) LoadSession(token string) (SessionState, error) {
+	return loadRedisSession(b.pool, token)
+}
+
+// ResumeSession gives the session of the given token to the given owner, and returns its buffered messages.
+func (b *RedisBroker) ResumeSession(token string, userID uuid.UUID, owner string, after uint64, ttl time.Duration) (SessionState, []BufferedMessage, error) {
+	return resumeRedisSession(b.pool, token, userID, owner, after, ttl)
+}
+
+// CloseSession deletes the given session and its buffer.
+func (b *RedisBroker) CloseSession(session SessionState) error {
+	return closeRedisSession(b.pool, session)
 }
 
-// Register registers a Client in the internal Client map of the Broker.
+// Register registers a Client in the internal Client registry of the Broker, adds it to the open sessions of its user
+// and delivers the messages that were sent while the user was offline.
 func (b *RedisBroker) Register(client *Client) error {
-	b.clients.Store(client.ID.String(), client)
+	b.waitSubscribed(b.addClient(client))
+	conn := b.pool.Get()
+	defer conn.Close()
+	event, err := json.Marshal(PresenceMessagePayload{
+		UserID: client.ID,
+		Status: PresenceOnline,
+	})
+	if err != nil {
+		return err
+	}
+	messages, err := redis.ByteSlices(redisRegisterScript.Do(
+		conn,
+		sessionsKey(client.ID),
+		mailboxKey(client.ID),
+		client.SessionID.String(),
+		time.Now().Unix(),
+		int(b.PresenceTTL/time.Second),
+		presenceChannel(client.ID),
+		event,
+	))
+	if err != nil {
+		return err
+	}
+	b.deliverMailbox(client, messages)
 	return nil
 }
 
-// Unregister removes a Client from the internal Client map of the Broker.
+// deliverMailbox delivers the messages read from the mailbox of its user to the given Client.
+func (b *RedisBroker) deliverMailbox(client *Client, messages [][]byte) {
+	for _, data := range messages {
+		message := new(BrokerMessage)
+		if err := json.Unmarshal(data, message); err != nil {
+			b.Log.Error(err)
+			continue
+		}
+		client.deliver(message)
+	}
+}
+
+// Unregister removes a Client from the internal Client registry of the Broker and from the open sessions of its user.
 func (b *RedisBroker) Unregister(client *Client) error {
-	b.clients.Delete(client.ID.String())
-	return nil
+	b.removeClient(client)
+	conn := b.pool.Get()
+	defer conn.Close()
+	now := time.Now()
+	event, err := json.Marshal(PresenceMessagePayload{
+		UserID:   client.ID,
+		Status:   PresenceOffline,
+		LastSeen: &now,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = redisUnregisterScript.Do(
+		conn,
+		sessionsKey(client.ID),
+		lastSeenKey(client.ID),
+		client.SessionID.String(),
+		now.Unix(),
+		presenceChannel(client.ID),
+		event,
+	)
+	return err
 }
 
-// PumpMessages subscribe to Redis channels, reads all incoming messages and sends them into the given channel.
-// If an error is encountered while reading the messages, the channel is closed and the function exits.
-func (b *RedisBroker) PumpMessages(channelsPattern string, out chan *redis.PMessage) {
-	if err := b.pubSubConn.PSubscribe(channelsPattern); err != nil {
-		b.Log.Error()
-		return
+// Heartbeat extends the lifetime of the session of the given Client, and delivers the messages stored in the mailbox of
+// its user because no node received them.
+func (b *RedisBroker) Heartbeat(client *Client) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	messages, err := redis.ByteSlices(redisHeartbeatScript.Do(
+		conn,
+		sessionsKey(client.ID),
+		mailboxKey(client.ID),
+		client.SessionID.String(),
+		time.Now().Unix(),
+		int(b.PresenceTTL/time.Second),
+	))
+	if err != nil {
+		return err
 	}
-	defer func() {
-		if err := b.pubSubConn.PUnsubscribe(channelsPattern); err != nil {
-			b.Log.Error()
-			return
+	b.deliverMailbox(client, messages)
+	return nil
+}
+
+// expireSessions removes the expired sessions of the users whose presence is watched by Clients of this node, which
+// were left by a node that stopped without unregistering them. The node removing the last session of a user publishes
+// its offline event, like Unregister.
+func (b *RedisBroker) expireSessions() error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	now := time.Now()
+	for _, userID := range b.presence.userIDs() {
+		event, err := json.Marshal(PresenceMessagePayload{
+			UserID:   userID,
+			Status:   PresenceOffline,
+			LastSeen: &now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = redisExpireScript.Do(
+			conn,
+			sessionsKey(userID),
+			lastSeenKey(userID),
+			now.Unix(),
+			presenceChannel(userID),
+			event,
+		)
+		if err != nil {
+			return err
 		}
-	}()
+	}
+	return nil
+}
+
+// expireSessionsPeriodically calls expireSessions at every HeartbeatInterval, until the given context is done.
+func (b *RedisBroker) expireSessionsPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
 	for {
-		switch n := b.pubSubConn.Receive().(type) {
-		case redis.PMessage:
-			b.Log.
-				WithField("channel", n.Channel).
-				Info("Received pmessage")
-			out <- &n
-		case error:
-			b.Log.Error(n)
-			close(out)
+		select {
+		case <-ticker.C:
+			if err := b.expireSessions(); err != nil {
+				b.Log.Error(err)
+			}
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// SubscribePresence subscribes the given Client to the presence events of the given users, and returns their current
+// presence.
+func (b *RedisBroker) SubscribePresence(client *Client, userIDs []uuid.UUID) ([]PresenceMessagePayload, error) {
+	b.waitSubscribed(b.addPresenceSubscriptions(client, userIDs)...)
+	return loadRedisPresences(b.pool, userIDs)
+}
+
+// loadRedisPresences returns the current presence of the given users, according to their open sessions.
+func loadRedisPresences(pool *redis.Pool, userIDs []uuid.UUID) ([]PresenceMessagePayload, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	presences := make([]PresenceMessagePayload, 0, len(userIDs))
+	now := time.Now().Unix()
+	for _, userID := range userIDs {
+		sessions, err := redis.Int(conn.Do("ZCOUNT", sessionsKey(userID), now, "+inf"))
+		if err != nil {
+			return nil, err
+		}
+		presence := PresenceMessagePayload{
+			UserID: userID,
+			Status: PresenceOnline,
+		}
+		if sessions == 0 {
+			presence.Status = PresenceOffline
+			lastSeen, err := redis.Int64(conn.Do("GET", lastSeenKey(userID)))
+			if err != nil && err != redis.ErrNil {
+				return nil, err
+			}
+			if err == nil {
+				lastSeenTime := time.Unix(lastSeen, 0)
+				presence.LastSeen = &lastSeenTime
+			}
+		}
+		presences = append(presences, presence)
+	}
+	return presences, nil
+}
+
+// UnsubscribePresence unsubscribes the given Client from the presence events of the given users.
+func (b *RedisBroker) UnsubscribePresence(client *Client, userIDs []uuid.UUID) error {
+	b.removePresenceSubscriptions(client, userIDs)
+	return nil
+}
+
 // Poll reads all messages published on the Redis server. If a message is intended to a known user, the Broker will send
-// it into the recipient's outboundChan.
+// it into the outboundChan of each of the recipient's sessions. Presence events are transmitted to the Clients
+// subscribed to them, and the sessions of the watched users that expired are closed periodically. The subscription to the
+// Redis channels is restored automatically if it is lost.
 func (b *RedisBroker) Poll(ctx context.Context) error {
-	channelsPattern := RedisBrokerPrefix + "*"
-	inbound := make(chan *redis.PMessage, 128)
-	go b.PumpMessages(channelsPattern, inbound)
+	inbound := make(chan *redis.Message, 128)
+	go b.subscribe(ctx, inbound)
+	go b.expireSessionsPeriodically(ctx)
 	for {
 		select {
-		case pmessage := <-inbound:
-			if pmessage == nil {
+		case received := <-inbound:
+			pollBacklog.set(float64(len(inbound)))
+			if strings.HasPrefix(received.Channel, presenceChannelPrefix) {
+				presence := PresenceMessagePayload{}
+				if err := json.Unmarshal(received.Data, &presence); err != nil {
+					b.Log.Error(err)
+					break
+				}
+				for _, client := range b.presence.subscribers(presence.UserID) {
+					client.deliverPresence(presence)
+				}
 				break
 			}
 			message := new(BrokerMessage)
-			if err := json.Unmarshal(pmessage.Data, message); err != nil {
+			if err := json.Unmarshal(received.Data, message); err != nil {
 				b.Log.Error(err)
 				break
 			}
-			v, ok := b.clients.Load(message.RecipientID.String())
-			if !ok {
-				break
+			sessions := b.clients.sessions(message.RecipientID)
+			if len(sessions) == 0 {
+				droppedMessages.inc(dropUnknownRecipient)
 			}
-			client, ok := v.(*Client)
-			if !ok {
-				b.Log.
-					WithField("sender", message.SenderID).
-					WithField("recipient", message.RecipientID).
-					Warn("Value is not a valid *Client")
-				break
+			for _, client := range sessions {
+				client.deliver(message)
 			}
-			go func() {
-				client.outboundChan <- NewReceiveMessage(nil, message.RecipientID, ReceiveMessagePayload{
-					SenderID: message.SenderID,
-					Text:     message.Text,
-				})
-			}()
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
-// Send publishes the given message on the Redis server.
+// CheckHealth is the implementation of HealthChecker.CheckHealth for RedisBroker. It fails if the Redis server doesn't
+// answer to a PING, or if the Broker isn't subscribed to the channels of the other nodes.
+func (b *RedisBroker) CheckHealth() error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&b.subscribed) == 0 {
+		return ErrSubscriptionClosed
+	}
+	return nil
+}
+
+// Send publishes the given message on the Redis server. If the recipient is offline, the message is stored in their
+// mailbox until they connect. If the recipient is a room, ErrRoomRecipient is returned.
 func (b *RedisBroker) Send(receiverID uuid.UUID, message *BrokerMessage) error {
+	conn := b.pool.Get()
+	defer conn.Close()
 	marshaled, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
-	_, err = b.conn.Do("PUBLISH", RedisBrokerPrefix+receiverID.String(), marshaled)
+	defer redisPublishDuration.observeSince(time.Now())
+	sent, err := b.send(conn, receiverID, marshaled)
+	if err == nil && sent < 0 {
+		return ErrRoomRecipient
+	}
 	return err
 }
+
+// send runs the send script for the given recipient. All its keys are hash tagged with the ID of the recipient, so that
+// it runs on a single node of a Redis Cluster.
+func (b *RedisBroker) send(conn redis.Conn, receiverID uuid.UUID, marshaled []byte) (int, error) {
+	return redis.Int(redisSendScript.Do(
+		conn,
+		sessionsKey(receiverID),
+		mailboxKey(receiverID),
+		roomKey(receiverID),
+		messageChannel(receiverID),
+		marshaled,
+		b.MailboxSize,
+		int(b.MailboxTTL/time.Second),
+		time.Now().Unix(),
+	))
+}
+
+// SendRoom publishes the given message for all the other members of its room, or stores it in the mailboxes of the
+// offline ones. The members are read first, and the message is then sent to each of them by its own script, since
+// their keys may be served by different nodes of a Redis Cluster.
+func (b *RedisBroker) SendRoom(message *BrokerMessage) error {
+	members, err := b.RoomMembers(message.RoomID)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return ErrUnknownRoom
+	}
+	member := false
+	for _, id := range members {
+		member = member || id == message.SenderID
+	}
+	if !member {
+		return ErrNotRoomMember
+	}
+	conn := b.pool.Get()
+	defer conn.Close()
+	defer redisPublishDuration.observeSince(time.Now())
+	for _, id := range members {
+		if id == message.SenderID {
+			continue
+		}
+		copied := *message
+		copied.RecipientID = id
+		marshaled, err := json.Marshal(&copied)
+		if err != nil {
+			return err
+		}
+		if _, err := b.send(conn, id, marshaled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// roomKey returns the key of the set storing the IDs of the members of the given room. It is hash tagged with the ID of
+// the room, so that Send can check whether a recipient is a room.
+func roomKey(id uuid.UUID) string {
+	return RedisBrokerPrefix + "room:{" + id.String() + "}"
+}
+
+// CreateRoom creates a new room, whose only member is the given user.
+func (b *RedisBroker) CreateRoom(roomID uuid.UUID, ownerID uuid.UUID) error {
+	return createRedisRoom(b.pool, roomID, ownerID)
+}
+
+// JoinRoom adds the given user to the members of an existing room.
+func (b *RedisBroker) JoinRoom(roomID uuid.UUID, userID uuid.UUID) error {
+	return joinRedisRoom(b.pool, roomID, userID)
+}
+
+// LeaveRoom removes the given user from the members of a room.
+func (b *RedisBroker) LeaveRoom(roomID uuid.UUID, userID uuid.UUID) error {
+	return leaveRedisRoom(b.pool, roomID, userID)
+}
+
+// RoomMembers returns the IDs of the members of a room.
+func (b *RedisBroker) RoomMembers(roomID uuid.UUID) ([]uuid.UUID, error) {
+	return redisRoomMembers(b.pool, roomID)
+}
+
+// createRedisRoom creates a new room, whose only member is the given user.
+func createRedisRoom(pool *redis.Pool, roomID uuid.UUID, ownerID uuid.UUID) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SADD", roomKey(roomID), ownerID.String())
+	return err
+}
+
+// joinRedisRoom adds the given user to the members of an existing room.
+func joinRedisRoom(pool *redis.Pool, roomID uuid.UUID, userID uuid.UUID) error {
+	conn := pool.Get()
+	defer conn.Close()
+	joined, err := redis.Bool(redisJoinScript.Do(conn, roomKey(roomID), userID.String()))
+	if err != nil {
+		return err
+	}
+	if !joined {
+		return ErrUnknownRoom
+	}
+	return nil
+}
+
+// leaveRedisRoom removes the given user from the members of a room.
+func leaveRedisRoom(pool *redis.Pool, roomID uuid.UUID, userID uuid.UUID) error {
+	conn := pool.Get()
+	defer conn.Close()
+	removed, err := redis.Int(conn.Do("SREM", roomKey(roomID), userID.String()))
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotRoomMember
+	}
+	return nil
+}
+
+// redisRoomMembers returns the IDs of the members of a room.
+func redisRoomMembers(pool *redis.Pool, roomID uuid.UUID) ([]uuid.UUID, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redis.Strings(conn.Do("SMEMBERS", roomKey(roomID)))
+	if err != nil {
+		return nil, err
+	}
+	members := make([]uuid.UUID, 0, len(values))
+	for _, value := range values {
+		member, err := uuid.FromString(value)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
@@ -3,8 +3,12 @@ package texto
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
@@ -12,74 +16,66 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func mapLen(map_ *sync.Map) int {
-	length := 0
-	map_.Range(func(key, value interface{}) bool {
-		length++
-		return true
-	})
-	return length
-}
-
-type DummyBroker struct {}
-
-func newDummyBroker() *DummyBroker {
-	return new(DummyBroker)
-}
-
-func (b *DummyBroker) Register(client *Client) error {
-	return nil
-}
-
-func (b *DummyBroker) Unregister(client *Client) error {
-	return nil
-}
-
-func (b *DummyBroker) Send(receiverID uuid.UUID, message *BrokerMessage) error {
-	return nil
-}
-
-func (b *DummyBroker) Poll(ctx context.Context) error {
-	return nil
+// newMockPool returns a pool whose connections are all the given connection.
+func newMockPool(conn redis.Conn) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return conn, nil
+		},
+	}
 }
 
 func TestRedisBroker_Register(t *testing.T) {
 	log := newLogger()
+	mockConn := redigomock.NewConn()
+	mockConn.GenericCommand("EVALSHA").Expect([]interface{}{})
 	broker := RedisBroker{
 		Log: log,
-		conn: redigomock.NewConn(),
-		pubSubConn: redis.PubSubConn{Conn: redigomock.NewConn()},
+		pool: newMockPool(mockConn),
 	}
-	assert.Equal(t, 0, mapLen(&broker.clients))
+	assert.Equal(t, 0, broker.clients.len())
 	firstClient := NewClient(log, nil, &broker)
-	broker.Register(firstClient)
-	assert.Equal(t, 1, mapLen(&broker.clients))
-	broker.Register(NewClient(log, nil, &broker))
-	assert.Equal(t, 2, mapLen(&broker.clients))
-	broker.Register(firstClient)
-	assert.Equal(t, 2, mapLen(&broker.clients))
+	assert.Nil(t, broker.Register(firstClient))
+	assert.Equal(t, 1, broker.clients.len())
+	assert.Nil(t, broker.Register(NewClient(log, nil, &broker)))
+	assert.Equal(t, 2, broker.clients.len())
+	assert.Nil(t, broker.Register(firstClient))
+	assert.Equal(t, 2, broker.clients.len())
 }
 
 func TestRedisBroker_Unregister(t *testing.T) {
 	log := newLogger()
+	mockConn := redigomock.NewConn()
 	broker := RedisBroker{
 		Log: log,
-		conn: redigomock.NewConn(),
-		pubSubConn: redis.PubSubConn{Conn: redigomock.NewConn()},
+		pool: newMockPool(mockConn),
 	}
 	firstClient := NewClient(log, nil, &broker)
-	broker.clients.Store(firstClient.ID.String(), firstClient)
+	broker.clients.add(firstClient)
 	secondClient := NewClient(log, nil, &broker)
-	broker.clients.Store(secondClient.ID.String(), secondClient)
+	secondClient.ID = firstClient.ID
+	broker.clients.add(secondClient)
 	thirdClient := NewClient(log, nil, &broker)
-	broker.clients.Store(thirdClient.ID.String(), thirdClient)
-	assert.Equal(t, 3, mapLen(&broker.clients))
-	broker.Unregister(thirdClient)
-	assert.Equal(t, 2, mapLen(&broker.clients))
-	broker.Unregister(secondClient)
-	assert.Equal(t, 1, mapLen(&broker.clients))
-	broker.Unregister(firstClient)
-	assert.Equal(t, 0, mapLen(&broker.clients))
+	broker.clients.add(thirdClient)
+	assert.Equal(t, 3, broker.clients.len())
+	for _, client := range []*Client{firstClient, secondClient, thirdClient} {
+		mockConn.Script(
+			[]byte(redisUnregisterScriptSource),
+			2,
+			"texto:sessions:{" + client.ID.String() + "}",
+			"texto:lastseen:{" + client.ID.String() + "}",
+			client.SessionID.String(),
+			redigomock.NewAnyInt(),
+			"texto:presence:" + client.ID.String(),
+			redigomock.NewAnyData(),
+		).Expect(int64(0))
+	}
+	assert.Nil(t, broker.Unregister(thirdClient))
+	assert.Equal(t, 2, broker.clients.len())
+	assert.Nil(t, broker.Unregister(secondClient))
+	assert.Equal(t, 1, broker.clients.len())
+	assert.Nil(t, broker.Unregister(firstClient))
+	assert.Equal(t, 0, broker.clients.len())
 }
 
 func TestRedisBroker_Send(t *testing.T) {
@@ -91,13 +87,350 @@ func TestRedisBroker_Send(t *testing.T) {
 	mockConn := redigomock.NewConn()
 	broker := RedisBroker{
 		Log: log,
-		conn: mockConn,
-		pubSubConn: redis.PubSubConn{Conn: redigomock.NewConn()},
+		MailboxTTL: time.Hour,
+		MailboxSize: 10,
+		pool: newMockPool(mockConn),
 	}
 	err := broker.Send(message.RecipientID, message)
 	assert.Error(t, err)
 	marshaled, _ := json.Marshal(message)
-	mockConn.Command("PUBLISH", "texto:" + message.RecipientID.String(), marshaled).Expect("ok")
+	mockConn.Script(
+		[]byte(redisSendScriptSource),
+		3,
+		"texto:sessions:{" + message.RecipientID.String() + "}",
+		"texto:mailbox:{" + message.RecipientID.String() + "}",
+		"texto:room:{" + message.RecipientID.String() + "}",
+		"texto:" + message.RecipientID.String(),
+		marshaled,
+		10,
+		3600,
+		redigomock.NewAnyInt(),
+	).Expect(int64(1)).Expect(int64(-1))
+	err = broker.Send(message.RecipientID, message)
+	assert.Nil(t, err)
 	err = broker.Send(message.RecipientID, message)
+	assert.Equal(t, ErrRoomRecipient, err)
+}
+
+func TestRedisBroker_RegisterFlushesMailbox(t *testing.T) {
+	log := newLogger()
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log: log,
+		PresenceTTL: 90 * time.Second,
+		pool: newMockPool(mockConn),
+	}
+	client := NewClient(log, nil, &broker)
+	message := &BrokerMessage{
+		MessageID: uuid.NewV4(),
+		SenderID: uuid.NewV4(),
+		RecipientID: client.ID,
+		Text: "Lorem ipsum dolor sit amet...",
+		SentAt: time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC),
+	}
+	marshaled, _ := json.Marshal(message)
+	event, _ := json.Marshal(PresenceMessagePayload{
+		UserID: client.ID,
+		Status: PresenceOnline,
+	})
+	mockConn.Script(
+		[]byte(redisRegisterScriptSource),
+		2,
+		"texto:sessions:{" + client.ID.String() + "}",
+		"texto:mailbox:{" + client.ID.String() + "}",
+		client.SessionID.String(),
+		redigomock.NewAnyInt(),
+		90,
+		"texto:presence:" + client.ID.String(),
+		event,
+	).Expect([]interface{}{marshaled})
+	assert.Nil(t, broker.Register(client))
+	select {
+	case received := <-client.outboundChan:
+		assert.Equal(t, ReceiveMessageKind, received.Kind)
+		assert.Equal(t, message.SenderID, received.Data.(ReceiveMessagePayload).SenderID)
+		assert.Equal(t, message.Text, received.Data.(ReceiveMessagePayload).Text)
+		assert.Equal(t, message.MessageID, received.ID)
+		assert.Equal(t, message.MessageID, received.Data.(ReceiveMessagePayload).MessageID)
+		assert.True(t, message.SentAt.Equal(received.Data.(ReceiveMessagePayload).SentAt))
+	case <-time.After(time.Second):
+		t.Fatal("stored message was not delivered")
+	}
+}
+
+func TestRedisBroker_HeartbeatFlushesMailbox(t *testing.T) {
+	log := newLogger()
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log: log,
+		PresenceTTL: 90 * time.Second,
+		pool: newMockPool(mockConn),
+	}
+	client := NewClient(log, nil, &broker)
+	message := &BrokerMessage{
+		MessageID: uuid.NewV4(),
+		SenderID: uuid.NewV4(),
+		RecipientID: client.ID,
+		Text: "Lorem ipsum dolor sit amet...",
+	}
+	marshaled, _ := json.Marshal(message)
+	mockConn.Script(
+		[]byte(redisHeartbeatScriptSource),
+		2,
+		"texto:sessions:{" + client.ID.String() + "}",
+		"texto:mailbox:{" + client.ID.String() + "}",
+		client.SessionID.String(),
+		redigomock.NewAnyInt(),
+		90,
+	).Expect([]interface{}{marshaled}).Expect([]interface{}{})
+	assert.Nil(t, broker.Heartbeat(client))
+	if assert.Len(t, client.outboundChan, 1) {
+		assert.Equal(t, message.MessageID, (<-client.outboundChan).ID)
+	}
+	assert.Nil(t, broker.Heartbeat(client))
+	assert.Empty(t, client.outboundChan)
+}
+
+func TestRedisBroker_Rooms(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log: newLogger(),
+		pool: newMockPool(mockConn),
+	}
+	var _ RoomBroker = &broker
+	roomID := uuid.NewV4()
+	owner := uuid.NewV4()
+	member := uuid.NewV4()
+	key := "texto:room:{" + roomID.String() + "}"
+
+	mockConn.Command("SADD", key, owner.String()).Expect(int64(1))
+	assert.Nil(t, broker.CreateRoom(roomID, owner))
+
+	mockConn.Script([]byte(redisJoinScriptSource), 1, key, member.String()).Expect(int64(0)).Expect(int64(1))
+	assert.Equal(t, ErrUnknownRoom, broker.JoinRoom(roomID, member))
+	assert.Nil(t, broker.JoinRoom(roomID, member))
+
+	mockConn.Command("SMEMBERS", key).Expect([]interface{}{[]byte(owner.String()), []byte(member.String())})
+	members, err := broker.RoomMembers(roomID)
+	assert.Nil(t, err)
+	assert.Equal(t, []uuid.UUID{owner, member}, members)
+
+	mockConn.Command("SREM", key, owner.String()).Expect(int64(1)).Expect(int64(0))
+	assert.Nil(t, broker.LeaveRoom(roomID, owner))
+	assert.Equal(t, ErrNotRoomMember, broker.LeaveRoom(roomID, owner))
+}
+
+func TestRedisBroker_SendRoom(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log:         newLogger(),
+		MailboxTTL:  time.Hour,
+		MailboxSize: 10,
+		pool:        newMockPool(mockConn),
+	}
+	roomID := uuid.NewV4()
+	sender := uuid.NewV4()
+	member := uuid.NewV4()
+	key := "texto:room:{" + roomID.String() + "}"
+	message := &BrokerMessage{MessageID: uuid.NewV4(), SenderID: sender, RecipientID: roomID, RoomID: roomID, Text: "Hello"}
+	copied := *message
+	copied.RecipientID = member
+	marshaled, _ := json.Marshal(&copied)
+
+	mockConn.Command("SMEMBERS", key).
+		Expect([]interface{}{[]byte(sender.String()), []byte(member.String())}).
+		Expect([]interface{}{[]byte(member.String())}).
+		Expect([]interface{}{})
+	send := mockConn.Script(
+		[]byte(redisSendScriptSource),
+		3,
+		"texto:sessions:{"+member.String()+"}",
+		"texto:mailbox:{"+member.String()+"}",
+		"texto:room:{"+member.String()+"}",
+		"texto:"+member.String(),
+		marshaled,
+		10,
+		3600,
+		redigomock.NewAnyInt(),
+	).Expect(int64(1))
+	assert.Nil(t, broker.SendRoom(message))
+	assert.Equal(t, 1, mockConn.Stats(send))
+	assert.Equal(t, ErrNotRoomMember, broker.SendRoom(message))
+	assert.Equal(t, ErrUnknownRoom, broker.SendRoom(message))
+	assert.Equal(t, 1, mockConn.Stats(send))
+}
+
+func TestRedisBroker_SubscribePresence(t *testing.T) {
+	log := newLogger()
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log: log,
+		pool: newMockPool(mockConn),
+	}
+	var _ PresenceBroker = &broker
+	client := NewClient(log, nil, &broker)
+	online := uuid.NewV4()
+	offline := uuid.NewV4()
+	mockConn.Command("ZCOUNT", "texto:sessions:{" + online.String() + "}", redigomock.NewAnyInt(), "+inf").Expect(int64(1))
+	mockConn.Command("ZCOUNT", "texto:sessions:{" + offline.String() + "}", redigomock.NewAnyInt(), "+inf").Expect(int64(0))
+	mockConn.Command("GET", "texto:lastseen:{" + offline.String() + "}").Expect([]byte("1500000000"))
+	presences, err := broker.SubscribePresence(client, []uuid.UUID{online, offline})
 	assert.Nil(t, err)
+	if assert.Len(t, presences, 2) {
+		assert.Equal(t, PresenceOnline, presences[0].Status)
+		assert.Equal(t, PresenceOffline, presences[1].Status)
+		assert.Equal(t, int64(1500000000), presences[1].LastSeen.Unix())
+	}
+	assert.Len(t, broker.presence.subscribers(online), 1)
+	assert.Nil(t, broker.UnsubscribePresence(client, []uuid.UUID{online}))
+	assert.Empty(t, broker.presence.subscribers(online))
+	assert.Len(t, broker.presence.subscribers(offline), 1)
+}
+
+func TestRedisBroker_ExpireSessions(t *testing.T) {
+	stub := newRedisStub(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crashedCtx, crash := context.WithCancel(ctx)
+	crashed := startRedisNode(t, crashedCtx, stub, RedisRoutingTargeted)
+	other := startRedisNode(t, ctx, stub, RedisRoutingTargeted)
+	client := NewClient(newLogger(), nil, crashed)
+	crashed.waitSubscribed(crashed.addClient(client))
+	var mu sync.Mutex
+	expiries := map[string]int64{sessionsKey(client.ID): time.Now().Unix() + int64(DefaultPresenceTTL/time.Second)}
+	expire := func(conn *redisStubConn, args []string) {
+		now, _ := strconv.ParseInt(args[4], 10, 64)
+		mu.Lock()
+		expiry, ok := expiries[args[2]]
+		expired := ok && expiry <= now
+		if expired {
+			delete(expiries, args[2])
+		}
+		mu.Unlock()
+		if !expired {
+			conn.reply(int64(0))
+			return
+		}
+		stub.publish(args[5], args[6])
+		conn.reply(int64(1))
+	}
+	stub.handle("EVAL", expire)
+	stub.handle("EVALSHA", expire)
+	watcher := NewClient(newLogger(), nil, other)
+	other.waitSubscribed(other.addPresenceSubscriptions(watcher, []uuid.UUID{client.ID})...)
+
+	crash()
+	assert.Nil(t, other.expireSessions())
+	assert.Len(t, watcher.outboundChan, 0)
+	mu.Lock()
+	expiries[sessionsKey(client.ID)] = time.Now().Unix() - 1
+	mu.Unlock()
+	assert.Nil(t, other.expireSessions())
+	select {
+	case received := <-watcher.outboundChan:
+		if assert.Equal(t, PresenceKind, received.Kind) {
+			presence := received.Data.(PresenceMessagePayload)
+			assert.Equal(t, client.ID, presence.UserID)
+			assert.Equal(t, PresenceOffline, presence.Status)
+			assert.NotNil(t, presence.LastSeen)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the offline event was not published")
+	}
+	assert.Nil(t, other.expireSessions())
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, watcher.outboundChan, 0)
+}
+
+func TestRedisBroker_PollReconnects(t *testing.T) {
+	for _, routing := range []RedisRouting{RedisRoutingTargeted, RedisRoutingPattern} {
+		log := newLogger()
+		failingConn := redigomock.NewConn()
+		pubSubConn := redigomock.NewConn()
+		client := NewClient(log, nil, nil)
+		message := &BrokerMessage{
+			MessageID: uuid.NewV4(),
+			SenderID: uuid.NewV4(),
+			RecipientID: client.ID,
+			Text: "Lorem ipsum dolor sit amet...",
+		}
+		marshaled, _ := json.Marshal(message)
+		if routing == RedisRoutingPattern {
+			pubSubConn.Command("PSUBSCRIBE", "texto:*").Expect([]interface{}{
+				[]byte("psubscribe"),
+				[]byte("texto:*"),
+				int64(1),
+			})
+			pubSubConn.AddSubscriptionMessage([]interface{}{
+				[]byte("pmessage"),
+				[]byte("texto:*"),
+				[]byte("texto:" + client.ID.String()),
+				marshaled,
+			})
+		} else {
+			pubSubConn.Command("SUBSCRIBE", "texto:" + client.ID.String()).
+				Expect([]interface{}{
+					[]byte("subscribe"),
+					[]byte("texto:" + client.ID.String()),
+					int64(1),
+				})
+			pubSubConn.AddSubscriptionMessage([]interface{}{
+				[]byte("message"),
+				[]byte("texto:" + client.ID.String()),
+				marshaled,
+			})
+		}
+		dials := make(chan redis.Conn, 2)
+		dials <- failingConn
+		dials <- pubSubConn
+		broker := RedisBroker{
+			Log: log,
+			ReconnectMinDelay: time.Millisecond,
+			ReconnectMaxDelay: 10 * time.Millisecond,
+			Routing: routing,
+			pool: newMockPool(redigomock.NewConn()),
+			dial: func(options ...redis.DialOption) (redis.Conn, error) {
+				select {
+				case conn := <-dials:
+					return conn, nil
+				default:
+					return nil, errors.New("connection refused")
+				}
+			},
+		}
+		client.broker = &broker
+		broker.addClient(client)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- broker.Poll(ctx)
+		}()
+		select {
+		case received := <-client.outboundChan:
+			assert.Equal(t, message.MessageID, received.ID)
+		case <-time.After(time.Second):
+			t.Fatal("message was not delivered after reconnecting")
+		}
+		cancel()
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Poll didn't return after the context was cancelled")
+		}
+	}
+}
+
+func TestRedisBroker_CheckHealth(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log: newLogger(),
+		pool: newMockPool(mockConn),
+	}
+	mockConn.Command("PING").Expect("PONG")
+	assert.Equal(t, ErrSubscriptionClosed, broker.CheckHealth())
+	atomic.StoreInt32(&broker.subscribed, 1)
+	assert.Nil(t, broker.CheckHealth())
+	mockConn.Command("PING").ExpectError(errors.New("connection refused"))
+	assert.Error(t, broker.CheckHealth())
 }
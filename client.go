@@ -1,6 +1,9 @@
 package texto
 
 import (
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -10,70 +13,486 @@ import (
 
 // A Client represents an open WebSocket connection with a user.
 type Client struct {
-	// The universally unique ID of the user on this node.
+	// The universally unique ID of the user. It is shared by all the sessions of the same user, across all nodes. Once
+	// the Client is registered, it is only changed by rebind while holding idMu, and the goroutines other than the one
+	// running the Client must read it using userID.
 	ID uuid.UUID
 
+	// idMu protects ID and SessionID while the Client is registered.
+	idMu sync.RWMutex
+
+	// The universally unique ID of this session. Once the Client is registered, it is only changed by rebind while
+	// holding idMu, or by releaseSession once the Client is done.
+	SessionID uuid.UUID
+
 	// The current logrus instance.
 	log *logrus.Logger
 
+	// Whether the ID of the user was verified by an Authenticator, in which case it can't be changed.
+	authenticated bool
+
+	// Whether the user can choose its ID with a registration message, even though it wasn't authenticated. Anyone can
+	// then impersonate any user.
+	insecureIdentity bool
+
 	// The WebSocket connection associated to this user.
 	conn *websocket.Conn
 
 	// The Broker in which the client is registered
 	broker Broker
 
+	// If not nil, the MessageStore recording the messages sent by the user.
+	store MessageStore
+
+	// rooms holds the IDs of the rooms the user joined or sent messages to during this session, whose messages are sent
+	// without checking whether they are rooms first.
+	rooms map[uuid.UUID]struct{}
+
 	// inboundChan is used to transfer messages incoming from the user to the main client loop.
 	inboundChan chan *ChatMessage
 
-	// outboundChan is used to transfer messages incoming from the broker to the main client loop.
+	// outboundChan is the send queue, transferring the messages to write to the user to the main client loop. The
+	// messages are added to it by enqueue.
 	outboundChan chan *ChatMessage
+
+	// queueMu serializes the additions to the send queue, and protects queueClosed.
+	queueMu sync.Mutex
+
+	// queueClosed is set once the Client is unregistered, after which the messages sent to it are discarded.
+	queueClosed bool
+
+	// overflow decides what happens to the messages sent while the send queue is full.
+	overflow OverflowPolicy
+
+	// slow is notified when the send queue overflows with the OverflowDisconnect policy.
+	slow chan struct{}
+
+	// receiptsMu protects receipts and readable.
+	receiptsMu sync.Mutex
+
+	// receipts maps the IDs of the receive messages sent to the user to the messages they were built from, until the
+	// user acknowledges them. It holds at most maxPendingReceipts entries.
+	receipts map[uuid.UUID]*BrokerMessage
+
+	// readable holds the messages received by the user in this session, directly or in a history page, for which it
+	// can send read receipts. It holds at most maxReadableMessages entries.
+	readable map[readableMessage]struct{}
+
+	// The duration for which a message received ahead of its turn is held, waiting for the ones preceding it in its
+	// conversation. A zero value transmits the messages as soon as they are received.
+	reorderWindow time.Duration
+
+	// orderMu protects orders.
+	orderMu sync.Mutex
+
+	// orders restores the order of the messages of each conversation, by conversation ID.
+	orders map[uuid.UUID]*conversationOrder
+
+	// The duration during which the retries of the messages sent by the user are detected, if the Broker is a
+	// DedupBroker. A zero value disables the detection.
+	dedupWindow time.Duration
+
+	// If not nil, the session can be resumed on another connection after this one is lost.
+	session *clientSession
+
+	// resumed is notified when the session was resumed on another connection.
+	resumed chan struct{}
+
+	// closedByUser is set to 1 when the user closed the connection normally, in which case the session can't be
+	// resumed. It must be accessed atomically.
+	closedByUser int32
+
+	// If not nil, limits the rate of the messages sent by the user.
+	limiter *clientRateLimiter
+
+	// The interval at which WebSocket pings are sent to the user, and the duration after which the connection is
+	// considered dead if nothing was received from the user. Zero values disable the keepalive.
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+
+	// alive is notified whenever the user shows it is still connected, by answering a ping or sending a message.
+	alive chan struct{}
+
+	// stop receives the deadline before which the session must be closed, when the server is shutting down.
+	stop chan time.Time
+}
+
+// maxPendingReceipts is the maximum number of unacknowledged receive messages a Client keeps track of. When it is
+// reached, the delivery of some of the oldest messages won't be reported to their senders.
+const maxPendingReceipts = 256
+
+// maxReadableMessages is the maximum number of received messages for which a Client accepts read receipts. When it is
+// reached, the read receipts of some of the oldest messages are rejected.
+const maxReadableMessages = 1024
+
+// A readableMessage identifies a message received by the user, by the ID of its sender and the ID given by its sender.
+type readableMessage struct {
+	senderID  uuid.UUID
+	messageID uuid.UUID
 }
 
 // NewClient creates a new Client from an open WebSocket connection.
 func NewClient(log *logrus.Logger, conn *websocket.Conn, broker Broker) *Client {
 	return &Client{
 		ID:           uuid.NewV4(),
+		SessionID:    uuid.NewV4(),
 		log:          log,
 		broker:       broker,
 		conn:         conn,
 		inboundChan:  make(chan *ChatMessage, 32),
-		outboundChan: make(chan *ChatMessage, 32),
+		outboundChan: make(chan *ChatMessage, DefaultSendQueueSize),
+		slow:         make(chan struct{}, 1),
+		receipts:     make(map[uuid.UUID]*BrokerMessage),
+		readable:     make(map[readableMessage]struct{}),
+		rooms:        make(map[uuid.UUID]struct{}),
+		orders:       make(map[uuid.UUID]*conversationOrder),
+		alive:        make(chan struct{}, 1),
+		resumed:      make(chan struct{}, 1),
+		stop:         make(chan time.Time, 1),
 	}
 }
 
 // consumeWebsocket reads incoming messages from the socket, and transfer them to the main client loop using the
 // inboundChan channel.
 func (c *Client) consumeWebsocket() {
+	if c.keepalive() {
+		c.extendReadDeadline()
+		c.conn.SetPongHandler(func(string) error {
+			c.extendReadDeadline()
+			return nil
+		})
+		c.conn.SetPingHandler(func(data string) error {
+			c.extendReadDeadline()
+			err := c.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.pongTimeout))
+			if err == websocket.ErrCloseSent {
+				return nil
+			}
+			return err
+		})
+	}
 	for {
 		message := new(ChatMessage)
 		if err := c.conn.ReadJSON(message); err != nil {
 			c.log.Error(err)
-			if _, ok := err.(*websocket.CloseError); ok {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				atomic.StoreInt32(&c.closedByUser, 1)
+			}
+			_, closed := err.(*websocket.CloseError)
+			if _, ok := err.(net.Error); ok {
+				closed = true
+			}
+			if closed {
 				if err := c.conn.Close(); err != nil {
 					c.log.Error(err)
 				}
 				close(c.inboundChan)
 				break
 			}
-			c.outboundChan <- NewErrorMessage(nil, c.ID, ErrorMessagePayload{
+			errorsReturned.inc("ESYNTAX")
+			c.enqueue(NewErrorMessage(nil, c.userID(), ErrorMessagePayload{
 				Code:        "ESYNTAX",
 				Description: "Unable to process the message due to a syntax error.",
-			})
+			}))
 			continue
 		}
+		if c.keepalive() {
+			c.extendReadDeadline()
+		}
 		c.inboundChan <- message
 	}
 }
 
+// keepalive reports whether the keepalive is enabled. Without pings, an idle user can't be told apart from a dead
+// connection, so the read deadline is only set when pings are sent.
+func (c *Client) keepalive() bool {
+	return c.pingInterval > 0 && c.pongTimeout > 0
+}
+
+// extendReadDeadline pushes back the deadline before which the user must send a message or answer a ping, and
+// notifies the main client loop that the user is still connected.
+func (c *Client) extendReadDeadline() {
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.pongTimeout)); err != nil {
+		c.log.Error(err)
+	}
+	select {
+	case c.alive <- struct{}{}:
+	default:
+	}
+}
+
+// deliver transmits a message received from the Broker to the user. The numbered text messages are transmitted in the
+// order of their conversation.
+func (c *Client) deliver(message *BrokerMessage) {
+	switch message.Kind {
+	case DeliveredKind, ReadKind:
+		receipt := ReceiptMessagePayload{
+			MessageID:   message.MessageID,
+			SenderID:    message.RecipientID,
+			RecipientID: message.SenderID,
+		}
+		outbound := NewReadMessage(nil, message.RecipientID, receipt)
+		if message.Kind == DeliveredKind {
+			outbound = NewDeliveredMessage(nil, message.RecipientID, receipt)
+		}
+		outbound.written = message.written
+		c.enqueue(outbound)
+		return
+	case sentKind:
+		c.skipSequence(messageConversationID(message), message.Sequence)
+		if message.written != nil {
+			message.written()
+		}
+		return
+	}
+	if message.Sequence != 0 && c.reorderWindow > 0 {
+		c.deliverInOrder(message)
+		return
+	}
+	c.transmit(message)
+}
+
+// transmit sends the receive message built from the given text message to the user. If the session is resumable, the
+// message is buffered first.
+func (c *Client) transmit(message *BrokerMessage) {
+	if c.session == nil {
+		c.enqueueReceive(message, 0)
+		return
+	}
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	c.transmitBuffered(message)
+}
+
+// enqueueReceive queues the receive message built from the given text message, with the given sequence number in the
+// session.
+func (c *Client) enqueueReceive(message *BrokerMessage, sessionSequence uint64) {
+	payload := newReceivePayload(message)
+	payload.SessionSequence = sessionSequence
+	var receiveID *uuid.UUID
+	if message.MessageID != uuid.Nil {
+		receiveID = &payload.MessageID
+	}
+	receive := NewReceiveMessage(receiveID, message.RecipientID, payload)
+	receive.written = message.written
+	c.trackReceipt(receive.ID, message)
+	c.enqueue(receive)
+}
+
+// newReceivePayload returns the payload of the receive message transmitting the given message.
+func newReceivePayload(message *BrokerMessage) ReceiveMessagePayload {
+	payload := ReceiveMessagePayload{
+		MessageID: message.MessageID,
+		SenderID:  message.SenderID,
+		Text:      message.Text,
+		SentAt:    message.SentAt,
+		Sequence:  message.Sequence,
+	}
+	if message.RoomID != uuid.Nil {
+		roomID := message.RoomID
+		payload.RoomID = &roomID
+	}
+	return payload
+}
+
+// record stores the given message in the history of its conversation, if the Client has a MessageStore. Failing to
+// record a message doesn't prevent its delivery.
+func (c *Client) record(message *BrokerMessage) {
+	if c.store == nil {
+		return
+	}
+	if err := c.store.Store(message); err != nil {
+		c.log.Error(err)
+	}
+}
+
+// trackReceipt remembers the message from which the receive message of the given ID was built, so that its sender can
+// be notified once the user acknowledges it.
+func (c *Client) trackReceipt(receiveID uuid.UUID, message *BrokerMessage) {
+	if message.MessageID == uuid.Nil {
+		return
+	}
+	c.receiptsMu.Lock()
+	defer c.receiptsMu.Unlock()
+	if len(c.receipts) >= maxPendingReceipts {
+		for id := range c.receipts {
+			delete(c.receipts, id)
+			break
+		}
+	}
+	c.receipts[receiveID] = message
+	c.markReadable(message.SenderID, message.MessageID)
+}
+
+// markReadable allows the user to send a read receipt for the message of the given sender and ID. The caller must hold
+// receiptsMu.
+func (c *Client) markReadable(senderID, messageID uuid.UUID) {
+	if messageID == uuid.Nil || senderID == c.userID() {
+		return
+	}
+	if len(c.readable) >= maxReadableMessages {
+		for key := range c.readable {
+			delete(c.readable, key)
+			break
+		}
+	}
+	c.readable[readableMessage{senderID: senderID, messageID: messageID}] = struct{}{}
+}
+
+// isReadable reports whether the user received the message of the given sender and ID in this session.
+func (c *Client) isReadable(senderID, messageID uuid.UUID) bool {
+	c.receiptsMu.Lock()
+	defer c.receiptsMu.Unlock()
+	_, ok := c.readable[readableMessage{senderID: senderID, messageID: messageID}]
+	return ok
+}
+
+// takeReceipt returns and forgets the message from which the receive message of the given ID was built, or nil if it
+// is unknown.
+func (c *Client) takeReceipt(receiveID uuid.UUID) *BrokerMessage {
+	c.receiptsMu.Lock()
+	defer c.receiptsMu.Unlock()
+	message, ok := c.receipts[receiveID]
+	if !ok {
+		return nil
+	}
+	delete(c.receipts, receiveID)
+	return message
+}
+
+// sendReceipt notifies the sender of the given message that it was delivered to or read by the user.
+func (c *Client) sendReceipt(kind string, messageID uuid.UUID, senderID uuid.UUID) error {
+	return c.broker.Send(senderID, &BrokerMessage{
+		Kind:        kind,
+		MessageID:   messageID,
+		SenderID:    c.ID,
+		RecipientID: senderID,
+	})
+}
+
+// deliverPresence transmits a presence event received from the Broker to the user.
+func (c *Client) deliverPresence(presence PresenceMessagePayload) {
+	c.enqueue(NewPresenceMessage(nil, c.userID(), presence))
+}
+
+// userID returns the ID of the user. Unlike ID, it can be called from any goroutine.
+func (c *Client) userID() uuid.UUID {
+	c.idMu.RLock()
+	defer c.idMu.RUnlock()
+	return c.ID
+}
+
+// rebind moves the current session to the given user and session IDs, registering it again in the Broker. It must be
+// called from the goroutine running the Client.
+func (c *Client) rebind(userID uuid.UUID, sessionID uuid.UUID) error {
+	if err := c.broker.Unregister(c); err != nil {
+		return err
+	}
+	c.idMu.Lock()
+	c.ID = userID
+	c.SessionID = sessionID
+	c.idMu.Unlock()
+	return c.broker.Register(c)
+}
+
 // HandleMessage processes the given message and returns the ChatMessage that should be send back to the user.
 func (c *Client) HandleMessage(msg *ChatMessage) *ChatMessage {
+	var response *ChatMessage
+	if retryAfter := c.checkRateLimit(msg.Kind); retryAfter > 0 {
+		response = NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "ERATE",
+			Description: "Too many messages were sent, retry later.",
+			RetryAfter:  int64((retryAfter + time.Millisecond - 1) / time.Millisecond),
+		})
+	} else {
+		response = c.handleMessage(msg)
+	}
+	kind := msg.Kind
+	if response != nil && response.Kind == ErrorMessageKind {
+		code := response.Data.(ErrorMessagePayload).Code
+		errorsReturned.inc(code)
+		if code == "EKIND" {
+			kind = "unknown"
+		}
+	}
+	messagesReceived.inc(kind)
+	return response
+}
+
+// checkRateLimit returns the duration after which a message of the given kind can be processed, or zero if it can be
+// processed now.
+func (c *Client) checkRateLimit(kind string) time.Duration {
+	if c.limiter == nil || !rateLimitedKind(kind) {
+		return 0
+	}
+	return c.limiter.allow(c.ID, time.Now())
+}
+
+// handleMessage is the implementation of HandleMessage.
+func (c *Client) handleMessage(msg *ChatMessage) *ChatMessage {
 	switch msg.Kind {
-	case ErrorMessageKind: // Ignore incoming error messages
-	case AcknowledgeMessageKind: // Ignore incoming ack messages
+	case ErrorMessageKind, PongKind: // Ignore incoming error and pong messages
+	case PingKind:
+		return NewPongMessage(&msg.ID, c.ID)
+	case AcknowledgeMessageKind:
+		if original := c.takeReceipt(msg.ID); original != nil {
+			if err := c.sendReceipt(DeliveredKind, original.MessageID, original.SenderID); err != nil {
+				c.log.Error(err)
+			}
+		}
+	case ReadKind:
+		payload, ok := msg.Data.(ReceiptMessagePayload)
+		if !ok || payload.MessageID == uuid.Nil || payload.SenderID == uuid.Nil {
+			return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+				Code:        "EINVAL",
+				Description: "The data payload doesn't match the given kind",
+			})
+		}
+		if !c.isReadable(payload.SenderID, payload.MessageID) {
+			return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+				Code:        "EINVAL",
+				Description: "The receipt doesn't refer to a message received in this session.",
+			})
+		}
+		if err := c.sendReceipt(ReadKind, payload.MessageID, payload.SenderID); err != nil {
+			c.log.Error(err)
+			return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+				Code:        "EBROKER",
+				Description: "Unable to send the read receipt to the sender.",
+			})
+		}
+		return NewAckMessage(&msg.ID, c.ID)
 	case RegistrationKind:
+		if payload, ok := msg.Data.(RegistrationMessagePayload); ok && payload.UserID != uuid.Nil && payload.UserID != c.ID {
+			if c.authenticated {
+				return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+					Code:        "EAUTH",
+					Description: "The session is authenticated as another user.",
+				})
+			}
+			if !c.insecureIdentity {
+				return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+					Code:        "EAUTH",
+					Description: "The user ID can't be chosen by the client on this server.",
+				})
+			}
+			if err := c.rebind(payload.UserID, c.SessionID); err != nil {
+				c.log.Error(err)
+				return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+					Code:        "EBROKER",
+					Description: "Unable to register the session for the given user.",
+				})
+			}
+			if err := c.updateSession(); err != nil {
+				c.log.Error(err)
+			}
+		}
 		return NewConnectionMessage(&msg.ID, c.ID, ConnectionMessagePayload{
-			ClientID: c.ID,
+			ClientID:    c.ID,
+			SessionID:   c.SessionID,
+			ResumeToken: c.resumeToken(),
 		})
+	case ResumeKind:
+		return c.handleResumeMessage(msg)
 	case SendMessageKind:
 		if msg.ClientID != c.ID {
 			return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
@@ -88,31 +507,307 @@ func (c *Client) HandleMessage(msg *ChatMessage) *ChatMessage {
 				Description: "The data payload doesn't match the given kind",
 			})
 		}
-		if err := c.broker.Send(payload.ReceiverID, &BrokerMessage{
-			SenderID: c.ID,
-			RecipientID: payload.ReceiverID,
-			Text: payload.Text,
-		}); err != nil {
-			c.log.Error(err)
+		return c.handleSendMessage(msg, payload)
+	case HistoryKind:
+		return c.handleHistoryMessage(msg)
+	case CreateRoomKind, JoinRoomKind, LeaveRoomKind, RoomMembersKind:
+		return c.handleRoomMessage(msg)
+	case SubscribePresenceKind, UnsubscribePresenceKind:
+		return c.handlePresenceMessage(msg)
+	default:
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EKIND",
+			Description: "Invalid message kind received.",
+		})
+	}
+	return nil
+}
+
+// handleSendMessage transmits the given message to its recipient, or to all the members of the room it is sent to.
+// The message is claimed before it is numbered and transmitted, so that its retries are acknowledged again without
+// transmitting it twice, even if they are sent concurrently.
+func (c *Client) handleSendMessage(msg *ChatMessage, payload SendMessagePayload) *ChatMessage {
+	if ack, err := c.claimSentMessage(msg.ID); err == ErrSendPending {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EPENDING",
+			Description: "The message is being sent, retry later.",
+		})
+	} else if err != nil {
+		c.log.Error(err)
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EBROKER",
+			Description: "Unable to send the message to the recipient.",
+		})
+	} else if ack != nil {
+		droppedMessages.inc(dropDuplicateSend)
+		return NewSendAckMessage(&msg.ID, c.ID, *ack)
+	}
+	message := &BrokerMessage{
+		MessageID:   msg.ID,
+		SenderID:    c.ID,
+		RecipientID: payload.ReceiverID,
+		Text:        payload.Text,
+		SentAt:      time.Now().UTC(),
+	}
+	if err := c.sendMessage(message); err != nil {
+		c.forgetSentMessage(msg.ID)
+		switch err {
+		case ErrNotRoomMember:
 			return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
-				Code: "EBROKER",
-				Description: "Unable to send the message to the recipient.",
+				Code:        "EMEMBER",
+				Description: "You are not a member of this room.",
 			})
+		case ErrUnknownRoom:
+			return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+				Code:        "ENOROOM",
+				Description: "The room doesn't exist.",
+			})
+		}
+		c.log.Error(err)
+		description := "Unable to send the message to the recipient."
+		if message.RoomID != uuid.Nil {
+			description = "Unable to send the message to all the members of the room."
 		}
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EBROKER",
+			Description: description,
+		})
+	}
+	c.skipSequence(messageConversationID(message), message.Sequence)
+	c.notifySent(message)
+	ack := AckMessagePayload{
+		SentAt:   message.SentAt,
+		Sequence: message.Sequence,
+	}
+	c.recordSentMessage(msg.ID, ack)
+	c.record(message)
+	return NewSendAckMessage(&msg.ID, c.ID, ack)
+}
+
+// sendMessage numbers the given message and transmits it to its recipient. If the recipient is a room, the message is
+// numbered in the conversation of the room and transmitted to all its other members instead, in a single step.
+func (c *Client) sendMessage(message *BrokerMessage) error {
+	if _, ok := c.rooms[message.RecipientID]; !ok {
+		err := c.numberMessage(message)
+		if err == nil {
+			err = c.broker.Send(message.RecipientID, message)
+		}
+		if err != ErrRoomRecipient {
+			return err
+		}
+		c.rooms[message.RecipientID] = struct{}{}
+	}
+	rooms, ok := c.broker.(RoomBroker)
+	if !ok {
+		return ErrRoomRecipient
+	}
+	message.RoomID = message.RecipientID
+	if err := c.numberMessage(message); err != nil {
+		return err
+	}
+	err := rooms.SendRoom(message)
+	if err == ErrUnknownRoom {
+		delete(c.rooms, message.RecipientID)
+	}
+	return err
+}
+
+// numberMessage sets the sequence number of the given message in its conversation.
+func (c *Client) numberMessage(message *BrokerMessage) error {
+	sequence, err := c.nextSequence(messageConversationID(message))
+	if err != nil {
+		return err
+	}
+	message.Sequence = sequence
+	return nil
+}
+
+// handleHistoryMessage returns a page of the history of the conversation with the requested peer.
+func (c *Client) handleHistoryMessage(msg *ChatMessage) *ChatMessage {
+	if c.store == nil {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "ENOTSUP",
+			Description: "History is not supported by this server.",
+		})
+	}
+	payload, ok := msg.Data.(HistoryMessagePayload)
+	if !ok || payload.PeerID == uuid.Nil {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EINVAL",
+			Description: "The data payload doesn't match the given kind",
+		})
+	}
+	page, err := loadHistory(c.broker, c.store, c.ID, payload)
+	switch err {
+	case nil:
+		c.receiptsMu.Lock()
+		for _, message := range page.Messages {
+			c.markReadable(message.SenderID, message.MessageID)
+		}
+		c.receiptsMu.Unlock()
+		return NewHistoryMessage(&msg.ID, c.ID, page)
+	case ErrNotRoomMember:
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EMEMBER",
+			Description: "You are not a member of this room.",
+		})
+	default:
+		c.log.Error(err)
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EBROKER",
+			Description: "Unable to fetch the history of the conversation.",
+		})
+	}
+}
+
+// handleRoomMessage processes the messages related to the management of rooms.
+func (c *Client) handleRoomMessage(msg *ChatMessage) *ChatMessage {
+	rooms, ok := c.broker.(RoomBroker)
+	if !ok {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "ENOTSUP",
+			Description: "Rooms are not supported by this server.",
+		})
+	}
+	var err error
+	var members []uuid.UUID
+	payload, _ := msg.Data.(RoomMessagePayload)
+	switch msg.Kind {
+	case CreateRoomKind:
+		payload.RoomID = uuid.NewV4()
+		if err = rooms.CreateRoom(payload.RoomID, c.ID); err == nil {
+			c.rooms[payload.RoomID] = struct{}{}
+			return NewRoomMessage(&msg.ID, c.ID, RoomMessagePayload{
+				RoomID:  payload.RoomID,
+				Members: []uuid.UUID{c.ID},
+			})
+		}
+	case JoinRoomKind:
+		if err = rooms.JoinRoom(payload.RoomID, c.ID); err == nil {
+			c.rooms[payload.RoomID] = struct{}{}
+		}
+	case LeaveRoomKind:
+		err = rooms.LeaveRoom(payload.RoomID, c.ID)
+	case RoomMembersKind:
+		members, err = rooms.RoomMembers(payload.RoomID)
+		if err == nil && len(members) == 0 {
+			err = ErrUnknownRoom
+		} else if err == nil && !containsUUID(members, c.ID) {
+			err = ErrNotRoomMember
+		}
+		if err == nil {
+			return NewRoomMessage(&msg.ID, c.ID, RoomMessagePayload{
+				RoomID:  payload.RoomID,
+				Members: members,
+			})
+		}
+	}
+	switch err {
+	case nil:
 		return NewAckMessage(&msg.ID, c.ID)
+	case ErrUnknownRoom:
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "ENOROOM",
+			Description: "The room doesn't exist.",
+		})
+	case ErrNotRoomMember:
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EMEMBER",
+			Description: "You are not a member of this room.",
+		})
 	default:
+		c.log.Error(err)
 		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
-			Code:        "EKIND",
-			Description: "Invalid message kind received.",
+			Code:        "EBROKER",
+			Description: "Unable to update the room.",
 		})
 	}
-	return nil
+}
+
+// handlePresenceMessage processes the (un)subscriptions to the presence of other users.
+func (c *Client) handlePresenceMessage(msg *ChatMessage) *ChatMessage {
+	presenceBroker, ok := c.broker.(PresenceBroker)
+	if !ok {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "ENOTSUP",
+			Description: "Presence is not supported by this server.",
+		})
+	}
+	payload, ok := msg.Data.(PresenceSubscriptionPayload)
+	if !ok || len(payload.UserIDs) > maxPresenceSubscription {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EINVAL",
+			Description: "The data payload doesn't match the given kind",
+		})
+	}
+	if msg.Kind == UnsubscribePresenceKind {
+		if err := presenceBroker.UnsubscribePresence(c, payload.UserIDs); err != nil {
+			c.log.Error(err)
+			return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+				Code:        "EBROKER",
+				Description: "Unable to unsubscribe from the presence of the given users.",
+			})
+		}
+		return NewAckMessage(&msg.ID, c.ID)
+	}
+	presences, err := presenceBroker.SubscribePresence(c, payload.UserIDs)
+	if err != nil {
+		c.log.Error(err)
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EBROKER",
+			Description: "Unable to subscribe to the presence of the given users.",
+		})
+	}
+	for _, presence := range presences {
+		c.deliverPresence(presence)
+	}
+	return NewAckMessage(&msg.ID, c.ID)
+}
+
+// maxPresenceSubscription is the maximum number of users a Client can (un)subscribe to in a single message.
+const maxPresenceSubscription = 100
+
+// containsUUID reports whether the given slice contains the given ID.
+func containsUUID(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
 }
 
 // Run listens on the inboundChan and outboundChan for new messages to process or send.
-// It timeouts after 5 minutes of inactivity.
+// It timeouts after the given duration of inactivity, answering a ping counting as activity. If the keepalive is
+// enabled, Run sends a WebSocket ping every pingInterval, and the connection is closed if nothing is received from the
+// user within pongTimeout. If the Broker tracks the presence of users, Run sends a heartbeat every
+// HeartbeatInterval for as long as it is running.
 func (c *Client) Run(timeout time.Duration) {
 	go c.consumeWebsocket()
+	var heartbeat <-chan time.Time
+	presenceBroker, ok := c.broker.(PresenceBroker)
+	if ok {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var ping <-chan time.Time
+	if c.keepalive() {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	inactivity := time.NewTimer(timeout)
+	defer inactivity.Stop()
+	active := func() {
+		if !inactivity.Stop() {
+			select {
+			case <-inactivity.C:
+			default:
+			}
+		}
+		inactivity.Reset(timeout)
+	}
 	for {
 		select {
 		case inbound := <-c.inboundChan:
@@ -124,22 +819,58 @@ func (c *Client) Run(timeout time.Duration) {
 				WithField("kind", inbound.Kind).
 				WithField("remote", c.conn.RemoteAddr()).
 				Info("Received message")
-			if response := c.HandleMessage(inbound); response != nil {
-				go func() {
-					c.outboundChan <- response
-				}()
+			response := c.HandleMessage(inbound)
+			if c.limiter != nil && c.limiter.abusive() {
+				c.log.
+					WithField("client", c.ID.String()).
+					WithField("remote", c.conn.RemoteAddr()).
+					Warn("Closing connection exceeding the rate limits")
+				if err := c.write(response); err != nil {
+					c.log.Error(err)
+				}
+				c.close(websocket.ClosePolicyViolation, RateLimitCloseReason, time.Now().Add(time.Second))
+				return
+			}
+			if response != nil {
+				c.enqueue(response)
 			}
+			active()
 		case outbound := <-c.outboundChan:
-			c.log.
-				WithField("client", c.ID.String()).
-				WithField("remote", c.conn.RemoteAddr()).
-				WithField("kind", outbound.Kind).
-				Info("Sending message")
-			if err := c.conn.WriteJSON(outbound); err != nil {
+			c.dequeued()
+			if err := c.write(outbound); err != nil {
+				c.log.Error(err)
+				return
+			}
+			active()
+		case <-c.alive:
+			active()
+		case <-ping:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.pingInterval)); err != nil {
 				c.log.Error(err)
 				return
 			}
-		case <-time.After(timeout):
+		case <-heartbeat:
+			if err := presenceBroker.Heartbeat(c); err != nil {
+				c.log.Error(err)
+			}
+		case <-c.slow:
+			c.log.
+				WithField("client", c.ID.String()).
+				WithField("remote", c.conn.RemoteAddr()).
+				Warn("Closing connection of a slow consumer")
+			c.close(CloseSlowConsumer, SlowConsumerCloseReason, time.Now().Add(time.Second))
+			return
+		case <-c.resumed:
+			c.log.
+				WithField("client", c.ID.String()).
+				WithField("remote", c.conn.RemoteAddr()).
+				Info("Closing connection whose session was resumed on another one")
+			c.close(CloseSessionResumed, SessionResumedCloseReason, time.Now().Add(time.Second))
+			return
+		case deadline := <-c.stop:
+			c.drain(deadline)
+			return
+		case <-inactivity.C:
 			c.log.
 				WithField("client", c.ID.String()).
 				Info("Connection timeout")
@@ -150,3 +881,69 @@ func (c *Client) Run(timeout time.Duration) {
 		}
 	}
 }
+
+// write sends the given message to the user.
+func (c *Client) write(outbound *ChatMessage) error {
+	c.log.
+		WithField("client", c.ID.String()).
+		WithField("remote", c.conn.RemoteAddr()).
+		WithField("kind", outbound.Kind).
+		Info("Sending message")
+	if err := c.conn.WriteJSON(outbound); err != nil {
+		return err
+	}
+	messagesSent.inc(outbound.Kind)
+	if outbound.written != nil {
+		outbound.written()
+	}
+	return nil
+}
+
+// ShutdownCloseReason is the reason of the close frame sent to the users when the server is shutting down.
+const ShutdownCloseReason = "server shutting down, please reconnect"
+
+// shutdown asks the running Client to close its session before the given deadline.
+func (c *Client) shutdown(deadline time.Time) {
+	select {
+	case c.stop <- deadline:
+	default:
+	}
+}
+
+// drain writes the messages waiting in the outbound queue until it is empty or the given deadline is reached, then
+// closes the connection with a going away close frame telling the user to reconnect, possibly to another node.
+func (c *Client) drain(deadline time.Time) {
+	c.conn.SetWriteDeadline(deadline)
+	for time.Now().Before(deadline) {
+		var outbound *ChatMessage
+		select {
+		case outbound = <-c.outboundChan:
+			c.dequeued()
+		default:
+		}
+		if outbound == nil {
+			break
+		}
+		if err := c.write(outbound); err != nil {
+			c.log.Error(err)
+			break
+		}
+	}
+	c.close(websocket.CloseGoingAway, ShutdownCloseReason, deadline)
+}
+
+// RateLimitCloseReason is the reason of the close frame sent to the users that kept sending messages despite being
+// rate limited.
+const RateLimitCloseReason = "rate limit exceeded"
+
+// close closes the connection with a close frame of the given code and reason, which is written before the given
+// deadline.
+func (c *Client) close(code int, reason string, deadline time.Time) {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, closeMessage, deadline); err != nil {
+		c.log.Error(err)
+	}
+	if err := c.conn.Close(); err != nil {
+		c.log.Error(err)
+	}
+}
@@ -1,13 +1,22 @@
 package texto
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestClient_HandleMessage(t *testing.T) {
-	client := NewClient(nil, nil, newDummyBroker())
+	client := NewClient(nil, nil, NewMemoryBroker(newLogger()))
 
 	errorMsg := NewErrorMessage(nil, client.ID, ErrorMessagePayload{
 		Code: "ENOMEM",
@@ -30,4 +39,354 @@ func TestClient_HandleMessage(t *testing.T) {
 	sendAnswer := client.HandleMessage(sendMsg)
 	assert.Equal(t, sendMsg.ID, sendAnswer.ID)
 	assert.Equal(t, AcknowledgeMessageKind, sendAnswer.Kind)
+
+	pingMsg := NewPingMessage(nil, client.ID)
+	pingAnswer := client.HandleMessage(pingMsg)
+	assert.Equal(t, pingMsg.ID, pingAnswer.ID)
+	assert.Equal(t, PongKind, pingAnswer.Kind)
+	assert.Nil(t, client.HandleMessage(NewPongMessage(nil, client.ID)))
+}
+
+func TestClient_HandleRegistration(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	client := NewClient(newLogger(), nil, broker)
+	broker.Register(client)
+	userID := uuid.NewV4()
+
+	registrationMsg := NewRegistrationMessage(nil, client.ID)
+	registrationMsg.Data = RegistrationMessagePayload{UserID: userID}
+	errorAnswer := client.HandleMessage(registrationMsg)
+	assert.Equal(t, ErrorMessageKind, errorAnswer.Kind)
+	assert.Equal(t, "EAUTH", errorAnswer.Data.(ErrorMessagePayload).Code)
+	assert.NotEqual(t, userID, client.ID)
+
+	client.insecureIdentity = true
+	registrationAnswer := client.HandleMessage(registrationMsg)
+	assert.Equal(t, ConnectionMessageKind, registrationAnswer.Kind)
+	assert.Equal(t, userID, registrationAnswer.Data.(ConnectionMessagePayload).ClientID)
+	assert.Equal(t, client.SessionID, registrationAnswer.Data.(ConnectionMessagePayload).SessionID)
+	assert.Equal(t, userID, client.ID)
+	assert.Len(t, broker.clients.sessions(userID), 1)
+	assert.Equal(t, 1, broker.clients.len())
+}
+
+func TestClient_RebindConcurrently(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	client := NewClient(newLogger(), nil, broker)
+	assert.Nil(t, broker.Register(client))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			client.deliver(&BrokerMessage{MessageID: uuid.NewV4(), SenderID: uuid.NewV4(), Text: "Lorem ipsum"})
+			<-client.outboundChan
+			client.deliverPresence(PresenceMessagePayload{UserID: uuid.NewV4(), Status: PresenceOnline})
+			<-client.outboundChan
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, client.rebind(uuid.NewV4(), client.SessionID))
+	}
+	<-done
+	assert.Equal(t, client.ID, client.userID())
+	assert.Equal(t, 1, broker.clients.len())
+}
+
+func TestClient_HandleRoomMessages(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	owner := NewClient(newLogger(), nil, broker)
+	member := NewClient(newLogger(), nil, broker)
+	outsider := NewClient(newLogger(), nil, broker)
+	broker.Register(owner)
+	broker.Register(member)
+	broker.Register(outsider)
+
+	roomAnswer := owner.HandleMessage(NewCreateRoomMessage(nil, owner.ID))
+	assert.Equal(t, RoomKind, roomAnswer.Kind)
+	roomID := roomAnswer.Data.(RoomMessagePayload).RoomID
+
+	joinAnswer := member.HandleMessage(NewJoinRoomMessage(nil, member.ID, RoomMessagePayload{RoomID: roomID}))
+	assert.Equal(t, AcknowledgeMessageKind, joinAnswer.Kind)
+	unknownAnswer := member.HandleMessage(NewJoinRoomMessage(nil, member.ID, RoomMessagePayload{RoomID: uuid.NewV4()}))
+	assert.Equal(t, "ENOROOM", unknownAnswer.Data.(ErrorMessagePayload).Code)
+
+	membersAnswer := member.HandleMessage(NewRoomMembersMessage(nil, member.ID, RoomMessagePayload{RoomID: roomID}))
+	assert.Equal(t, RoomKind, membersAnswer.Kind)
+	assert.Len(t, membersAnswer.Data.(RoomMessagePayload).Members, 2)
+	outsiderAnswer := outsider.HandleMessage(NewRoomMembersMessage(nil, outsider.ID, RoomMessagePayload{RoomID: roomID}))
+	assert.Equal(t, "EMEMBER", outsiderAnswer.Data.(ErrorMessagePayload).Code)
+
+	sendAnswer := owner.HandleMessage(NewSendMessage(nil, owner.ID, SendMessagePayload{
+		ReceiverID: roomID,
+		Text:       "Hello everyone!",
+	}))
+	assert.Equal(t, AcknowledgeMessageKind, sendAnswer.Kind)
+	select {
+	case received := <-member.outboundChan:
+		assert.Equal(t, ReceiveMessageKind, received.Kind)
+		assert.Equal(t, owner.ID, received.Data.(ReceiveMessagePayload).SenderID)
+		assert.Equal(t, roomID, *received.Data.(ReceiveMessagePayload).RoomID)
+	case <-time.After(time.Second):
+		t.Fatal("room message was not delivered")
+	}
+	outsiderSendAnswer := outsider.HandleMessage(NewSendMessage(nil, outsider.ID, SendMessagePayload{
+		ReceiverID: roomID,
+		Text:       "Let me in!",
+	}))
+	assert.Equal(t, "EMEMBER", outsiderSendAnswer.Data.(ErrorMessagePayload).Code)
+	outsiderSendAnswer = outsider.HandleMessage(NewSendMessage(nil, outsider.ID, SendMessagePayload{
+		ReceiverID: roomID,
+		Text:       "Let me in again!",
+	}))
+	assert.Equal(t, "EMEMBER", outsiderSendAnswer.Data.(ErrorMessagePayload).Code)
+	assert.Empty(t, member.outboundChan)
+
+	leaveAnswer := member.HandleMessage(NewLeaveRoomMessage(nil, member.ID, RoomMessagePayload{RoomID: roomID}))
+	assert.Equal(t, AcknowledgeMessageKind, leaveAnswer.Kind)
+}
+
+func TestClient_HandlePresenceMessages(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	client := NewClient(newLogger(), nil, broker)
+	broker.Register(client)
+	userID := uuid.NewV4()
+
+	subscribeAnswer := client.HandleMessage(NewSubscribePresenceMessage(nil, client.ID, PresenceSubscriptionPayload{
+		UserIDs: []uuid.UUID{userID},
+	}))
+	assert.Equal(t, AcknowledgeMessageKind, subscribeAnswer.Kind)
+	select {
+	case event := <-client.outboundChan:
+		assert.Equal(t, PresenceKind, event.Kind)
+		assert.Equal(t, userID, event.Data.(PresenceMessagePayload).UserID)
+		assert.Equal(t, PresenceOffline, event.Data.(PresenceMessagePayload).Status)
+	case <-time.After(time.Second):
+		t.Fatal("current presence was not delivered")
+	}
+
+	unsubscribeAnswer := client.HandleMessage(NewUnsubscribePresenceMessage(nil, client.ID, PresenceSubscriptionPayload{
+		UserIDs: []uuid.UUID{userID},
+	}))
+	assert.Equal(t, AcknowledgeMessageKind, unsubscribeAnswer.Kind)
+	assert.Empty(t, broker.presence.subscribers(userID))
+
+	tooManyAnswer := client.HandleMessage(NewSubscribePresenceMessage(nil, client.ID, PresenceSubscriptionPayload{
+		UserIDs: make([]uuid.UUID, maxPresenceSubscription+1),
+	}))
+	assert.Equal(t, "EINVAL", tooManyAnswer.Data.(ErrorMessagePayload).Code)
+}
+
+func TestClient_HandleReceipts(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	sender := NewClient(newLogger(), nil, broker)
+	recipient := NewClient(newLogger(), nil, broker)
+	broker.Register(sender)
+	broker.Register(recipient)
+
+	sendMsg := NewSendMessage(nil, sender.ID, SendMessagePayload{
+		ReceiverID: recipient.ID,
+		Text:       "Hello World!",
+	})
+	assert.Equal(t, AcknowledgeMessageKind, sender.HandleMessage(sendMsg).Kind)
+	var receive *ChatMessage
+	select {
+	case receive = <-recipient.outboundChan:
+		assert.Equal(t, ReceiveMessageKind, receive.Kind)
+		assert.Equal(t, sendMsg.ID, receive.ID)
+		assert.Equal(t, sendMsg.ID, receive.Data.(ReceiveMessagePayload).MessageID)
+		assert.False(t, receive.Data.(ReceiveMessagePayload).SentAt.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	assert.Nil(t, recipient.HandleMessage(NewAckMessage(&receive.ID, recipient.ID)))
+	select {
+	case delivered := <-sender.outboundChan:
+		assert.Equal(t, DeliveredKind, delivered.Kind)
+		assert.Equal(t, sender.ID, delivered.ClientID)
+		assert.Equal(t, ReceiptMessagePayload{
+			MessageID:   sendMsg.ID,
+			SenderID:    sender.ID,
+			RecipientID: recipient.ID,
+		}, delivered.Data)
+	case <-time.After(time.Second):
+		t.Fatal("delivered receipt was not relayed")
+	}
+	assert.Nil(t, recipient.HandleMessage(NewAckMessage(&receive.ID, recipient.ID)))
+	assert.Empty(t, recipient.receipts)
+
+	readMsg := NewReadMessage(nil, recipient.ID, ReceiptMessagePayload{
+		MessageID: sendMsg.ID,
+		SenderID:  sender.ID,
+	})
+	assert.Equal(t, AcknowledgeMessageKind, recipient.HandleMessage(readMsg).Kind)
+	select {
+	case read := <-sender.outboundChan:
+		assert.Equal(t, ReadKind, read.Kind)
+		assert.Equal(t, sendMsg.ID, read.Data.(ReceiptMessagePayload).MessageID)
+		assert.Equal(t, recipient.ID, read.Data.(ReceiptMessagePayload).RecipientID)
+	case <-time.After(time.Second):
+		t.Fatal("read receipt was not relayed")
+	}
+
+	invalidRead := NewReadMessage(nil, recipient.ID, ReceiptMessagePayload{})
+	assert.Equal(t, ErrorMessageKind, recipient.HandleMessage(invalidRead).Kind)
+	forgedRead := NewReadMessage(nil, recipient.ID, ReceiptMessagePayload{
+		MessageID: uuid.NewV4(),
+		SenderID:  sender.ID,
+	})
+	forgedAnswer := recipient.HandleMessage(forgedRead)
+	assert.Equal(t, "EINVAL", forgedAnswer.Data.(ErrorMessagePayload).Code)
+	forgedRead = NewReadMessage(nil, recipient.ID, ReceiptMessagePayload{
+		MessageID: sendMsg.ID,
+		SenderID:  uuid.NewV4(),
+	})
+	forgedAnswer = recipient.HandleMessage(forgedRead)
+	assert.Equal(t, "EINVAL", forgedAnswer.Data.(ErrorMessagePayload).Code)
+	assert.Empty(t, sender.outboundChan)
+}
+
+func TestClient_HandleHistory(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	sender := NewClient(newLogger(), nil, broker)
+	recipient := NewClient(newLogger(), nil, broker)
+	historyMsg := NewHistoryMessage(nil, sender.ID, HistoryMessagePayload{PeerID: recipient.ID})
+	assert.Equal(t, ErrorMessageKind, sender.HandleMessage(historyMsg).Kind)
+
+	dir, err := ioutil.TempDir("", "texto")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileMessageStore(filepath.Join(dir, "history.jsonl"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer store.Close()
+	sender.store = store
+	recipient.store = store
+
+	sendMsg := NewSendMessage(nil, sender.ID, SendMessagePayload{
+		ReceiverID: recipient.ID,
+		Text:       "Hello World!",
+	})
+	assert.Equal(t, AcknowledgeMessageKind, sender.HandleMessage(sendMsg).Kind)
+	historyMsg = NewHistoryMessage(nil, recipient.ID, HistoryMessagePayload{PeerID: sender.ID})
+	historyAnswer := recipient.HandleMessage(historyMsg)
+	assert.Equal(t, HistoryKind, historyAnswer.Kind)
+	if assert.Len(t, historyAnswer.Data.(HistoryMessagePayload).Messages, 1) {
+		assert.Equal(t, sendMsg.ID, historyAnswer.Data.(HistoryMessagePayload).Messages[0].MessageID)
+		assert.Equal(t, "Hello World!", historyAnswer.Data.(HistoryMessagePayload).Messages[0].Text)
+	}
+
+	roomID := uuid.NewV4()
+	broker.CreateRoom(roomID, sender.ID)
+	historyMsg = NewHistoryMessage(nil, recipient.ID, HistoryMessagePayload{PeerID: roomID})
+	assert.Equal(t, ErrorMessageKind, recipient.HandleMessage(historyMsg).Kind)
+}
+
+// newTestConn returns both ends of a WebSocket connection: the one accepted by the server, and the one of the peer.
+// They are closed at the end of the test.
+func newTestConn(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[len("http"):], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	conn := <-conns
+	t.Cleanup(func() { conn.Close() })
+	return conn, peer
+}
+
+func TestClient_Drain(t *testing.T) {
+	conn, peer := newTestConn(t)
+	client := NewClient(newLogger(), conn, NewMemoryBroker(newLogger()))
+	written := 0
+	for i := 0; i < 3; i++ {
+		message := NewAckMessage(nil, client.ID)
+		message.written = func() {
+			written++
+		}
+		client.outboundChan <- message
+	}
+
+	client.drain(time.Now().Add(time.Second))
+	assert.Equal(t, 3, written)
+	for i := 0; i < 3; i++ {
+		received := new(ChatMessage)
+		assert.Nil(t, peer.ReadJSON(received))
+		assert.Equal(t, AcknowledgeMessageKind, received.Kind)
+	}
+	_, _, err := peer.ReadMessage()
+	if assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway)) {
+		assert.Equal(t, ShutdownCloseReason, err.(*websocket.CloseError).Text)
+	}
+}
+
+func TestClient_Keepalive(t *testing.T) {
+	conn, peer := newTestConn(t)
+	client := NewClient(newLogger(), conn, NewMemoryBroker(newLogger()))
+	client.pingInterval = 20 * time.Millisecond
+	client.pongTimeout = 100 * time.Millisecond
+	var answering int32 = 1
+	pings := make(chan struct{}, 100)
+	peer.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		if atomic.LoadInt32(&answering) == 0 {
+			return nil
+		}
+		return peer.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go peer.ReadMessage()
+	done := make(chan struct{})
+	go func() {
+		client.Run(200 * time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the connection was closed while the peer answered the pings")
+	case <-time.After(400 * time.Millisecond):
+	}
+	assert.True(t, len(pings) > 5)
+	atomic.StoreInt32(&answering, 0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the connection wasn't closed while the peer didn't answer the pings")
+	}
+}
+
+func TestClient_KeepaliveDisabled(t *testing.T) {
+	conn, peer := newTestConn(t)
+	client := NewClient(newLogger(), conn, NewMemoryBroker(newLogger()))
+	client.pongTimeout = 50 * time.Millisecond
+	go peer.ReadMessage()
+	done := make(chan struct{})
+	go func() {
+		client.Run(400 * time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the connection of an idle client was closed while the pings were disabled")
+	case <-time.After(200 * time.Millisecond):
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the connection wasn't closed after the inactivity timeout")
+	}
 }
@@ -2,7 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/kureuil/texto"
 	"github.com/sirupsen/logrus"
@@ -10,24 +16,88 @@ import (
 
 func main() {
 	log := logrus.New()
-	redisAddr := os.Getenv("REDIS_URL")
-	if len(redisAddr) == 0 {
-		redisAddr = "localhost:6379"
-	}
-	broker, err := texto.NewRedisBroker(log, redisAddr)
-	if err != nil {
+	config, err := texto.LoadConfig(os.Args[0], os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
 		log.Fatal(err)
 	}
-	port := os.Getenv("PORT")
-	if len(port) == 0 {
-		port = "8080"
+	var broker texto.Broker
+	if strings.HasPrefix(config.RedisURL, "memory://") {
+		log.Info("Using in-process memory broker")
+		memoryBroker := texto.NewMemoryBroker(log)
+		memoryBroker.MailboxTTL = config.MailboxTTL
+		memoryBroker.MailboxSize = config.MailboxSize
+		broker = memoryBroker
+	} else if len(config.NatsURL) != 0 {
+		log.Info("Using NATS broker")
+		natsBroker, err := texto.NewNatsBroker(log, config.NatsURL, config.MailboxTTL, config.MailboxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		broker = natsBroker
+	} else if config.RedisBroker == "streams" {
+		log.Info("Using Redis Streams broker")
+		streamBroker, err := texto.NewStreamBroker(log, config.RedisURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		streamBroker.MailboxTTL = config.MailboxTTL
+		streamBroker.MailboxSize = config.MailboxSize
+		broker = streamBroker
+	} else {
+		redisBroker, err := texto.NewRedisBroker(log, config.RedisURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		redisBroker.MailboxTTL = config.MailboxTTL
+		redisBroker.MailboxSize = config.MailboxSize
+		if config.RedisRouting == "pattern" {
+			redisBroker.Routing = texto.RedisRoutingPattern
+		}
+		broker = redisBroker
+	}
+	var options []texto.ServerOption
+	if len(config.JWTSecret) != 0 {
+		options = append(options, texto.WithAuthenticator(&texto.JWTAuthenticator{
+			Secret:   []byte(config.JWTSecret),
+			Issuer:   config.JWTIssuer,
+			Audience: config.JWTAudience,
+			Leeway:   30 * time.Second,
+		}))
+	}
+	if len(config.HistoryFile) != 0 {
+		store, err := texto.NewFileMessageStore(config.HistoryFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer store.Close()
+		options = append(options, texto.WithMessageStore(store))
+	} else if len(config.HistoryRedisURL) != 0 {
+		store, err := texto.NewRedisMessageStore(config.HistoryRedisURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer store.Close()
+		options = append(options, texto.WithMessageStore(store))
 	}
 	ctx := context.Background()
-	s, err := texto.NewServer(ctx, log, ":" + port, broker)
+	s, err := texto.NewServer(ctx, log, config, broker, options...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := s.Run(); err != nil {
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		log.WithField("signal", <-signals).Info("Shutting down")
+		if err := s.Stop(); err != nil {
+			log.Error(err)
+		}
+		close(stopped)
+	}()
+	if err := s.Run(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
 }
@@ -0,0 +1,513 @@
+package texto
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Config holds the settings of a texto server. It is loaded by LoadConfig from a configuration file, the environment
+// and the command line flags.
+type Config struct {
+	// The port on which the HTTP server listens.
+	Port int
+	// The duration of inactivity after which a WebSocket connection is closed.
+	ClientTimeout time.Duration
+	// The interval at which WebSocket pings are sent to the users, and the duration after which a connection on which
+	// nothing was received is closed. A zero interval disables the keepalive.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// The number of messages waiting to be written to each user, and what happens to the messages sent while it is
+	// full: "drop_oldest", "drop_newest" or "disconnect".
+	SendQueueSize     int
+	SendQueueOverflow string
+	// The duration for which a message received ahead of its turn in its conversation is held, waiting for the ones
+	// preceding it. Zero disables the reordering.
+	ReorderWindow time.Duration
+	// The duration during which the retries of the messages sent by the users are detected. Zero disables the
+	// detection.
+	DedupWindow time.Duration
+	// The duration during which a session can be resumed after its connection is lost, zero to disable the resumption,
+	// and the number of messages kept to be transmitted again to each session.
+	ResumeWindow     time.Duration
+	ResumeBufferSize int
+	// The sizes of the read and write buffers of the WebSocket connections.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// The timeouts of the HTTP server, as documented by http.Server.
+	HTTPReadTimeout       time.Duration
+	HTTPReadHeaderTimeout time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	// The duration given to the connected users to receive their queued messages when the server stops.
+	DrainTimeout time.Duration
+	// The origins from which WebSocket connections are accepted besides the host serving them, as scheme://host[:port]
+	// values whose host may start with a "*." wildcard matching its subdomains. The "*" origin accepts all of them.
+	AllowedOrigins []string
+	// The rate limits of the messages sent by each session and by each user, in messages per second with the given
+	// bursts, and the number of consecutive rejected messages after which a session is closed. A zero rate or number
+	// disables the limit.
+	ClientRate        float64
+	ClientBurst       int
+	UserRate          float64
+	UserBurst         int
+	MaxRateViolations int
+
+	// The address of the Redis server, or memory:// to use the in-process MemoryBroker.
+	RedisURL string
+	// The Redis broker to use: "pubsub" for the RedisBroker, or "streams" for the StreamBroker.
+	RedisBroker string
+	// The routing of the RedisBroker: "targeted" or "pattern".
+	RedisRouting string
+	// If not empty, the addresses of the NATS servers used by the NatsBroker instead of Redis.
+	NatsURL string
+	// The settings of the mailboxes of the offline users.
+	MailboxTTL  time.Duration
+	MailboxSize int
+
+	// If not empty, the secret with which the JWT authenticating the users are signed, and the claims they must hold.
+	JWTSecret   string
+	JWTIssuer   string
+	JWTAudience string
+	// Whether the users can choose their ID when they aren't authenticated. Anyone can then impersonate any user, so it
+	// must only be enabled for development.
+	InsecureIdentities bool
+
+	// If not empty, the file or the Redis server in which the history of the conversations is recorded.
+	HistoryFile     string
+	HistoryRedisURL string
+}
+
+// DefaultConfig returns a Config holding the default settings.
+func DefaultConfig() *Config {
+	return &Config{
+		Port:                  8080,
+		ClientTimeout:         5 * time.Minute,
+		PingInterval:          30 * time.Second,
+		PongTimeout:           60 * time.Second,
+		SendQueueSize:         DefaultSendQueueSize,
+		SendQueueOverflow:     "drop_oldest",
+		ReorderWindow:         DefaultReorderWindow,
+		DedupWindow:           DefaultDedupWindow,
+		ResumeWindow:          DefaultResumeWindow,
+		ResumeBufferSize:      DefaultResumeBufferSize,
+		ReadBufferSize:        1024,
+		WriteBufferSize:       1024,
+		HTTPReadTimeout:       60 * time.Second,
+		HTTPReadHeaderTimeout: 60 * time.Second,
+		HTTPWriteTimeout:      60 * time.Second,
+		HTTPIdleTimeout:       60 * time.Second,
+		DrainTimeout:          DefaultDrainTimeout,
+		ClientRate:            DefaultClientRateLimit.Rate,
+		ClientBurst:           DefaultClientRateLimit.Burst,
+		UserRate:              DefaultUserRateLimit.Rate,
+		UserBurst:             DefaultUserRateLimit.Burst,
+		MaxRateViolations:     DefaultMaxRateViolations,
+		RedisURL:              "localhost:6379",
+		RedisBroker:           "pubsub",
+		RedisRouting:          "targeted",
+		MailboxTTL:            DefaultMailboxTTL,
+		MailboxSize:           DefaultMailboxSize,
+	}
+}
+
+// A configSetting is a setting of a Config. It is named name in the configuration file, NAME in the environment and
+// -name on the command line, with dashes instead of underscores.
+type configSetting struct {
+	name  string
+	usage string
+	value flag.Value
+}
+
+// settings returns the settings of the Config, bound to its fields.
+func (c *Config) settings() []configSetting {
+	return []configSetting{
+		{"port", "the port on which the HTTP server listens", (*intValue)(&c.Port)},
+		{"client_timeout", "the duration of inactivity after which a connection is closed", (*durationValue)(&c.ClientTimeout)},
+		{"ping_interval", "the interval at which WebSocket pings are sent to the users", (*durationValue)(&c.PingInterval)},
+		{"pong_timeout", "the duration after which a connection on which nothing was received is closed", (*durationValue)(&c.PongTimeout)},
+		{"send_queue_size", "the number of messages waiting to be written to each user", (*intValue)(&c.SendQueueSize)},
+		{"send_queue_overflow", "what happens to the messages sent to a full queue: drop_oldest, drop_newest or disconnect", (*stringValue)(&c.SendQueueOverflow)},
+		{"reorder_window", "the duration for which a message received ahead of its turn is held", (*durationValue)(&c.ReorderWindow)},
+		{"dedup_window", "the duration during which the retries of the sent messages are detected", (*durationValue)(&c.DedupWindow)},
+		{"resume_window", "the duration during which a session can be resumed after its connection is lost", (*durationValue)(&c.ResumeWindow)},
+		{"resume_buffer_size", "the number of messages kept to be transmitted again to a resumed session", (*intValue)(&c.ResumeBufferSize)},
+		{"read_buffer_size", "the size of the read buffer of the WebSocket connections", (*intValue)(&c.ReadBufferSize)},
+		{"write_buffer_size", "the size of the write buffer of the WebSocket connections", (*intValue)(&c.WriteBufferSize)},
+		{"http_read_timeout", "the maximum duration for reading an HTTP request", (*durationValue)(&c.HTTPReadTimeout)},
+		{"http_read_header_timeout", "the maximum duration for reading the headers of an HTTP request", (*durationValue)(&c.HTTPReadHeaderTimeout)},
+		{"http_write_timeout", "the maximum duration for writing an HTTP response", (*durationValue)(&c.HTTPWriteTimeout)},
+		{"http_idle_timeout", "the maximum duration an idle HTTP connection is kept open", (*durationValue)(&c.HTTPIdleTimeout)},
+		{"drain_timeout", "the duration given to the connected users to receive their messages on shutdown", (*durationValue)(&c.DrainTimeout)},
+		{"allowed_origins", "the comma-separated origins from which connections are accepted besides the server itself", (*listValue)(&c.AllowedOrigins)},
+		{"client_rate", "the number of messages per second each session can send", (*floatValue)(&c.ClientRate)},
+		{"client_burst", "the number of messages each session can send in a burst", (*intValue)(&c.ClientBurst)},
+		{"user_rate", "the number of messages per second each user can send", (*floatValue)(&c.UserRate)},
+		{"user_burst", "the number of messages each user can send in a burst", (*intValue)(&c.UserBurst)},
+		{"max_rate_violations", "the number of consecutive rate limited messages after which a session is closed", (*intValue)(&c.MaxRateViolations)},
+		{"redis_url", "the address of the Redis server, or memory:// to use the in-process broker", (*stringValue)(&c.RedisURL)},
+		{"redis_broker", "the Redis broker to use: pubsub or streams", (*stringValue)(&c.RedisBroker)},
+		{"redis_routing", "the routing of the Redis Pub/Sub broker: targeted or pattern", (*stringValue)(&c.RedisRouting)},
+		{"nats_url", "the addresses of the NATS servers to use instead of Redis", (*stringValue)(&c.NatsURL)},
+		{"mailbox_ttl", "the duration for which undelivered messages are kept", (*durationValue)(&c.MailboxTTL)},
+		{"mailbox_size", "the maximum number of undelivered messages kept for a user", (*intValue)(&c.MailboxSize)},
+		{"jwt_secret", "the secret with which the tokens authenticating the users are signed", (*stringValue)(&c.JWTSecret)},
+		{"jwt_issuer", "the issuer the tokens must be issued by", (*stringValue)(&c.JWTIssuer)},
+		{"jwt_audience", "the audience the tokens must be intended for", (*stringValue)(&c.JWTAudience)},
+		{"insecure_identities", "let the unauthenticated users choose their ID, allowing anyone to impersonate anyone", (*boolValue)(&c.InsecureIdentities)},
+		{"history_file", "the file in which the history of the conversations is recorded", (*stringValue)(&c.HistoryFile)},
+		{"history_redis_url", "the Redis server in which the history of the conversations is recorded", (*stringValue)(&c.HistoryRedisURL)},
+	}
+}
+
+// LoadConfig returns the Config described by the given command line arguments and environment, which is looked up using
+// the given function. The settings are read from the configuration file given by the -config flag or the CONFIG_FILE
+// variable first, then from the environment and finally from the flags, each source overriding the previous ones. The
+// resulting Config is validated.
+func LoadConfig(name string, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := DefaultConfig()
+	settings := c.settings()
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	path, _ := lookupEnv("CONFIG_FILE")
+	flags.StringVar(&path, "config", path, "the TOML file from which the settings are read")
+	var parsed []*flagSetting
+	for _, setting := range settings {
+		f := &flagSetting{setting: setting}
+		parsed = append(parsed, f)
+		flags.Var(f, strings.Replace(setting.name, "_", "-", -1), setting.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if len(path) != 0 {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, setting := range settings {
+		env := strings.ToUpper(setting.name)
+		if value, ok := lookupEnv(env); ok {
+			if err := setting.value.Set(value); err != nil {
+				return nil, fmt.Errorf("config: invalid value %q for %s: %v", value, env, err)
+			}
+		}
+	}
+	for _, f := range parsed {
+		if f.set {
+			if err := f.setting.value.Set(f.raw); err != nil {
+				return nil, fmt.Errorf("config: invalid value %q for -%s: %v", f.raw, strings.Replace(f.setting.name, "_", "-", -1), err)
+			}
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// A flagSetting records the value given to a flag, so that it is applied after the configuration file and the
+// environment.
+type flagSetting struct {
+	setting configSetting
+	raw     string
+	set     bool
+}
+
+// String implements flag.Value.
+func (f *flagSetting) String() string {
+	if f.setting.value == nil {
+		return ""
+	}
+	return f.setting.value.String()
+}
+
+// Set implements flag.Value.
+func (f *flagSetting) Set(value string) error {
+	f.raw, f.set = value, true
+	return nil
+}
+
+// IsBoolFlag allows the boolean settings to be given as flags without a value.
+func (f *flagSetting) IsBoolFlag() bool {
+	value, ok := f.setting.value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && value.IsBoolFlag()
+}
+
+// loadFile reads the settings from the configuration file at the given path.
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	values, err := parseConfigFile(file)
+	if err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	settings := make(map[string]configSetting)
+	for _, setting := range c.settings() {
+		settings[setting.name] = setting
+	}
+	for name, value := range values {
+		setting, ok := settings[name]
+		if !ok {
+			return fmt.Errorf("config: %s: unknown setting %q", path, name)
+		}
+		if err := setting.value.Set(value); err != nil {
+			return fmt.Errorf("config: %s: invalid value %q for %s: %v", path, value, name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfigFile parses the subset of TOML used by the configuration files: comments and key = value lines, whose
+// value is a string, a number, a boolean or an array of strings. The values are returned in the form accepted by the
+// flags, arrays being joined with commas.
+func parseConfigFile(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if len(text) == 0 {
+			continue
+		}
+		separator := strings.Index(text, "=")
+		if separator < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key := strings.TrimSpace(text[:separator])
+		if len(key) == 0 {
+			return nil, fmt.Errorf("line %d: missing key", line)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line, key)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(text[separator+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// stripConfigComment removes the comment ending the given line, if any.
+func stripConfigComment(line string) string {
+	quoted := false
+	for i, r := range line {
+		switch {
+		case r == '"' && (i == 0 || line[i-1] != '\\'):
+			quoted = !quoted
+		case r == '#' && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValue parses the value of a configuration file setting.
+func parseConfigValue(text string) (string, error) {
+	switch {
+	case len(text) == 0:
+		return "", errors.New("missing value")
+	case strings.HasPrefix(text, "\""):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return "", errors.New("unterminated array")
+		}
+		var items []string
+		for _, item := range strings.Split(text[1:len(text)-1], ",") {
+			item = strings.TrimSpace(item)
+			if len(item) == 0 {
+				continue
+			}
+			value, err := strconv.Unquote(item)
+			if err != nil {
+				return "", fmt.Errorf("invalid array item %s", item)
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	case text == "true" || text == "false":
+		return text, nil
+	default:
+		number := strings.Replace(text, "_", "", -1)
+		if _, err := strconv.ParseFloat(number, 64); err != nil {
+			return "", fmt.Errorf("invalid value %s", text)
+		}
+		return number, nil
+	}
+}
+
+// Validate reports the first invalid setting of the Config.
+func (c *Config) Validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("config: invalid port %d", c.Port)
+	}
+	if c.ClientTimeout <= 0 {
+		return errors.New("config: client_timeout must be positive")
+	}
+	if c.PingInterval < 0 || (c.PingInterval > 0 && c.PongTimeout <= c.PingInterval) {
+		return errors.New("config: pong_timeout must be longer than ping_interval")
+	}
+	if c.SendQueueSize <= 0 {
+		return errors.New("config: send_queue_size must be positive")
+	}
+	if _, err := ParseOverflowPolicy(c.SendQueueOverflow); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if c.ReorderWindow < 0 || c.DedupWindow < 0 || c.ResumeWindow < 0 {
+		return errors.New("config: reorder_window, dedup_window and resume_window can't be negative")
+	}
+	if c.ResumeWindow > 0 && c.ResumeBufferSize <= 0 {
+		return errors.New("config: resume_buffer_size must be positive")
+	}
+	if c.ReadBufferSize <= 0 || c.WriteBufferSize <= 0 {
+		return errors.New("config: the buffer sizes must be positive")
+	}
+	if c.DrainTimeout <= 0 {
+		return errors.New("config: drain_timeout must be positive")
+	}
+	for _, timeout := range []time.Duration{c.HTTPReadTimeout, c.HTTPReadHeaderTimeout, c.HTTPWriteTimeout, c.HTTPIdleTimeout} {
+		if timeout < 0 {
+			return errors.New("config: the timeouts can't be negative")
+		}
+	}
+	for _, origin := range c.AllowedOrigins {
+		if _, ok := parseOriginPattern(origin); !ok && origin != "*" {
+			return fmt.Errorf("config: invalid allowed origin %q", origin)
+		}
+	}
+	if c.ClientRate < 0 || c.UserRate < 0 || c.MaxRateViolations < 0 {
+		return errors.New("config: the rate limits can't be negative")
+	}
+	if (c.ClientRate > 0 && c.ClientBurst < 1) || (c.UserRate > 0 && c.UserBurst < 1) {
+		return errors.New("config: the bursts of the rate limits must be positive")
+	}
+	if len(c.RedisURL) == 0 {
+		return errors.New("config: redis_url can't be empty")
+	}
+	if c.RedisBroker != "pubsub" && c.RedisBroker != "streams" {
+		return fmt.Errorf("config: invalid redis_broker %q, expected pubsub or streams", c.RedisBroker)
+	}
+	if c.RedisBroker == "streams" && len(c.NatsURL) == 0 && isRedisClusterURL(c.RedisURL) {
+		return errors.New("config: redis_broker streams doesn't support Redis Cluster")
+	}
+	if c.RedisRouting != "targeted" && c.RedisRouting != "pattern" {
+		return fmt.Errorf("config: invalid redis_routing %q, expected targeted or pattern", c.RedisRouting)
+	}
+	if c.MailboxTTL <= 0 || c.MailboxSize <= 0 {
+		return errors.New("config: mailbox_ttl and mailbox_size must be positive")
+	}
+	if len(c.HistoryFile) != 0 && len(c.HistoryRedisURL) != 0 {
+		return errors.New("config: history_file and history_redis_url are mutually exclusive")
+	}
+	return nil
+}
+
+// stringValue is a flag.Value setting a string.
+type stringValue string
+
+func (v *stringValue) String() string {
+	return string(*v)
+}
+
+func (v *stringValue) Set(value string) error {
+	*v = stringValue(value)
+	return nil
+}
+
+// boolValue is a flag.Value setting a bool.
+type boolValue bool
+
+func (v *boolValue) String() string {
+	return strconv.FormatBool(bool(*v))
+}
+
+func (v *boolValue) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+// IsBoolFlag allows the flag to be given without a value.
+func (v *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+// intValue is a flag.Value setting an int.
+type intValue int
+
+func (v *intValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *intValue) Set(value string) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*v = intValue(i)
+	return nil
+}
+
+// floatValue is a flag.Value setting a float64.
+type floatValue float64
+
+func (v *floatValue) String() string {
+	return strconv.FormatFloat(float64(*v), 'g', -1, 64)
+}
+
+func (v *floatValue) Set(value string) error {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+// durationValue is a flag.Value setting a time.Duration.
+type durationValue time.Duration
+
+func (v *durationValue) String() string {
+	return time.Duration(*v).String()
+}
+
+func (v *durationValue) Set(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+// listValue is a flag.Value setting a slice of strings from a comma-separated list.
+type listValue []string
+
+func (v *listValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *listValue) Set(value string) error {
+	*v = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
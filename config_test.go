@@ -0,0 +1,106 @@
+package texto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lookupEnv returns a function looking up the variables of the given environment.
+func lookupEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig("texto", nil, lookupEnv(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+
+	dir, err := ioutil.TempDir("", "texto")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "texto.toml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`# texto configuration
+port = 9000
+client_timeout = "1m" # shorter than the default
+allowed_origins = ["https://example.com", "https://chat.example.com"]
+redis_url = "redis://redis:6379/0"
+mailbox_size = 1_000
+`), 0600))
+	config, err = LoadConfig("texto", []string{"-config", path, "-port", "9001"}, lookupEnv(map[string]string{
+		"PORT":           "9002",
+		"CLIENT_TIMEOUT": "2m",
+	}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 9001, config.Port)
+	assert.Equal(t, 2*time.Minute, config.ClientTimeout)
+	assert.Equal(t, []string{"https://example.com", "https://chat.example.com"}, config.AllowedOrigins)
+	assert.Equal(t, "redis://redis:6379/0", config.RedisURL)
+	assert.Equal(t, 1000, config.MailboxSize)
+
+	config, err = LoadConfig("texto", nil, lookupEnv(map[string]string{"CONFIG_FILE": path}))
+	assert.Nil(t, err)
+	assert.Equal(t, 9000, config.Port)
+	assert.False(t, config.InsecureIdentities)
+
+	config, err = LoadConfig("texto", []string{"-insecure-identities", "-port", "9003"}, lookupEnv(nil))
+	if assert.Nil(t, err) {
+		assert.True(t, config.InsecureIdentities)
+		assert.Equal(t, 9003, config.Port)
+	}
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("unknown = 1\n"), 0600))
+	_, err = LoadConfig("texto", []string{"-config", path}, lookupEnv(nil))
+	assert.NotNil(t, err)
+	_, err = LoadConfig("texto", nil, lookupEnv(map[string]string{"MAILBOX_TTL": "soon"}))
+	assert.NotNil(t, err)
+	_, err = LoadConfig("texto", []string{"-redis-broker", "kafka"}, lookupEnv(nil))
+	assert.NotNil(t, err)
+}
+
+func TestParseConfigFile(t *testing.T) {
+	values, err := parseConfigFile(strings.NewReader(`
+jwt_secret = "a # b"
+allowed_origins = []
+port = 80
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"jwt_secret": "a # b", "allowed_origins": "", "port": "80"}, values)
+
+	for _, invalid := range []string{"port", "= 80", "port = ", "port = eighty", "a = [\"b\"", "a = 1\na = 2"} {
+		_, err := parseConfigFile(strings.NewReader(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.Nil(t, DefaultConfig().Validate())
+	for _, update := range []func(c *Config){
+		func(c *Config) { c.Port = 70000 },
+		func(c *Config) { c.ClientTimeout = 0 },
+		func(c *Config) { c.ReadBufferSize = 0 },
+		func(c *Config) { c.HTTPIdleTimeout = -time.Second },
+		func(c *Config) { c.DrainTimeout = 0 },
+		func(c *Config) { c.AllowedOrigins = []string{"example.com"} },
+		func(c *Config) { c.RedisRouting = "random" },
+		func(c *Config) { c.RedisBroker, c.RedisURL = "streams", "redis+cluster://localhost:7000" },
+		func(c *Config) { c.MailboxSize = 0 },
+		func(c *Config) { c.HistoryFile, c.HistoryRedisURL = "history.log", "localhost:6379" },
+	} {
+		config := DefaultConfig()
+		update(config)
+		assert.NotNil(t, config.Validate())
+	}
+}
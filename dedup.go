@@ -0,0 +1,58 @@
+package texto
+
+import (
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// DefaultDedupWindow is the default duration during which the retries of a sent message are detected.
+const DefaultDedupWindow = 10 * time.Minute
+
+// dedupBroker returns the DedupBroker detecting the retries of the messages sent by the user, or nil if they aren't
+// detected.
+func (c *Client) dedupBroker() DedupBroker {
+	if c.dedupWindow <= 0 {
+		return nil
+	}
+	dedup, _ := c.broker.(DedupBroker)
+	return dedup
+}
+
+// sendClaimTimeout is the duration after which the claim of a message expires if its acknowledgement wasn't recorded,
+// for example because the node sending it stopped. Its retries are then transmitted again.
+const sendClaimTimeout = 30 * time.Second
+
+// claimSentMessage claims the message of the given ID before it is transmitted. If the user already sent it, its
+// acknowledgement is returned and it mustn't be transmitted again. ErrSendPending is returned if it is being sent, for
+// example by a retry on another node.
+func (c *Client) claimSentMessage(messageID uuid.UUID) (*AckMessagePayload, error) {
+	dedup := c.dedupBroker()
+	if dedup == nil {
+		return nil, nil
+	}
+	return dedup.ClaimSentMessage(c.ID, messageID, sendClaimTimeout)
+}
+
+// recordSentMessage records the acknowledgement of the message of the given ID, once it was transmitted.
+func (c *Client) recordSentMessage(messageID uuid.UUID, ack AckMessagePayload) {
+	dedup := c.dedupBroker()
+	if dedup == nil {
+		return
+	}
+	if err := dedup.RecordSentMessage(c.ID, messageID, ack, c.dedupWindow); err != nil {
+		c.log.Error(err)
+	}
+}
+
+// forgetSentMessage removes the claim of the message of the given ID, so that it can be retried after it couldn't be
+// transmitted.
+func (c *Client) forgetSentMessage(messageID uuid.UUID) {
+	dedup := c.dedupBroker()
+	if dedup == nil {
+		return
+	}
+	if err := dedup.ForgetSentMessage(c.ID, messageID); err != nil {
+		c.log.Error(err)
+	}
+}
@@ -0,0 +1,122 @@
+package texto
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_DedupSend(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	sender := NewClient(newLogger(), nil, broker)
+	recipient := NewClient(newLogger(), nil, broker)
+	assert.Nil(t, broker.Register(recipient))
+	sendMsg := NewSendMessage(nil, sender.ID, SendMessagePayload{ReceiverID: recipient.ID, Text: "Hello"})
+
+	sender.dedupWindow = time.Minute
+	dropped := droppedMessages.get(dropDuplicateSend)
+	ack := sender.HandleMessage(sendMsg)
+	assert.Equal(t, AcknowledgeMessageKind, ack.Kind)
+	retry := sender.HandleMessage(sendMsg)
+	assert.Equal(t, ack, retry)
+	assert.Equal(t, dropped+1, droppedMessages.get(dropDuplicateSend))
+	assert.Equal(t, []string{"Hello"}, queuedTexts(recipient))
+
+	other := NewSendMessage(nil, sender.ID, SendMessagePayload{ReceiverID: recipient.ID, Text: "World"})
+	assert.Equal(t, AcknowledgeMessageKind, sender.HandleMessage(other).Kind)
+	assert.Equal(t, []string{"World"}, queuedTexts(recipient))
+
+	sender.dedupWindow = 0
+	sender.HandleMessage(sendMsg)
+	assert.Equal(t, []string{"Hello"}, queuedTexts(recipient))
+}
+
+func TestClient_DedupPendingSend(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	sender := NewClient(newLogger(), nil, broker)
+	recipient := NewClient(newLogger(), nil, broker)
+	assert.Nil(t, broker.Register(recipient))
+	sender.dedupWindow = time.Minute
+	sendMsg := NewSendMessage(nil, sender.ID, SendMessagePayload{ReceiverID: recipient.ID, Text: "Hello"})
+
+	_, err := broker.ClaimSentMessage(sender.ID, sendMsg.ID, time.Minute)
+	assert.Nil(t, err)
+	pending := sender.HandleMessage(sendMsg)
+	assert.Equal(t, ErrorMessageKind, pending.Kind)
+	assert.Equal(t, "EPENDING", pending.Data.(ErrorMessagePayload).Code)
+	assert.Empty(t, queuedTexts(recipient))
+
+	assert.Nil(t, broker.ForgetSentMessage(sender.ID, sendMsg.ID))
+	ack := sender.HandleMessage(sendMsg)
+	assert.Equal(t, AcknowledgeMessageKind, ack.Kind)
+	assert.Equal(t, uint64(1), ack.Data.(AckMessagePayload).Sequence)
+	assert.Equal(t, []string{"Hello"}, queuedTexts(recipient))
+}
+
+func TestMemoryBroker_SentMessages(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	var _ DedupBroker = broker
+	senderID := uuid.NewV4()
+	messageID := uuid.NewV4()
+	first := AckMessagePayload{SentAt: time.Now().UTC(), Sequence: 1}
+
+	ack, err := broker.ClaimSentMessage(senderID, messageID, time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, ack)
+	_, err = broker.ClaimSentMessage(senderID, messageID, time.Minute)
+	assert.Equal(t, ErrSendPending, err)
+	assert.Nil(t, broker.RecordSentMessage(senderID, messageID, first, time.Minute))
+	ack, err = broker.ClaimSentMessage(senderID, messageID, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, &first, ack)
+	ack, err = broker.ClaimSentMessage(uuid.NewV4(), messageID, time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, ack)
+
+	assert.Nil(t, broker.ForgetSentMessage(senderID, messageID))
+	ack, err = broker.ClaimSentMessage(senderID, messageID, -time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, ack)
+	ack, err = broker.ClaimSentMessage(senderID, messageID, -time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, ack)
+	broker.sweep()
+	assert.Len(t, broker.sent, 1)
+}
+
+func TestRedisBroker_SentMessages(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log:  newLogger(),
+		pool: newMockPool(mockConn),
+	}
+	var _ DedupBroker = &broker
+	senderID := uuid.NewV4()
+	messageID := uuid.NewV4()
+	key := "texto:sent:{" + senderID.String() + "}:" + messageID.String()
+	ack := AckMessagePayload{SentAt: time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC), Sequence: 3}
+	marshaled, _ := json.Marshal(ack)
+
+	mockConn.Script([]byte(redisClaimSentScriptSource), 1, key, "pending", int64(30000)).
+		Expect(nil).
+		Expect([]byte("pending")).
+		Expect(marshaled)
+	recorded, err := broker.ClaimSentMessage(senderID, messageID, 30*time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, recorded)
+	_, err = broker.ClaimSentMessage(senderID, messageID, 30*time.Second)
+	assert.Equal(t, ErrSendPending, err)
+	recorded, err = broker.ClaimSentMessage(senderID, messageID, 30*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, &ack, recorded)
+
+	mockConn.Command("SET", key, marshaled, "PX", int64(60000)).Expect("OK")
+	assert.Nil(t, broker.RecordSentMessage(senderID, messageID, ack, time.Minute))
+
+	mockConn.Command("DEL", key).Expect(int64(1))
+	assert.Nil(t, broker.ForgetSentMessage(senderID, messageID))
+}
@@ -1,9 +1,16 @@
 package texto
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"time"
 )
@@ -14,24 +21,301 @@ type ChatHandler struct {
 	Broker   Broker
 	Upgrader websocket.Upgrader
 	Timeout  time.Duration
+	// If not zero, a WebSocket ping is sent to the users every PingInterval, and their connection is closed if nothing
+	// was received from them within PongTimeout.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// The number of messages waiting to be written to each user, DefaultSendQueueSize if zero, and what happens to the
+	// messages sent while it is full.
+	SendQueueSize int
+	Overflow      OverflowPolicy
+	// If not zero, the messages received ahead of their turn in their conversation are held for at most ReorderWindow,
+	// waiting for the ones preceding them.
+	ReorderWindow time.Duration
+	// If not zero and the Broker is a DedupBroker, the messages sent again by a user within DedupWindow, identified by
+	// their ID, are acknowledged again without being transmitted twice.
+	DedupWindow time.Duration
+	// If not zero and the Broker is a ResumeBroker, the sessions can be resumed on another connection, on any node,
+	// during ResumeWindow after their connection is lost. The last ResumeBufferSize messages transmitted to each
+	// session, DefaultResumeBufferSize if zero, are kept to be transmitted again.
+	ResumeWindow     time.Duration
+	ResumeBufferSize int
+	// If not nil, the Authenticator is consulted before upgrading the connection. The authenticated user ID is used as
+	// the identity of the Client, and the requests it rejects are answered with 401 Unauthorized.
+	Authenticator Authenticator
+	// If true and there is no Authenticator, the users can choose their ID with the user_id query parameter or a
+	// registration message. Nothing proves they own it, so anyone can then receive the messages of any user: it must
+	// only be enabled for development. Otherwise, each connection is given a new random ID.
+	InsecureIdentities bool
+	// If not nil, the messages sent by the users are recorded in the MessageStore.
+	Store MessageStore
+	// The rate limits of the messages sent by each session and by all the sessions of each user on this node. The
+	// sessions are closed after MaxRateViolations consecutive messages were rejected, unless it is zero.
+	ClientRateLimit   RateLimit
+	UserRateLimit     RateLimit
+	MaxRateViolations int
+
+	// mu protects sessions and draining.
+	mu sync.Mutex
+	// sessions holds the running Clients, so that they can be closed by Shutdown.
+	sessions map[*Client]struct{}
+	// draining is set by Shutdown, after which new connections are rejected.
+	draining bool
+	// users holds the token buckets of the users, created along with the first session.
+	users *userRateLimiter
+	// running counts the sessions that are still registered in the Broker.
+	running sync.WaitGroup
+}
+
+// DefaultDrainTimeout is the duration given to the sessions to write their queued messages and unregister from the
+// Broker when the server is shutting down.
+const DefaultDrainTimeout = 10 * time.Second
+
+// track adds the given Client to the running sessions, and sets its rate limits. It returns false if the handler is
+// shutting down.
+func (h *ChatHandler) track(client *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return false
+	}
+	if h.sessions == nil {
+		h.sessions = make(map[*Client]struct{})
+		h.users = newUserRateLimiter(h.UserRateLimit)
+	}
+	if h.ClientRateLimit.Rate > 0 || h.UserRateLimit.Rate > 0 {
+		client.limiter = &clientRateLimiter{
+			limit:         h.ClientRateLimit,
+			users:         h.users,
+			maxViolations: h.MaxRateViolations,
+		}
+	}
+	h.sessions[client] = struct{}{}
+	h.running.Add(1)
+	return true
+}
+
+// untrack removes the given Client from the running sessions.
+func (h *ChatHandler) untrack(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sessions, client)
+	h.running.Done()
+}
+
+// Shutdown rejects the new connections and asks the running sessions to write the messages queued for their user and
+// to close their connection with a going away close frame, before the deadline of the given context or within
+// DefaultDrainTimeout if it has none. It returns once all the sessions are unregistered from the Broker, or the error
+// of the context if it is done first.
+func (h *ChatHandler) Shutdown(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultDrainTimeout)
+	}
+	h.mu.Lock()
+	h.draining = true
+	for client := range h.sessions {
+		client.shutdown(deadline)
+	}
+	h.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isDraining reports whether Shutdown was called.
+func (h *ChatHandler) isDraining() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.draining
+}
+
+// ErrInsecureIdentity is returned when a user chooses their ID while the server doesn't allow it.
+var ErrInsecureIdentity = errors.New("user IDs can't be chosen by the clients")
+
+// resolveUserID returns the durable ID of the user opening the given request, as specified by the user_id query
+// parameter if insecure is true. If none was given, a new random ID is generated.
+func resolveUserID(r *http.Request, insecure bool) (uuid.UUID, error) {
+	value := r.URL.Query().Get("user_id")
+	if len(value) == 0 {
+		return uuid.NewV4(), nil
+	}
+	if !insecure {
+		return uuid.Nil, ErrInsecureIdentity
+	}
+	return uuid.FromString(value)
 }
 
 // ServeHTTP is the http.Handler implementation for ChatHandler.
 func (h *ChatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.isDraining() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	var userID uuid.UUID
+	var err error
+	if h.Authenticator != nil {
+		userID, err = h.Authenticator.Authenticate(r)
+		if err != nil {
+			h.Log.
+				WithField("remote", r.RemoteAddr).
+				WithError(err).
+				Warn("Rejected unauthenticated connection")
+			rejectedUpgrades.inc(rejectUnauthorized)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		userID, err = resolveUserID(r, h.InsecureIdentities)
+		if err == ErrInsecureIdentity {
+			http.Error(w, "User IDs can't be chosen on this server", http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+	}
 	conn, err := h.Upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.Log.Error(err)
 		return
 	}
 	client := NewClient(h.Log, conn, h.Broker)
-	h.Broker.Register(client)
+	client.ID = userID
+	client.authenticated = h.Authenticator != nil
+	client.insecureIdentity = h.InsecureIdentities
+	client.store = h.Store
+	if h.SendQueueSize > 0 {
+		client.outboundChan = make(chan *ChatMessage, h.SendQueueSize)
+	}
+	client.overflow = h.Overflow
+	client.reorderWindow = h.ReorderWindow
+	client.dedupWindow = h.DedupWindow
+	client.pingInterval = h.PingInterval
+	client.pongTimeout = h.PongTimeout
+	if !h.track(client) {
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, ShutdownCloseReason)
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	defer h.untrack(client)
+	if resumes, ok := h.Broker.(ResumeBroker); ok && h.ResumeWindow > 0 {
+		size := h.ResumeBufferSize
+		if size <= 0 {
+			size = DefaultResumeBufferSize
+		}
+		if err := client.makeResumable(resumes, h.ResumeWindow, size); err != nil {
+			h.Log.Error(err)
+		}
+	}
+	if err := h.Broker.Register(client); err != nil {
+		h.Log.Error(err)
+	}
+	connectedClients.add(1)
 	defer func() {
-		h.Broker.Unregister(client)
+		connectedClients.add(-1)
+		client.releaseSession()
+		if err := h.Broker.Unregister(client); err != nil {
+			h.Log.Error(err)
+		}
+		client.closeQueue()
 	}()
 	if len(r.URL.Query().Get("nogreet")) == 0 {
-		client.outboundChan <- NewConnectionMessage(nil, client.ID, ConnectionMessagePayload{
-			ClientID: client.ID,
-		})
+		client.enqueue(NewConnectionMessage(nil, client.ID, ConnectionMessagePayload{
+			ClientID:    client.ID,
+			SessionID:   client.SessionID,
+			ResumeToken: client.resumeToken(),
+		}))
 	}
 	client.Run(h.Timeout)
+	client.linger(h.isDraining())
+}
+
+// HistoryHandler is the HTTP Handler serving the history of the conversations, on paths of the form
+// /v1/conversations/{peer}/messages. The page is selected by the before (an RFC 3339 timestamp) and limit query
+// parameters.
+type HistoryHandler struct {
+	Log    *logrus.Logger
+	Broker Broker
+	Store  MessageStore
+	// Authenticator identifies the user requesting the history. Without an Authenticator, the identity of the user
+	// can't be trusted and all requests are rejected.
+	Authenticator Authenticator
+}
+
+// historyPathPrefix is the prefix of the paths served by the HistoryHandler.
+const historyPathPrefix = "/v1/conversations/"
+
+// ServeHTTP is the http.Handler implementation for HistoryHandler.
+func (h *HistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, historyPathPrefix), "/")
+	if len(parts) != 2 || parts[1] != "messages" {
+		http.NotFound(w, r)
+		return
+	}
+	if h.Authenticator == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, err := h.Authenticator.Authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	request := HistoryMessagePayload{}
+	if request.PeerID, err = uuid.FromString(parts[0]); err != nil {
+		http.Error(w, "Invalid peer ID", http.StatusBadRequest)
+		return
+	}
+	if value := r.URL.Query().Get("before"); len(value) != 0 {
+		before, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, "Invalid before parameter", http.StatusBadRequest)
+			return
+		}
+		request.Before = &before
+	}
+	if value := r.URL.Query().Get("before_id"); len(value) != 0 {
+		beforeID, err := uuid.FromString(value)
+		if err != nil {
+			http.Error(w, "Invalid before_id parameter", http.StatusBadRequest)
+			return
+		}
+		request.BeforeID = &beforeID
+	}
+	if value := r.URL.Query().Get("limit"); len(value) != 0 {
+		if request.Limit, err = strconv.Atoi(value); err != nil || request.Limit <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	page, err := loadHistory(h.Broker, h.Store, userID, request)
+	if err == ErrNotRoomMember {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	} else if err != nil {
+		h.Log.Error(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		h.Log.Error(err)
+	}
 }
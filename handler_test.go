@@ -1,14 +1,19 @@
 package texto
 
 import (
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -22,7 +27,7 @@ func newLogger() *logrus.Logger {
 func TestChatHandler_ServeHTTP(t *testing.T) {
 	handler := ChatHandler{
 		Log: newLogger(),
-		Broker: newDummyBroker(),
+		Broker: NewMemoryBroker(newLogger()),
 		Upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -45,3 +50,312 @@ func TestChatHandler_ServeHTTP(t *testing.T) {
 	time.Sleep(3 * time.Second)
 	srv.Close()
 }
+
+func TestChatHandler_ServeHTTPUserID(t *testing.T) {
+	handler := ChatHandler{
+		Log: newLogger(),
+		Broker: NewMemoryBroker(newLogger()),
+		Upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		Timeout: time.Second,
+	}
+	srv := httptest.NewServer(&handler)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	u.Scheme = "ws"
+	u.Path = "/v1/texto"
+	userID := uuid.NewV4()
+	u.RawQuery = url.Values{"user_id": {userID.String()}}.Encode()
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	handler.InsecureIdentities = true
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if assert.Nil(t, err) {
+		greetingMsg := new(ChatMessage)
+		assert.Nil(t, conn.ReadJSON(greetingMsg))
+		assert.Equal(t, userID, greetingMsg.Data.(ConnectionMessagePayload).ClientID)
+		conn.Close()
+	}
+	u.RawQuery = url.Values{"user_id": {"not-a-uuid"}}.Encode()
+	_, resp, err = websocket.DefaultDialer.Dial(u.String(), nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestChatHandler_ServeHTTPAuthenticator(t *testing.T) {
+	authenticator := &JWTAuthenticator{Secret: []byte("secret")}
+	handler := ChatHandler{
+		Log: newLogger(),
+		Broker: NewMemoryBroker(newLogger()),
+		Upgrader: websocket.Upgrader{
+			Subprotocols: []string{Subprotocol},
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		Timeout: time.Second,
+		Authenticator: authenticator,
+	}
+	srv := httptest.NewServer(&handler)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	u.Scheme = "ws"
+	u.Path = "/v1/texto"
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	userID := uuid.NewV4()
+	token, _ := authenticator.Sign(JWTClaims{Subject: userID.String()})
+	dialer := websocket.Dialer{Subprotocols: []string{Subprotocol, TokenSubprotocolPrefix + token}}
+	conn, resp, err := dialer.Dial(u.String(), nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, Subprotocol, resp.Header.Get("Sec-WebSocket-Protocol"))
+		greetingMsg := new(ChatMessage)
+		assert.Nil(t, conn.ReadJSON(greetingMsg))
+		assert.Equal(t, userID, greetingMsg.ClientID)
+
+		registrationMsg := NewRegistrationMessage(nil, userID)
+		registrationMsg.Data = RegistrationMessagePayload{UserID: uuid.NewV4()}
+		assert.Nil(t, conn.WriteJSON(registrationMsg))
+		errorMsg := new(ChatMessage)
+		assert.Nil(t, conn.ReadJSON(errorMsg))
+		assert.Equal(t, ErrorMessageKind, errorMsg.Kind)
+		assert.Equal(t, "EAUTH", errorMsg.Data.(ErrorMessagePayload).Code)
+		conn.Close()
+	}
+}
+
+func TestChatHandler_Shutdown(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	handler := ChatHandler{
+		Log:    newLogger(),
+		Broker: broker,
+		Upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		Timeout:            time.Minute,
+		InsecureIdentities: true,
+	}
+	srv := httptest.NewServer(&handler)
+	defer srv.Close()
+	userID := uuid.NewV4()
+	u, _ := url.Parse(srv.URL)
+	u.Scheme = "ws"
+	u.RawQuery = "nogreet=1&user_id=" + userID.String()
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	for broker.clients.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, broker.Send(userID, &BrokerMessage{
+		SenderID:    uuid.NewV4(),
+		RecipientID: userID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	}))
+	received := new(ChatMessage)
+	assert.Nil(t, conn.ReadJSON(received))
+	assert.Equal(t, ReceiveMessageKind, received.Kind)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, handler.Shutdown(ctx))
+	assert.Equal(t, 0, broker.clients.len())
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	assert.NotNil(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestChatHandler_RateLimit(t *testing.T) {
+	handler := ChatHandler{
+		Log:    newLogger(),
+		Broker: NewMemoryBroker(newLogger()),
+		Upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		Timeout:           time.Minute,
+		ClientRateLimit:   RateLimit{Rate: 0.1, Burst: 1},
+		MaxRateViolations: 3,
+	}
+	srv := httptest.NewServer(&handler)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	u.Scheme = "ws"
+	u.RawQuery = "nogreet=1"
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	codes := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, conn.WriteJSON(NewRegistrationMessage(nil, uuid.Nil)))
+		received := new(ChatMessage)
+		assert.Nil(t, conn.ReadJSON(received))
+		if received.Kind == ErrorMessageKind {
+			codes[received.Data.(ErrorMessagePayload).Code]++
+		}
+	}
+	assert.Equal(t, map[string]int{"ERATE": 3}, codes)
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+}
+
+func TestHistoryHandler_ServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "texto")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileMessageStore(filepath.Join(dir, "history.jsonl"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer store.Close()
+	sender := uuid.NewV4()
+	recipient := uuid.NewV4()
+	sentAt := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		store.Store(&BrokerMessage{
+			MessageID:   uuid.NewV4(),
+			SenderID:    sender,
+			RecipientID: recipient,
+			Text:        "Lorem ipsum dolor sit amet...",
+			SentAt:      sentAt.Add(time.Duration(i) * time.Second),
+		})
+	}
+	handler := &HistoryHandler{
+		Log:    newLogger(),
+		Broker: NewMemoryBroker(newLogger()),
+		Store:  store,
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	query := url.Values{
+		"user_id": {recipient.String()},
+		"before":  {sentAt.Add(2 * time.Second).Format(time.RFC3339Nano)},
+		"limit":   {"10"},
+	}
+	resp, err := http.Get(srv.URL + "/v1/conversations/" + sender.String() + "/messages?" + query.Encode())
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	authenticator := &JWTAuthenticator{Secret: []byte("secret")}
+	handler.Authenticator = authenticator
+	token, _ := authenticator.Sign(JWTClaims{Subject: recipient.String()})
+	delete(query, "user_id")
+	query.Set("token", token)
+	resp, err = http.Get(srv.URL + "/v1/conversations/" + sender.String() + "/messages?" + query.Encode())
+	if assert.Nil(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		page := new(HistoryMessagePayload)
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(page))
+		assert.Equal(t, sender, page.PeerID)
+		assert.Len(t, page.Messages, 2)
+	}
+
+	resp, err = http.Get(srv.URL + "/v1/conversations/" + sender.String() + "/messages")
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	resp, err = http.Get(srv.URL + "/v1/conversations/" + sender.String() + "?token=" + token)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+	resp, err = http.Post(srv.URL+"/v1/conversations/"+sender.String()+"/messages", "application/json", nil)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestChatHandler_Resume(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	handler := ChatHandler{
+		Log:    newLogger(),
+		Broker: broker,
+		Upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		Timeout:      time.Minute,
+		ResumeWindow: time.Minute,
+	}
+	srv := httptest.NewServer(&handler)
+	defer srv.Close()
+	defer handler.Shutdown(context.Background())
+	u, _ := url.Parse(srv.URL)
+	u.Scheme = "ws"
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	read := func(conn *websocket.Conn) *ChatMessage {
+		received := new(ChatMessage)
+		assert.Nil(t, conn.ReadJSON(received))
+		return received
+	}
+	senderID := uuid.NewV4()
+	send := func(recipientID uuid.UUID, text string) {
+		assert.Nil(t, broker.Send(recipientID, &BrokerMessage{
+			MessageID:   uuid.NewV4(),
+			SenderID:    senderID,
+			RecipientID: recipientID,
+			Text:        text,
+		}))
+	}
+
+	conn := dial()
+	greeting := read(conn).Data.(ConnectionMessagePayload)
+	assert.NotEmpty(t, greeting.ResumeToken)
+	send(greeting.ClientID, "first")
+	receive := read(conn).Data.(ReceiveMessagePayload)
+	assert.Equal(t, uint64(1), receive.SessionSequence)
+	conn.UnderlyingConn().Close()
+	send(greeting.ClientID, "second")
+
+	conn = dial()
+	defer conn.Close()
+	read(conn)
+	assert.Nil(t, conn.WriteJSON(NewResumeMessage(nil, uuid.Nil, ResumeMessagePayload{
+		Token:        greeting.ResumeToken,
+		LastSequence: 1,
+	})))
+	resumed := read(conn)
+	assert.Equal(t, ConnectionMessageKind, resumed.Kind)
+	assert.Equal(t, greeting, resumed.Data.(ConnectionMessagePayload))
+	receive = read(conn).Data.(ReceiveMessagePayload)
+	assert.Equal(t, "second", receive.Text)
+	assert.Equal(t, uint64(2), receive.SessionSequence)
+	send(greeting.ClientID, "third")
+	receive = read(conn).Data.(ReceiveMessagePayload)
+	assert.Equal(t, "third", receive.Text)
+	assert.Equal(t, uint64(3), receive.SessionSequence)
+}
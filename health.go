@@ -0,0 +1,35 @@
+package texto
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A HealthChecker is a Broker able to report whether it can currently transmit messages between users.
+type HealthChecker interface {
+	Broker
+	// CheckHealth returns an error describing why the Broker can't transmit messages, or nil if it is healthy.
+	CheckHealth() error
+}
+
+// HealthHandler is the HTTP Handler answering 200 OK when its check succeeds, and 503 Service Unavailable otherwise.
+type HealthHandler struct {
+	Log   *logrus.Logger
+	Check func() error
+}
+
+// ServeHTTP is the http.Handler implementation for HealthHandler.
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.Check(); err != nil {
+		h.Log.
+			WithField("path", r.URL.Path).
+			WithError(err).
+			Warn("Health check failed")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,398 @@
+package texto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// DefaultHistoryLimit is the number of messages returned by a history request that doesn't specify a limit.
+	DefaultHistoryLimit = 50
+	// MaxHistoryLimit is the maximum number of messages returned by a single history request.
+	MaxHistoryLimit = 100
+)
+
+// A MessageStore records the messages sent through the server, and returns the history of the conversations.
+type MessageStore interface {
+	// Store records the given message in the history of its conversation.
+	Store(message *BrokerMessage) error
+	// History returns at most limit messages of the given conversation preceding the given cursor, in chronological
+	// order.
+	History(conversationID uuid.UUID, before HistoryCursor, limit int) ([]*BrokerMessage, error)
+}
+
+// A HistoryCursor is a position in the history of a conversation, whose messages are ordered by the time at which they
+// were sent, then by ID. The messages preceding a cursor are the ones sent before SentAt, and the ones sent at SentAt
+// whose ID is lower than MessageID, so that a page ending with a message can be followed by the one preceding it even
+// if other messages were sent at the same time.
+type HistoryCursor struct {
+	SentAt    time.Time
+	MessageID uuid.UUID
+}
+
+// messageCursor returns the position of the given message in the history of its conversation.
+func messageCursor(message *BrokerMessage) HistoryCursor {
+	return HistoryCursor{SentAt: message.SentAt, MessageID: message.MessageID}
+}
+
+// before reports whether the cursor precedes the other given cursor.
+func (c HistoryCursor) before(other HistoryCursor) bool {
+	if !c.SentAt.Equal(other.SentAt) {
+		return c.SentAt.Before(other.SentAt)
+	}
+	return bytes.Compare(c.MessageID.Bytes(), other.MessageID.Bytes()) < 0
+}
+
+// conversationNamespace is the namespace of the IDs generated by ConversationID.
+var conversationNamespace = uuid.NewV5(uuid.NamespaceURL, "https://github.com/kureuil/texto/conversations")
+
+// ConversationID returns the ID of the direct conversation between the two given users. It doesn't depend on the order
+// of its arguments.
+func ConversationID(firstUserID, secondUserID uuid.UUID) uuid.UUID {
+	if firstUserID.String() > secondUserID.String() {
+		firstUserID, secondUserID = secondUserID, firstUserID
+	}
+	return uuid.NewV5(conversationNamespace, firstUserID.String()+secondUserID.String())
+}
+
+// messageConversationID returns the ID of the conversation the given message belongs to: the ID of its room for room
+// messages, and the ID of the conversation between its sender and its recipient otherwise.
+func messageConversationID(message *BrokerMessage) uuid.UUID {
+	if message.RoomID != uuid.Nil {
+		return message.RoomID
+	}
+	return ConversationID(message.SenderID, message.RecipientID)
+}
+
+// resolveConversationID returns the ID of the conversation between the given user and a peer, which is either another
+// user or a room. Only the members of a room can access its conversation.
+func resolveConversationID(broker Broker, userID, peerID uuid.UUID) (uuid.UUID, error) {
+	if rooms, ok := broker.(RoomBroker); ok {
+		members, err := rooms.RoomMembers(peerID)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if len(members) != 0 {
+			if !containsUUID(members, userID) {
+				return uuid.Nil, ErrNotRoomMember
+			}
+			return peerID, nil
+		}
+	}
+	return ConversationID(userID, peerID), nil
+}
+
+// loadHistory returns the page of the history of the conversation between the given user and a peer selected by the
+// given request.
+func loadHistory(broker Broker, store MessageStore, userID uuid.UUID, request HistoryMessagePayload) (HistoryMessagePayload, error) {
+	page := HistoryMessagePayload{
+		PeerID:   request.PeerID,
+		Messages: []ReceiveMessagePayload{},
+	}
+	conversationID, err := resolveConversationID(broker, userID, request.PeerID)
+	if err != nil {
+		return page, err
+	}
+	before := HistoryCursor{SentAt: time.Now()}
+	if request.Before != nil {
+		before.SentAt = *request.Before
+		if request.BeforeID != nil {
+			before.MessageID = *request.BeforeID
+		}
+	}
+	messages, err := store.History(conversationID, before, request.Limit)
+	if err != nil {
+		return page, err
+	}
+	for _, message := range messages {
+		page.Messages = append(page.Messages, newReceivePayload(message))
+	}
+	return page, nil
+}
+
+// normalizeHistoryLimit returns the number of messages to return for the requested limit.
+func normalizeHistoryLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		return MaxHistoryLimit
+	}
+	return limit
+}
+
+// ErrClosedStore is returned by a FileMessageStore once it was closed.
+var ErrClosedStore = errors.New("message store is closed")
+
+// A FileMessageStore is a MessageStore persisting the messages in a single append-only file, one JSON record per line.
+// Every record points to the previous record of its conversation, and only the position of the last record of each
+// conversation is kept in memory: History reads the records of a conversation backward, from the most recent one. These
+// positions are rebuilt from the file when it is opened.
+type FileMessageStore struct {
+	mu    sync.RWMutex
+	file  *os.File
+	size  int64
+	heads map[uuid.UUID]fileMessagePosition
+}
+
+// A fileMessageRecord is a line of the file of a FileMessageStore.
+type fileMessageRecord struct {
+	ConversationID uuid.UUID
+	// Previous locates the previous record of the conversation, or is nil for its first record.
+	Previous *fileMessagePosition `json:",omitempty"`
+	Message  *BrokerMessage
+}
+
+// A fileMessagePosition locates a record in the file of a FileMessageStore.
+type fileMessagePosition struct {
+	Offset int64
+	Length int64
+}
+
+// fileHistoryDisorder is the maximum delay between the time at which a message is sent and the time at which it is
+// stored. The records of a conversation are appended in the order in which they are stored, so History keeps reading
+// them for this duration past the oldest message of a page, in case an older record holds a more recent message.
+const fileHistoryDisorder = time.Minute
+
+// NewFileMessageStore opens the FileMessageStore stored at the given path, creating it if needed.
+func NewFileMessageStore(path string) (*FileMessageStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileMessageStore{
+		file:  file,
+		heads: make(map[uuid.UUID]fileMessagePosition),
+	}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load finds the last record of every conversation in the file. The records that can't be decoded are skipped, and a
+// truncated last record, left by an interrupted write, is discarded.
+func (s *FileMessageStore) load() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		record := new(fileMessageRecord)
+		if err := json.Unmarshal(line, record); err == nil && record.Message != nil {
+			s.heads[record.ConversationID] = fileMessagePosition{Offset: offset, Length: int64(len(line))}
+		}
+		offset += int64(len(line))
+	}
+	s.size = offset
+	return s.file.Truncate(offset)
+}
+
+// Store is the implementation of MessageStore.Store for FileMessageStore. The record is synced to the disk before
+// Store returns.
+func (s *FileMessageStore) Store(message *BrokerMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return ErrClosedStore
+	}
+	record := fileMessageRecord{
+		ConversationID: messageConversationID(message),
+		Message:        message,
+	}
+	if previous, ok := s.heads[record.ConversationID]; ok {
+		record.Previous = &previous
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.file.WriteAt(line, s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.heads[record.ConversationID] = fileMessagePosition{Offset: s.size, Length: int64(len(line))}
+	s.size += int64(len(line))
+	return nil
+}
+
+// History is the implementation of MessageStore.History for FileMessageStore. The history of a conversation stops at
+// the first record that can't be decoded.
+func (s *FileMessageStore) History(conversationID uuid.UUID, before HistoryCursor, limit int) ([]*BrokerMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return nil, ErrClosedStore
+	}
+	limit = normalizeHistoryLimit(limit)
+	var messages []*BrokerMessage
+	var next *fileMessagePosition
+	if head, ok := s.heads[conversationID]; ok {
+		next = &head
+	}
+	for next != nil {
+		line := make([]byte, next.Length)
+		if _, err := s.file.ReadAt(line, next.Offset); err != nil {
+			return nil, err
+		}
+		record := new(fileMessageRecord)
+		if err := json.Unmarshal(line, record); err != nil || record.Message == nil {
+			break
+		}
+		if len(messages) == limit && record.Message.SentAt.Before(messages[0].SentAt.Add(-fileHistoryDisorder)) {
+			break
+		}
+		if messageCursor(record.Message).before(before) {
+			messages = insertMessage(messages, record.Message, limit)
+		}
+		next = record.Previous
+	}
+	return messages, nil
+}
+
+// insertMessage inserts the given message in the given messages, sorted in chronological order, and keeps the limit
+// most recent ones.
+func insertMessage(messages []*BrokerMessage, message *BrokerMessage, limit int) []*BrokerMessage {
+	position := messageCursor(message)
+	i := sort.Search(len(messages), func(i int) bool {
+		return position.before(messageCursor(messages[i]))
+	})
+	messages = append(messages, nil)
+	copy(messages[i+1:], messages[i:])
+	messages[i] = message
+	if len(messages) > limit {
+		messages = messages[1:]
+	}
+	return messages
+}
+
+// Close closes the file of the store.
+func (s *FileMessageStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// A RedisMessageStore is a MessageStore keeping the history of every conversation in a Redis sorted set, scored by the
+// time at which the messages were sent, in microseconds. Each member is the ID of a message followed by its JSON
+// payload, so that the messages sent during the same microsecond are ordered by ID.
+type RedisMessageStore struct {
+	// pool provides the connections used to send commands to Redis.
+	pool *redis.Pool
+}
+
+// NewRedisMessageStore returns a RedisMessageStore connected to Redis using the given address, which accepts the same
+// forms as the one of NewRedisBroker, and checks that the Redis server is reachable.
+func NewRedisMessageStore(addr string) (*RedisMessageStore, error) {
+	dial, err := newRedisDialer(addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &RedisMessageStore{pool: newRedisPool(dial)}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		s.pool.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the connections of the store.
+func (s *RedisMessageStore) Close() error {
+	return s.pool.Close()
+}
+
+// historyKey returns the key of the sorted set storing the history of the given conversation.
+func historyKey(conversationID uuid.UUID) string {
+	return RedisBrokerPrefix + "history:" + conversationID.String()
+}
+
+// historyIDLength is the length of the ID of the message starting each member of the history of a conversation.
+const historyIDLength = 36
+
+// historyScore returns the score of a message sent at the given time.
+func historyScore(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// Store is the implementation of MessageStore.Store for RedisMessageStore.
+func (s *RedisMessageStore) Store(message *BrokerMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	member := append([]byte(message.MessageID.String()), payload...)
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("ZADD", historyKey(messageConversationID(message)), historyScore(message.SentAt), member)
+	return err
+}
+
+// History is the implementation of MessageStore.History for RedisMessageStore. The messages sent during the microsecond
+// of the cursor are read first, then the ones sent before it.
+func (s *RedisMessageStore) History(conversationID uuid.UUID, before HistoryCursor, limit int) ([]*BrokerMessage, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	key := historyKey(conversationID)
+	limit = normalizeHistoryLimit(limit)
+	score := strconv.FormatInt(historyScore(before.SentAt), 10)
+	var members [][]byte
+	if before.MessageID != uuid.Nil {
+		ties, err := redis.ByteSlices(conn.Do("ZREVRANGEBYSCORE", key, score, score))
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range ties {
+			// A member starts with the ID of its message, and is thus lower than the ID of the cursor if and only if
+			// its message precedes it.
+			if len(members) < limit && string(member) < before.MessageID.String() {
+				members = append(members, member)
+			}
+		}
+	}
+	if len(members) < limit {
+		older, err := redis.ByteSlices(conn.Do("ZREVRANGEBYSCORE", key, "("+score, "-inf", "LIMIT", 0, limit-len(members)))
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, older...)
+	}
+	messages := make([]*BrokerMessage, len(members))
+	for i, member := range members {
+		message := new(BrokerMessage)
+		if len(member) < historyIDLength {
+			return nil, errUnexpectedReply(member)
+		}
+		if err := json.Unmarshal(member[historyIDLength:], message); err != nil {
+			return nil, err
+		}
+		messages[len(members)-1-i] = message
+	}
+	return messages, nil
+}
@@ -0,0 +1,194 @@
+package texto
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversationID(t *testing.T) {
+	first := uuid.NewV4()
+	second := uuid.NewV4()
+	assert.Equal(t, ConversationID(first, second), ConversationID(second, first))
+	assert.NotEqual(t, ConversationID(first, second), ConversationID(first, uuid.NewV4()))
+}
+
+func TestFileMessageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "texto")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.jsonl")
+	store, err := NewFileMessageStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	sender := uuid.NewV4()
+	recipient := uuid.NewV4()
+	start := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i, text := range []string{"first", "third", "second"} {
+		sentAt := start.Add(time.Duration(i) * time.Second)
+		if text == "second" {
+			sentAt = start.Add(time.Second / 2)
+		}
+		assert.Nil(t, store.Store(&BrokerMessage{
+			MessageID:   uuid.NewV4(),
+			SenderID:    sender,
+			RecipientID: recipient,
+			Text:        text,
+			SentAt:      sentAt,
+		}))
+	}
+	assert.Nil(t, store.Store(&BrokerMessage{
+		SenderID:    sender,
+		RecipientID: uuid.NewV4(),
+		Text:        "elsewhere",
+		SentAt:      start,
+	}))
+
+	conversationID := ConversationID(recipient, sender)
+	messages, err := store.History(conversationID, HistoryCursor{SentAt: start.Add(time.Minute)}, 2)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "second", messages[0].Text)
+		assert.Equal(t, "third", messages[1].Text)
+	}
+	messages, err = store.History(conversationID, messageCursor(messages[0]), 2)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "first", messages[0].Text)
+	}
+	assert.Nil(t, store.Close())
+	_, err = store.History(conversationID, HistoryCursor{SentAt: start}, 2)
+	assert.Equal(t, ErrClosedStore, err)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if assert.Nil(t, err) {
+		file.WriteString("{\"ConversationID\":\n")
+		file.WriteString(`{"ConversationID":`)
+		file.Close()
+	}
+	store, err = NewFileMessageStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer store.Close()
+	messages, err = store.History(conversationID, HistoryCursor{SentAt: start.Add(time.Minute)}, 0)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 3)
+	assert.Nil(t, store.Store(&BrokerMessage{
+		SenderID:    recipient,
+		RecipientID: sender,
+		Text:        "fourth",
+		SentAt:      start.Add(time.Minute),
+	}))
+	messages, err = store.History(conversationID, HistoryCursor{SentAt: start.Add(time.Hour)}, 0)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 4) {
+		assert.Equal(t, "fourth", messages[3].Text)
+	}
+}
+
+func TestFileMessageStore_SameTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "texto")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileMessageStore(filepath.Join(dir, "history.jsonl"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer store.Close()
+	sender := uuid.NewV4()
+	recipient := uuid.NewV4()
+	sentAt := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	stored := make(map[uuid.UUID]bool)
+	for i := 0; i < 5; i++ {
+		message := &BrokerMessage{
+			MessageID:   uuid.NewV4(),
+			SenderID:    sender,
+			RecipientID: recipient,
+			SentAt:      sentAt,
+		}
+		assert.Nil(t, store.Store(message))
+		stored[message.MessageID] = true
+	}
+
+	conversationID := ConversationID(sender, recipient)
+	cursor := HistoryCursor{SentAt: sentAt.Add(time.Second)}
+	for page := 0; page < 3; page++ {
+		messages, err := store.History(conversationID, cursor, 2)
+		if !assert.Nil(t, err) || len(messages) == 0 {
+			break
+		}
+		for i, message := range messages {
+			assert.True(t, stored[message.MessageID])
+			delete(stored, message.MessageID)
+			if i > 0 {
+				assert.True(t, messageCursor(messages[i-1]).before(messageCursor(message)))
+			}
+		}
+		cursor = messageCursor(messages[0])
+	}
+	assert.Empty(t, stored)
+}
+
+func TestRedisMessageStore(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	store := &RedisMessageStore{pool: newMockPool(mockConn)}
+	message := &BrokerMessage{
+		MessageID:   uuid.FromStringOrNil("f0000000-0000-4000-8000-000000000000"),
+		SenderID:    uuid.NewV4(),
+		RecipientID: uuid.NewV4(),
+		Text:        "Lorem ipsum dolor sit amet...",
+		SentAt:      time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC),
+	}
+	marshaled, _ := json.Marshal(message)
+	member := append([]byte(message.MessageID.String()), marshaled...)
+	key := "texto:history:" + ConversationID(message.SenderID, message.RecipientID).String()
+	mockConn.Command("ZADD", key, int64(1506859200000000), member).Expect(int64(1))
+	assert.Nil(t, store.Store(message))
+
+	mockConn.Command("ZREVRANGEBYSCORE", key, "(1506859260000000", "-inf", "LIMIT", 0, DefaultHistoryLimit).
+		Expect([]interface{}{member})
+	messages, err := store.History(
+		ConversationID(message.RecipientID, message.SenderID),
+		HistoryCursor{SentAt: message.SentAt.Add(time.Minute)},
+		0,
+	)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, message.MessageID, messages[0].MessageID)
+		assert.Equal(t, message.Text, messages[0].Text)
+	}
+
+	same := *message
+	same.MessageID = uuid.FromStringOrNil("10000000-0000-4000-8000-000000000000")
+	same.Text = "same time"
+	marshaled, _ = json.Marshal(&same)
+	sameMember := append([]byte(same.MessageID.String()), marshaled...)
+	older := *message
+	older.MessageID = uuid.NewV4()
+	older.Text = "older"
+	marshaled, _ = json.Marshal(&older)
+	olderMember := append([]byte(older.MessageID.String()), marshaled...)
+	mockConn.Command("ZREVRANGEBYSCORE", key, "1506859200000000", "1506859200000000").
+		Expect([]interface{}{member, sameMember})
+	mockConn.Command("ZREVRANGEBYSCORE", key, "(1506859200000000", "-inf", "LIMIT", 0, 1).
+		Expect([]interface{}{olderMember})
+	messages, err = store.History(ConversationID(message.RecipientID, message.SenderID), messageCursor(message), 2)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "older", messages[0].Text)
+		assert.Equal(t, "same time", messages[1].Text)
+	}
+}
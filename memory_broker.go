@@ -0,0 +1,451 @@
+package texto
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// A MemoryBroker transmits messages between users connected to the current process. It doesn't require any external
+// service, which makes it suitable for single-node deployments, local development and tests.
+type MemoryBroker struct {
+	Log *logrus.Logger
+	// MailboxTTL is the duration for which messages sent to offline users are kept.
+	MailboxTTL time.Duration
+	// MailboxSize is the maximum number of messages kept for an offline user. Older messages are discarded first.
+	MailboxSize int
+	clients     clientRegistry
+	presence    presenceRegistry
+	// mu serializes the registration of clients with the accesses to the mailboxes.
+	mu        sync.Mutex
+	mailboxes map[string][]memoryMailboxEntry
+	rooms     map[uuid.UUID]map[uuid.UUID]struct{}
+	lastSeen  map[uuid.UUID]time.Time
+	sequences map[uuid.UUID]uint64
+	sent      map[memorySentKey]memorySentEntry
+	// sessionsMu protects sessions. The messages are buffered while b.mu is held by Send.
+	sessionsMu sync.Mutex
+	sessions   map[string]*memorySession
+}
+
+// A memorySession is a resumable session, along with the last messages transmitted to it.
+type memorySession struct {
+	state     SessionState
+	sequence  uint64
+	buffer    []BufferedMessage
+	expiresAt time.Time
+}
+
+// A memorySentKey identifies a message sent by a user.
+type memorySentKey struct {
+	senderID  uuid.UUID
+	messageID uuid.UUID
+}
+
+// A memorySentEntry is the acknowledgement of a message sent by a user, kept to detect its retries. It is nil while the
+// message is being sent.
+type memorySentEntry struct {
+	ack       *AckMessagePayload
+	expiresAt time.Time
+}
+
+// A memoryMailboxEntry is a message waiting for its recipient to connect.
+type memoryMailboxEntry struct {
+	message   *BrokerMessage
+	expiresAt time.Time
+}
+
+// NewMemoryBroker creates a new MemoryBroker instance.
+func NewMemoryBroker(log *logrus.Logger) *MemoryBroker {
+	return &MemoryBroker{
+		Log:         log,
+		MailboxTTL:  DefaultMailboxTTL,
+		MailboxSize: DefaultMailboxSize,
+		mailboxes:   make(map[string][]memoryMailboxEntry),
+		rooms:       make(map[uuid.UUID]map[uuid.UUID]struct{}),
+		lastSeen:    make(map[uuid.UUID]time.Time),
+		sequences:   make(map[uuid.UUID]uint64),
+		sent:        make(map[memorySentKey]memorySentEntry),
+		sessions:    make(map[string]*memorySession),
+	}
+}
+
+// Register registers a Client in the internal Client registry of the Broker and delivers the messages that were sent
+// while its user was offline.
+func (b *MemoryBroker) Register(client *Client) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients.add(client) {
+		b.publishPresence(PresenceMessagePayload{
+			UserID: client.ID,
+			Status: PresenceOnline,
+		})
+	}
+	for _, message := range b.take(client.ID) {
+		client.deliver(message)
+	}
+	return nil
+}
+
+// take removes the mailbox of the given user, and returns the messages it contains that didn't expire. The caller must
+// hold b.mu.
+func (b *MemoryBroker) take(userID uuid.UUID) []*BrokerMessage {
+	now := time.Now()
+	var messages []*BrokerMessage
+	for _, entry := range b.mailboxes[userID.String()] {
+		if entry.expiresAt.Before(now) {
+			continue
+		}
+		messages = append(messages, entry.message)
+	}
+	delete(b.mailboxes, userID.String())
+	return messages
+}
+
+// Unregister removes a Client from the internal Client registry of the Broker.
+func (b *MemoryBroker) Unregister(client *Client) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.presence.removeAll(client)
+	if b.clients.remove(client) {
+		now := time.Now()
+		b.lastSeen[client.ID] = now
+		b.publishPresence(PresenceMessagePayload{
+			UserID:   client.ID,
+			Status:   PresenceOffline,
+			LastSeen: &now,
+		})
+	}
+	return nil
+}
+
+// publishPresence transmits the given presence event to the Clients subscribed to it.
+func (b *MemoryBroker) publishPresence(presence PresenceMessagePayload) {
+	for _, client := range b.presence.subscribers(presence.UserID) {
+		client.deliverPresence(presence)
+	}
+}
+
+// Heartbeat does nothing, as the sessions of a MemoryBroker can't outlive the process.
+func (b *MemoryBroker) Heartbeat(client *Client) error {
+	return nil
+}
+
+// SubscribePresence subscribes the given Client to the presence events of the given users, and returns their current
+// presence.
+func (b *MemoryBroker) SubscribePresence(client *Client, userIDs []uuid.UUID) ([]PresenceMessagePayload, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	presences := make([]PresenceMessagePayload, 0, len(userIDs))
+	for _, userID := range userIDs {
+		b.presence.add(userID, client)
+		presence := PresenceMessagePayload{
+			UserID: userID,
+			Status: PresenceOnline,
+		}
+		if len(b.clients.sessions(userID)) == 0 {
+			presence.Status = PresenceOffline
+			if lastSeen, ok := b.lastSeen[userID]; ok {
+				presence.LastSeen = &lastSeen
+			}
+		}
+		presences = append(presences, presence)
+	}
+	return presences, nil
+}
+
+// UnsubscribePresence unsubscribes the given Client from the presence events of the given users.
+func (b *MemoryBroker) UnsubscribePresence(client *Client, userIDs []uuid.UUID) error {
+	for _, userID := range userIDs {
+		b.presence.remove(userID, client)
+	}
+	return nil
+}
+
+// Send transmits the given message into the outboundChan of every session of the recipient. If the recipient is
+// offline, the message is stored in their mailbox until they connect. If the recipient is a room, ErrRoomRecipient is
+// returned.
+func (b *MemoryBroker) Send(receiverID uuid.UUID, message *BrokerMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.rooms[receiverID]; ok {
+		return ErrRoomRecipient
+	}
+	b.send(receiverID, message)
+	return nil
+}
+
+// SendRoom transmits the given message to all the other members of its room.
+func (b *MemoryBroker) SendRoom(message *BrokerMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	members, ok := b.rooms[message.RoomID]
+	if !ok {
+		return ErrUnknownRoom
+	}
+	if _, ok := members[message.SenderID]; !ok {
+		return ErrNotRoomMember
+	}
+	for member := range members {
+		if member == message.SenderID {
+			continue
+		}
+		copied := *message
+		copied.RecipientID = member
+		b.send(member, &copied)
+	}
+	return nil
+}
+
+// send transmits the given message to the sessions of the recipient, or stores it in their mailbox. The caller must
+// hold b.mu.
+func (b *MemoryBroker) send(receiverID uuid.UUID, message *BrokerMessage) {
+	sessions := b.clients.sessions(receiverID)
+	if len(sessions) == 0 {
+		b.store(receiverID, message)
+		return
+	}
+	for _, client := range sessions {
+		client.deliver(message)
+	}
+}
+
+// store appends the given message to the recipient's mailbox, discarding the oldest messages if it is full.
+// The caller must hold b.mu.
+func (b *MemoryBroker) store(receiverID uuid.UUID, message *BrokerMessage) {
+	if b.MailboxSize <= 0 {
+		return
+	}
+	mailbox := append(b.mailboxes[receiverID.String()], memoryMailboxEntry{
+		message:   message,
+		expiresAt: time.Now().Add(b.MailboxTTL),
+	})
+	if len(mailbox) > b.MailboxSize {
+		for range mailbox[:len(mailbox)-b.MailboxSize] {
+			droppedMessages.inc(dropMailboxFull)
+		}
+		mailbox = mailbox[len(mailbox)-b.MailboxSize:]
+	}
+	b.mailboxes[receiverID.String()] = mailbox
+}
+
+// NextSequence returns the next sequence number of the given conversation.
+func (b *MemoryBroker) NextSequence(conversationID uuid.UUID) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sequences[conversationID]++
+	return b.sequences[conversationID], nil
+}
+
+// ClaimSentMessage claims the given message, and returns its acknowledgement if it was already sent.
+func (b *MemoryBroker) ClaimSentMessage(senderID uuid.UUID, messageID uuid.UUID, ttl time.Duration) (*AckMessagePayload, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := memorySentKey{senderID, messageID}
+	now := time.Now()
+	if entry, ok := b.sent[key]; ok && !entry.expiresAt.Before(now) {
+		if entry.ack == nil {
+			return nil, ErrSendPending
+		}
+		return entry.ack, nil
+	}
+	b.sent[key] = memorySentEntry{expiresAt: now.Add(ttl)}
+	return nil, nil
+}
+
+// RecordSentMessage records the acknowledgement of the given message, replacing its claim.
+func (b *MemoryBroker) RecordSentMessage(senderID uuid.UUID, messageID uuid.UUID, ack AckMessagePayload, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent[memorySentKey{senderID, messageID}] = memorySentEntry{ack: &ack, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+// ForgetSentMessage removes the claim or the acknowledgement of the given message.
+func (b *MemoryBroker) ForgetSentMessage(senderID uuid.UUID, messageID uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.sent, memorySentKey{senderID, messageID})
+	return nil
+}
+
+// session returns the unexpired session of the given token, or nil. The caller must hold b.sessionsMu.
+func (b *MemoryBroker) session(token string) *memorySession {
+	session, ok := b.sessions[token]
+	if !ok || session.expiresAt.Before(time.Now()) {
+		return nil
+	}
+	return session
+}
+
+// saveSession creates or refreshes the given session, and returns it. The caller must hold b.sessionsMu.
+func (b *MemoryBroker) saveSession(state SessionState, ttl time.Duration) (*memorySession, error) {
+	session := b.session(state.Token)
+	if session == nil {
+		session = new(memorySession)
+		b.sessions[state.Token] = session
+	} else if session.state.Owner != state.Owner {
+		return nil, ErrSessionResumed
+	}
+	session.state = state
+	session.expiresAt = time.Now().Add(ttl)
+	return session, nil
+}
+
+// SaveSession creates or refreshes the given session.
+func (b *MemoryBroker) SaveSession(state SessionState, ttl time.Duration) error {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+	_, err := b.saveSession(state, ttl)
+	return err
+}
+
+// BufferMessage appends the given message to the buffer of the given session.
+func (b *MemoryBroker) BufferMessage(state SessionState, message *BrokerMessage, size int, ttl time.Duration) (uint64, error) {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+	session, err := b.saveSession(state, ttl)
+	if err != nil {
+		return 0, err
+	}
+	session.sequence++
+	session.buffer = append(session.buffer, BufferedMessage{Sequence: session.sequence, Message: message})
+	if len(session.buffer) > size {
+		session.buffer = append([]BufferedMessage(nil), session.buffer[len(session.buffer)-size:]...)
+	}
+	return session.sequence, nil
+}
+
+// LoadSession returns the session of the given token.
+func (b *MemoryBroker) LoadSession(token string) (SessionState, error) {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+	session := b.session(token)
+	if session == nil {
+		return SessionState{}, ErrUnknownSession
+	}
+	return session.state, nil
+}
+
+// ResumeSession gives the session of the given token to the given owner, and returns its buffered messages.
+func (b *MemoryBroker) ResumeSession(token string, userID uuid.UUID, owner string, after uint64, ttl time.Duration) (SessionState, []BufferedMessage, error) {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+	session := b.session(token)
+	if session == nil || session.state.UserID != userID {
+		return SessionState{}, nil, ErrUnknownSession
+	}
+	session.state.Owner = owner
+	session.expiresAt = time.Now().Add(ttl)
+	var messages []BufferedMessage
+	for _, buffered := range session.buffer {
+		if buffered.Sequence > after {
+			messages = append(messages, buffered)
+		}
+	}
+	return session.state, messages, nil
+}
+
+// CloseSession deletes the given session and its buffer.
+func (b *MemoryBroker) CloseSession(state SessionState) error {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+	if session := b.session(state.Token); session == nil || session.state.Owner == state.Owner {
+		delete(b.sessions, state.Token)
+	}
+	return nil
+}
+
+// CreateRoom creates a new room, whose only member is the given user.
+func (b *MemoryBroker) CreateRoom(roomID uuid.UUID, ownerID uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rooms[roomID] = map[uuid.UUID]struct{}{ownerID: {}}
+	return nil
+}
+
+// JoinRoom adds the given user to the members of an existing room.
+func (b *MemoryBroker) JoinRoom(roomID uuid.UUID, userID uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	members, ok := b.rooms[roomID]
+	if !ok {
+		return ErrUnknownRoom
+	}
+	members[userID] = struct{}{}
+	return nil
+}
+
+// LeaveRoom removes the given user from the members of a room. The room is deleted when its last member leaves.
+func (b *MemoryBroker) LeaveRoom(roomID uuid.UUID, userID uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	members := b.rooms[roomID]
+	if _, ok := members[userID]; !ok {
+		return ErrNotRoomMember
+	}
+	delete(members, userID)
+	if len(members) == 0 {
+		delete(b.rooms, roomID)
+	}
+	return nil
+}
+
+// RoomMembers returns the IDs of the members of a room.
+func (b *MemoryBroker) RoomMembers(roomID uuid.UUID) ([]uuid.UUID, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	members := make([]uuid.UUID, 0, len(b.rooms[roomID]))
+	for member := range b.rooms[roomID] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// sweep removes the expired messages from all mailboxes, the expired acknowledgements of the sent messages and the
+// expired sessions.
+func (b *MemoryBroker) sweep() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for id, mailbox := range b.mailboxes {
+		for len(mailbox) > 0 && mailbox[0].expiresAt.Before(now) {
+			mailbox = mailbox[1:]
+		}
+		if len(mailbox) == 0 {
+			delete(b.mailboxes, id)
+		} else {
+			b.mailboxes[id] = mailbox
+		}
+	}
+	for key, entry := range b.sent {
+		if entry.expiresAt.Before(now) {
+			delete(b.sent, key)
+		}
+	}
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+	for token, session := range b.sessions {
+		if session.expiresAt.Before(now) {
+			delete(b.sessions, token)
+		}
+	}
+}
+
+// Poll periodically removes expired messages from the mailboxes until the given context is done. Messages are
+// delivered directly by Send, so there is nothing to read.
+func (b *MemoryBroker) Poll(ctx context.Context) error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.sweep()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
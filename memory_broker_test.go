@@ -0,0 +1,230 @@
+package texto
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBroker_Register(t *testing.T) {
+	log := newLogger()
+	broker := NewMemoryBroker(log)
+	assert.Equal(t, 0, broker.clients.len())
+	firstClient := NewClient(log, nil, broker)
+	broker.Register(firstClient)
+	assert.Equal(t, 1, broker.clients.len())
+	broker.Register(NewClient(log, nil, broker))
+	assert.Equal(t, 2, broker.clients.len())
+	broker.Register(firstClient)
+	assert.Equal(t, 2, broker.clients.len())
+}
+
+func TestMemoryBroker_Unregister(t *testing.T) {
+	log := newLogger()
+	broker := NewMemoryBroker(log)
+	firstClient := NewClient(log, nil, broker)
+	broker.Register(firstClient)
+	secondClient := NewClient(log, nil, broker)
+	broker.Register(secondClient)
+	assert.Equal(t, 2, broker.clients.len())
+	broker.Unregister(secondClient)
+	assert.Equal(t, 1, broker.clients.len())
+	broker.Unregister(firstClient)
+	assert.Equal(t, 0, broker.clients.len())
+}
+
+func TestMemoryBroker_Send(t *testing.T) {
+	log := newLogger()
+	broker := NewMemoryBroker(log)
+	recipient := NewClient(log, nil, broker)
+	broker.Register(recipient)
+	message := &BrokerMessage{
+		SenderID:    uuid.NewV4(),
+		RecipientID: recipient.ID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	}
+	assert.Nil(t, broker.Send(recipient.ID, message))
+	select {
+	case received := <-recipient.outboundChan:
+		assert.Equal(t, ReceiveMessageKind, received.Kind)
+		assert.Equal(t, recipient.ID, received.ClientID)
+		assert.Equal(t, message.SenderID, received.Data.(ReceiveMessagePayload).SenderID)
+		assert.Equal(t, message.Text, received.Data.(ReceiveMessagePayload).Text)
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+	assert.Nil(t, broker.Send(uuid.NewV4(), message))
+}
+
+func TestMemoryBroker_SendFansOut(t *testing.T) {
+	log := newLogger()
+	broker := NewMemoryBroker(log)
+	firstSession := NewClient(log, nil, broker)
+	secondSession := NewClient(log, nil, broker)
+	secondSession.ID = firstSession.ID
+	broker.Register(firstSession)
+	broker.Register(secondSession)
+	assert.Nil(t, broker.Send(firstSession.ID, &BrokerMessage{
+		SenderID:    uuid.NewV4(),
+		RecipientID: firstSession.ID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	}))
+	for _, session := range []*Client{firstSession, secondSession} {
+		select {
+		case received := <-session.outboundChan:
+			assert.Equal(t, ReceiveMessageKind, received.Kind)
+			assert.Equal(t, firstSession.ID, received.ClientID)
+		case <-time.After(time.Second):
+			t.Fatal("message was not delivered to every session")
+		}
+	}
+}
+
+func TestMemoryBroker_Mailbox(t *testing.T) {
+	log := newLogger()
+	broker := NewMemoryBroker(log)
+	broker.MailboxSize = 2
+	recipient := NewClient(log, nil, broker)
+	for _, text := range []string{"first", "second", "third"} {
+		assert.Nil(t, broker.Send(recipient.ID, &BrokerMessage{
+			SenderID:    uuid.NewV4(),
+			RecipientID: recipient.ID,
+			Text:        text,
+		}))
+	}
+	assert.Nil(t, broker.Register(recipient))
+	var texts []string
+	for i := 0; i < 2; i++ {
+		select {
+		case received := <-recipient.outboundChan:
+			texts = append(texts, received.Data.(ReceiveMessagePayload).Text)
+		case <-time.After(time.Second):
+			t.Fatal("stored message was not delivered")
+		}
+	}
+	sort.Strings(texts)
+	assert.Equal(t, []string{"second", "third"}, texts)
+	assert.Empty(t, broker.mailboxes)
+}
+
+func TestMemoryBroker_MailboxExpiry(t *testing.T) {
+	log := newLogger()
+	broker := NewMemoryBroker(log)
+	broker.MailboxTTL = -time.Second
+	recipientID := uuid.NewV4()
+	assert.Nil(t, broker.Send(recipientID, &BrokerMessage{
+		SenderID:    uuid.NewV4(),
+		RecipientID: recipientID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	}))
+	assert.Len(t, broker.mailboxes, 1)
+	broker.sweep()
+	assert.Empty(t, broker.mailboxes)
+}
+
+func TestMemoryBroker_Poll(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- broker.Poll(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Poll didn't return after the context was cancelled")
+	}
+}
+
+func TestMemoryBroker_Rooms(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	var _ RoomBroker = broker
+	roomID := uuid.NewV4()
+	owner := uuid.NewV4()
+	member := uuid.NewV4()
+	assert.Equal(t, ErrUnknownRoom, broker.JoinRoom(roomID, member))
+	assert.Nil(t, broker.CreateRoom(roomID, owner))
+	assert.Nil(t, broker.JoinRoom(roomID, member))
+	members, err := broker.RoomMembers(roomID)
+	assert.Nil(t, err)
+	assert.Len(t, members, 2)
+	assert.Nil(t, broker.LeaveRoom(roomID, owner))
+	assert.Equal(t, ErrNotRoomMember, broker.LeaveRoom(roomID, owner))
+	assert.Nil(t, broker.LeaveRoom(roomID, member))
+	members, err = broker.RoomMembers(roomID)
+	assert.Nil(t, err)
+	assert.Empty(t, members)
+	assert.Equal(t, ErrUnknownRoom, broker.JoinRoom(roomID, member))
+}
+
+func TestMemoryBroker_SendRoom(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	roomID := uuid.NewV4()
+	owner := NewClient(newLogger(), nil, broker)
+	member := NewClient(newLogger(), nil, broker)
+	assert.Nil(t, broker.Register(owner))
+	assert.Nil(t, broker.Register(member))
+	message := &BrokerMessage{SenderID: owner.ID, RecipientID: roomID, RoomID: roomID, Text: "Hello"}
+	assert.Equal(t, ErrUnknownRoom, broker.SendRoom(message))
+	assert.Nil(t, broker.CreateRoom(roomID, owner.ID))
+	assert.Nil(t, broker.JoinRoom(roomID, member.ID))
+	assert.Equal(t, ErrRoomRecipient, broker.Send(roomID, message))
+
+	assert.Nil(t, broker.SendRoom(message))
+	assert.Empty(t, owner.outboundChan)
+	if assert.Len(t, member.outboundChan, 1) {
+		received := (<-member.outboundChan).Data.(ReceiveMessagePayload)
+		assert.Equal(t, roomID, *received.RoomID)
+	}
+	message.SenderID = uuid.NewV4()
+	assert.Equal(t, ErrNotRoomMember, broker.SendRoom(message))
+}
+
+func TestMemoryBroker_Presence(t *testing.T) {
+	log := newLogger()
+	broker := NewMemoryBroker(log)
+	var _ PresenceBroker = broker
+	watcher := NewClient(log, nil, broker)
+	broker.Register(watcher)
+	user := NewClient(log, nil, broker)
+
+	presences, err := broker.SubscribePresence(watcher, []uuid.UUID{user.ID})
+	assert.Nil(t, err)
+	if assert.Len(t, presences, 1) {
+		assert.Equal(t, PresenceOffline, presences[0].Status)
+		assert.Nil(t, presences[0].LastSeen)
+	}
+
+	broker.Register(user)
+	select {
+	case event := <-watcher.outboundChan:
+		assert.Equal(t, PresenceKind, event.Kind)
+		assert.Equal(t, user.ID, event.Data.(PresenceMessagePayload).UserID)
+		assert.Equal(t, PresenceOnline, event.Data.(PresenceMessagePayload).Status)
+	case <-time.After(time.Second):
+		t.Fatal("online event was not delivered")
+	}
+
+	broker.Unregister(user)
+	select {
+	case event := <-watcher.outboundChan:
+		assert.Equal(t, PresenceOffline, event.Data.(PresenceMessagePayload).Status)
+		assert.NotNil(t, event.Data.(PresenceMessagePayload).LastSeen)
+	case <-time.After(time.Second):
+		t.Fatal("offline event was not delivered")
+	}
+
+	presences, err = broker.SubscribePresence(watcher, []uuid.UUID{user.ID})
+	assert.Nil(t, err)
+	if assert.Len(t, presences, 1) {
+		assert.NotNil(t, presences[0].LastSeen)
+	}
+	broker.Unregister(watcher)
+	assert.Empty(t, broker.presence.subscribers(user.ID))
+}
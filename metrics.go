@@ -0,0 +1,267 @@
+package texto
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics exposed by the server, in the Prometheus text exposition format.
+var (
+	connectedClients = newGauge(
+		"texto_connected_clients",
+		"Number of WebSocket sessions connected to this node.",
+	)
+	messagesReceived = newCounterVec(
+		"texto_messages_received_total",
+		"Number of messages received from the clients, by kind.",
+		"kind",
+	)
+	messagesSent = newCounterVec(
+		"texto_messages_sent_total",
+		"Number of messages sent to the clients, by kind.",
+		"kind",
+	)
+	errorsReturned = newCounterVec(
+		"texto_errors_total",
+		"Number of error messages returned to the clients, by code.",
+		"code",
+	)
+	droppedMessages = newCounterVec(
+		"texto_dropped_messages_total",
+		"Number of messages dropped by this node, by reason.",
+		"reason",
+	)
+	queuedMessages = newGauge(
+		"texto_send_queue_messages",
+		"Number of messages waiting in the send queues of the sessions connected to this node.",
+	)
+	sendQueueDepth = newHistogram(
+		"texto_send_queue_depth",
+		"Depth of the send queue of a session, observed whenever a message is added to it.",
+		[]float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512},
+	)
+	rejectedUpgrades = newCounterVec(
+		"texto_rejected_upgrades_total",
+		"Number of WebSocket upgrades rejected by this node, by reason.",
+		"reason",
+	)
+	pollBacklog = newGauge(
+		"texto_poll_backlog",
+		"Number of messages received from Redis waiting to be dispatched by Poll.",
+	)
+	redisPublishDuration = newHistogram(
+		"texto_redis_publish_duration_seconds",
+		"Latency of the publication of a message to Redis.",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	)
+)
+
+// allMetrics lists the metrics written by the MetricsHandler, in order.
+var allMetrics = []metric{
+	connectedClients,
+	messagesReceived,
+	messagesSent,
+	errorsReturned,
+	droppedMessages,
+	queuedMessages,
+	sendQueueDepth,
+	rejectedUpgrades,
+	pollBacklog,
+	redisPublishDuration,
+}
+
+// The reasons for which messages are dropped, used as the label of droppedMessages.
+const (
+	// dropUnknownRecipient is used when a message is received from the Broker for a user not connected to this node.
+	dropUnknownRecipient = "unknown_recipient"
+	// dropMailboxFull is used when a message is discarded from a full mailbox.
+	dropMailboxFull = "mailbox_full"
+	// dropSendQueueFull is used when a message is discarded from, or not added to, the full send queue of a session.
+	dropSendQueueFull = "send_queue_full"
+	// dropDuplicateSend is used when a user sends again a message that was already sent, which is acknowledged again
+	// but not transmitted.
+	dropDuplicateSend = "duplicate_send"
+)
+
+// The reasons for which WebSocket upgrades are rejected, used as the label of rejectedUpgrades.
+const (
+	// rejectOrigin is used when the connection is opened from an origin which isn't allowed.
+	rejectOrigin = "origin"
+	// rejectUnauthorized is used when the user couldn't be authenticated.
+	rejectUnauthorized = "unauthorized"
+)
+
+// A metric is written in the Prometheus text exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// A gauge is a metric whose value can go up and down.
+type gauge struct {
+	name  string
+	help  string
+	mu    sync.Mutex
+	value float64
+}
+
+// newGauge returns a new gauge with the given name and description.
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+// add adds the given delta to the value of the gauge.
+func (g *gauge) add(delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value += delta
+}
+
+// set sets the value of the gauge.
+func (g *gauge) set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = value
+}
+
+// get returns the current value of the gauge.
+func (g *gauge) get() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+func (g *gauge) write(w io.Writer) {
+	writeMetricHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatMetricValue(g.get()))
+}
+
+// A counterVec is a set of counters partitioned by the value of a label.
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newCounterVec returns a new counterVec with the given name, description and label name.
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+// inc increments the counter of the given label value.
+func (c *counterVec) inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value]++
+}
+
+// get returns the value of the counter of the given label value.
+func (c *counterVec) get(value string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[value]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeMetricHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labels := make([]string, 0, len(c.values))
+	for label := range c.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", c.name, c.label, escapeLabelValue(label), formatMetricValue(c.values[label]))
+	}
+}
+
+// A histogram counts observations in configurable buckets.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// newHistogram returns a new histogram with the given name, description and sorted bucket upper bounds.
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// observe records the given value.
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+}
+
+// observeSince records the time elapsed since the given time, in seconds.
+func (h *histogram) observeSince(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer) {
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatMetricValue(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatMetricValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric.
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatMetricValue formats a sample value.
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapeLabelValue escapes the backslashes, double quotes and line feeds of a label value.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// MetricsHandler is the HTTP Handler exposing the metrics of the server in the Prometheus text exposition format.
+type MetricsHandler struct{}
+
+// ServeHTTP is the http.Handler implementation for MetricsHandler.
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buffered := bufio.NewWriter(w)
+	for _, m := range allMetrics {
+		m.write(buffered)
+	}
+	buffered.Flush()
+}
@@ -0,0 +1,80 @@
+package texto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "code")
+	counter.inc("B")
+	counter.inc("A")
+	counter.inc("A")
+	counter.inc("say \"hi\"\n")
+	var buffer bytes.Buffer
+	counter.write(&buffer)
+	assert.Equal(t, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{code="A"} 2
+test_total{code="B"} 1
+test_total{code="say \"hi\"\n"} 1
+`, buffer.String())
+}
+
+func TestGauge(t *testing.T) {
+	g := newGauge("test_gauge", "Test gauge.")
+	g.add(2)
+	g.add(-1)
+	var buffer bytes.Buffer
+	g.write(&buffer)
+	assert.Equal(t, "# HELP test_gauge Test gauge.\n# TYPE test_gauge gauge\ntest_gauge 1\n", buffer.String())
+	g.set(0.5)
+	assert.Equal(t, 0.5, g.get())
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "Test histogram.", []float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.1)
+	h.observe(0.5)
+	h.observe(2)
+	var buffer bytes.Buffer
+	h.write(&buffer)
+	assert.Equal(t, `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 2.65
+test_seconds_count 4
+`, buffer.String())
+}
+
+func TestMetricsHandler_ServeHTTP(t *testing.T) {
+	client := NewClient(newLogger(), nil, NewMemoryBroker(newLogger()))
+	before := errorsReturned.get("ECID")
+	client.HandleMessage(NewSendMessage(nil, client.SessionID, SendMessagePayload{}))
+	assert.Equal(t, before+1, errorsReturned.get("ECID"))
+	client.HandleMessage(&ChatMessage{ID: client.ID, ClientID: client.ID, Kind: "unsupported"})
+	assert.Equal(t, float64(0), messagesReceived.get("unsupported"))
+
+	recorder := httptest.NewRecorder()
+	(&MetricsHandler{}).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	for _, name := range []string{
+		"texto_connected_clients",
+		"texto_messages_received_total{kind=\"unknown\"}",
+		"texto_messages_received_total{kind=\"send\"}",
+		"texto_errors_total{code=\"ECID\"}",
+		"texto_poll_backlog",
+		"texto_redis_publish_duration_seconds_count",
+	} {
+		assert.Contains(t, string(body), name)
+	}
+}
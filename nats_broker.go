@@ -0,0 +1,674 @@
+package texto
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/go-nats"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDeliveryTimeout is the default value of NatsBroker.DeliveryTimeout.
+	DefaultDeliveryTimeout = 250 * time.Millisecond
+	// natsDialTimeout bounds the time spent connecting to the NATS server, and waiting for it to answer to a PING.
+	natsDialTimeout = 5 * time.Second
+	// natsReconnectWait is the delay between two attempts to reconnect to a NATS server.
+	natsReconnectWait = time.Second
+	// natsLateAckTimeout is the time during which a message stored in the mailboxes is still retracted if a node
+	// acknowledges it.
+	natsLateAckTimeout = 5 * time.Second
+	// NatsSubjectPrefix is the prefix of all the subjects used by the NatsBroker.
+	NatsSubjectPrefix = "texto."
+	// natsMailboxSubjects matches the subjects on which the mailboxes are updated. Each node handles them on a single
+	// subscription, so that it applies the updates in the order they were published.
+	natsMailboxSubjects = NatsSubjectPrefix + "mailbox.>"
+	// natsStoreSubject is the subject on which the messages for offline users are published. Every node stores them.
+	natsStoreSubject = NatsSubjectPrefix + "mailbox.store"
+	// natsRetractSubject is the subject on which the messages delivered after being stored are published, so that the
+	// nodes remove them from the mailboxes.
+	natsRetractSubject = NatsSubjectPrefix + "mailbox.retract"
+	// natsFetchSubject is the subject on which the nodes are asked for the messages stored for a user. They keep them
+	// until the node of the user retracts them.
+	natsFetchSubject = NatsSubjectPrefix + "mailbox.fetch"
+	// natsSyncSubject is the subject on which a node asks its peers for their mailboxes, when it starts or reconnects.
+	natsSyncSubject = NatsSubjectPrefix + "mailbox.sync"
+)
+
+// A NatsBroker is a Broker relying on NATS. Each node subscribes to the subject of the users connected to it, on which
+// the messages intended for them are published. The nodes acknowledge the messages they deliver: a message that isn't
+// acknowledged within DeliveryTimeout is stored by every node, which are asked for the messages of a user when they
+// connect. The messages are removed from the mailboxes once the node of their recipient retracts them, after delivering
+// them. A node that starts or reconnects copies the mailboxes of its peers, so that the messages are kept as long as one
+// node is running.
+type NatsBroker struct {
+	Log *logrus.Logger
+	// DeliveryTimeout is the time to wait for a node to acknowledge a message before considering its recipient offline.
+	DeliveryTimeout time.Duration
+
+	conn       *nats.Conn
+	nodeID     uuid.UUID
+	mailboxTTL time.Duration
+	// mu protects subscriptions, and serializes the subscriptions with the changes of the client registry.
+	mu            sync.Mutex
+	subscriptions map[uuid.UUID]*nats.Subscription
+	clients       clientRegistry
+	// mailboxes is the copy of the mailboxes kept by the node.
+	mailboxes  *natsMailboxes
+	deliveries natsDeliveries
+	// requests maps the reply subjects of the pending requests to the channels on which their replies are sent.
+	requestsMu  sync.Mutex
+	requests    map[string]chan *nats.Msg
+	nextRequest uint64
+}
+
+// A natsMailboxEntry is a message published on the subject of its recipient, or on the store subject if they are
+// offline.
+type natsMailboxEntry struct {
+	// ID identifies the publication of the message, so that the nodes can retract it and the copies of the mailboxes
+	// can be merged.
+	ID          uuid.UUID
+	RecipientID uuid.UUID
+	Message     *BrokerMessage
+	ExpiresAt   time.Time
+	// storedAt is the time at which the node stored the message.
+	storedAt time.Time
+}
+
+// A natsRetraction is published on the retract subject when a message stored in the mailboxes is acknowledged.
+type natsRetraction struct {
+	ID          uuid.UUID
+	RecipientID uuid.UUID
+}
+
+// NewNatsBroker creates a new NatsBroker instance connected to the NATS servers at the given address, which is a comma
+// separated list of "host:port" addresses or nats:// URLs. The messages for offline users are kept for mailboxTTL, and
+// at most mailboxSize of them are kept for each user.
+func NewNatsBroker(log *logrus.Logger, addr string, mailboxTTL time.Duration, mailboxSize int) (*NatsBroker, error) {
+	b := &NatsBroker{
+		Log:             log,
+		DeliveryTimeout: DefaultDeliveryTimeout,
+		nodeID:          uuid.NewV4(),
+		mailboxTTL:      mailboxTTL,
+		subscriptions:   make(map[uuid.UUID]*nats.Subscription),
+		mailboxes:       newNatsMailboxes(mailboxSize),
+		requests:        make(map[string]chan *nats.Msg),
+	}
+	options := nats.GetDefaultOptions()
+	options.Servers = natsServers(addr)
+	options.Name = "texto " + b.nodeID.String()
+	options.Timeout = natsDialTimeout
+	options.MaxReconnect = -1
+	options.ReconnectWait = natsReconnectWait
+	options.DisconnectedCB = func(*nats.Conn) {
+		log.Warn("Lost the connection to NATS, reconnecting")
+	}
+	options.ReconnectedCB = func(conn *nats.Conn) {
+		log.WithField("url", conn.ConnectedUrl()).Info("Reconnected to NATS")
+		b.synchronize()
+	}
+	options.AsyncErrorCB = func(_ *nats.Conn, subscription *nats.Subscription, err error) {
+		log.WithError(err).WithField("subject", subscription.Subject).Error("NATS subscription failed")
+	}
+	conn, err := options.Connect()
+	if err != nil {
+		return nil, err
+	}
+	b.conn = conn
+	_, err = conn.Subscribe(b.inboxPrefix()+"*", b.handleReply)
+	if err == nil {
+		_, err = conn.Subscribe(natsMailboxSubjects, b.handleMailbox)
+	}
+	if err == nil {
+		err = conn.FlushTimeout(natsDialTimeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.synchronize()
+	return b, nil
+}
+
+// natsServers returns the URLs of the NATS servers listed in the given address.
+func natsServers(addr string) []string {
+	var servers []string
+	for _, server := range strings.Split(addr, ",") {
+		server = strings.TrimSpace(server)
+		if !strings.Contains(server, "://") {
+			server = "nats://" + server
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// userSubject returns the subject on which the messages intended for the given user are published.
+func userSubject(id uuid.UUID) string {
+	return NatsSubjectPrefix + "user." + id.String()
+}
+
+// inboxPrefix returns the prefix of the reply subjects of the requests of the node.
+func (b *NatsBroker) inboxPrefix() string {
+	return "_INBOX." + b.nodeID.String() + "."
+}
+
+// Register registers a Client in the internal Client registry of the Broker, subscribes to the subject of its user if
+// it is their first session on this node, and asks the nodes for the messages that were sent while the user was
+// offline. The messages stored once the Client is registered are delivered by storeEntry, and the ones that the nodes
+// don't return in time are kept until the next session of the user.
+func (b *NatsBroker) Register(client *Client) error {
+	b.mu.Lock()
+	var err error
+	if b.clients.add(client) {
+		b.subscriptions[client.ID], err = b.conn.Subscribe(userSubject(client.ID), b.handleMessage)
+	}
+	var entries []natsMailboxEntry
+	if err == nil {
+		entries = b.mailboxes.take(client.ID)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	b.deliverStored(client, entries)
+	if err := b.conn.FlushTimeout(natsDialTimeout); err != nil {
+		return err
+	}
+	replies, reply := b.newRequest(64)
+	if err := b.conn.PublishRequest(natsFetchSubject, reply, []byte(client.ID.String())); err != nil {
+		b.cancelRequest(reply)
+		return err
+	}
+	go func() {
+		defer b.cancelRequest(reply)
+		timeout := time.After(b.DeliveryTimeout)
+		for {
+			select {
+			case msg := <-replies:
+				var entries []natsMailboxEntry
+				if err := json.Unmarshal(msg.Data, &entries); err != nil {
+					b.Log.Error(err)
+					continue
+				}
+				b.deliverStored(client, entries)
+			case <-timeout:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// deliverStored delivers the given stored entries to the given Client, unless the node already delivered them, and
+// retracts them from the mailboxes of all the nodes.
+func (b *NatsBroker) deliverStored(client *Client, entries []natsMailboxEntry) {
+	for _, entry := range entries {
+		if b.deliveries.first(entry.ID) {
+			client.deliver(entry.Message)
+		}
+		b.retract(entry)
+	}
+}
+
+// Unregister removes a Client from the internal Client registry of the Broker, and unsubscribes from the subject of its
+// user if it was their last session on this node.
+func (b *NatsBroker) Unregister(client *Client) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.clients.remove(client) {
+		return nil
+	}
+	subscription, ok := b.subscriptions[client.ID]
+	if !ok {
+		return nil
+	}
+	delete(b.subscriptions, client.ID)
+	return subscription.Unsubscribe()
+}
+
+// Send publishes the given message on the subject of its recipient. If no node acknowledges it within DeliveryTimeout,
+// it is published on the store subject, to be kept until the recipient connects. If a node acknowledges it later, it is
+// retracted from the mailboxes.
+func (b *NatsBroker) Send(receiverID uuid.UUID, message *BrokerMessage) error {
+	entry := natsMailboxEntry{
+		ID:          uuid.NewV4(),
+		RecipientID: receiverID,
+		Message:     message,
+		ExpiresAt:   time.Now().Add(b.mailboxTTL),
+	}
+	marshaled, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	acks, reply := b.newRequest(1)
+	if err := b.conn.PublishRequest(userSubject(receiverID), reply, marshaled); err != nil {
+		b.cancelRequest(reply)
+		return err
+	}
+	go b.awaitDelivery(acks, reply, entry)
+	return nil
+}
+
+// awaitDelivery stores the given message in the mailboxes if it isn't acknowledged within DeliveryTimeout, and retracts
+// it if it is acknowledged within natsLateAckTimeout afterwards.
+func (b *NatsBroker) awaitDelivery(acks chan *nats.Msg, reply string, entry natsMailboxEntry) {
+	defer b.cancelRequest(reply)
+	select {
+	case <-acks:
+		return
+	case <-time.After(b.DeliveryTimeout):
+	}
+	if err := b.publish(natsStoreSubject, entry); err != nil {
+		b.Log.Error(err)
+		return
+	}
+	select {
+	case <-acks:
+		b.retract(entry)
+	case <-time.After(natsLateAckTimeout):
+	}
+}
+
+// retract publishes the retraction of the given entry, so that the nodes remove it from their mailboxes.
+func (b *NatsBroker) retract(entry natsMailboxEntry) {
+	if err := b.publish(natsRetractSubject, natsRetraction{ID: entry.ID, RecipientID: entry.RecipientID}); err != nil {
+		b.Log.Error(err)
+	}
+}
+
+// publish publishes the JSON representation of the given value on the given subject.
+func (b *NatsBroker) publish(subject string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.conn.Publish(subject, data)
+}
+
+// newRequest returns a channel receiving the replies of a new request, and the reply subject of the request.
+func (b *NatsBroker) newRequest(size int) (chan *nats.Msg, string) {
+	replies := make(chan *nats.Msg, size)
+	reply := b.inboxPrefix() + strconv.FormatUint(atomic.AddUint64(&b.nextRequest, 1), 10)
+	b.requestsMu.Lock()
+	b.requests[reply] = replies
+	b.requestsMu.Unlock()
+	return replies, reply
+}
+
+// cancelRequest stops receiving the replies of the request of the given reply subject.
+func (b *NatsBroker) cancelRequest(reply string) {
+	b.requestsMu.Lock()
+	defer b.requestsMu.Unlock()
+	delete(b.requests, reply)
+}
+
+// handleReply transmits a reply to the channel of its request. Replies that can't be handled in time are discarded.
+func (b *NatsBroker) handleReply(msg *nats.Msg) {
+	b.requestsMu.Lock()
+	replies, ok := b.requests[msg.Subject]
+	b.requestsMu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case replies <- msg:
+	default:
+	}
+}
+
+// handleMessage transmits a message published on the subject of a user to their sessions, unless the node already
+// delivered it, and acknowledges it.
+func (b *NatsBroker) handleMessage(msg *nats.Msg) {
+	var entry natsMailboxEntry
+	if err := json.Unmarshal(msg.Data, &entry); err != nil {
+		b.Log.Error(err)
+		return
+	}
+	sessions := b.clients.sessions(entry.RecipientID)
+	if len(sessions) == 0 {
+		droppedMessages.inc(dropUnknownRecipient)
+		return
+	}
+	if b.deliveries.first(entry.ID) {
+		for _, client := range sessions {
+			client.deliver(entry.Message)
+		}
+	}
+	if len(msg.Reply) != 0 {
+		if err := b.conn.Publish(msg.Reply, nil); err != nil {
+			b.Log.Error(err)
+		}
+	}
+}
+
+// handleMailbox applies an update of the mailboxes, or answers to a request for their content. The requests of the node
+// itself are ignored.
+func (b *NatsBroker) handleMailbox(msg *nats.Msg) {
+	switch msg.Subject {
+	case natsStoreSubject:
+		var entry natsMailboxEntry
+		if err := json.Unmarshal(msg.Data, &entry); err != nil {
+			b.Log.Error(err)
+			return
+		}
+		b.storeEntry(entry)
+	case natsRetractSubject:
+		var retraction natsRetraction
+		if err := json.Unmarshal(msg.Data, &retraction); err != nil {
+			b.Log.Error(err)
+			return
+		}
+		b.mailboxes.retract(retraction.RecipientID, retraction.ID)
+	case natsFetchSubject:
+		if len(msg.Reply) == 0 || strings.HasPrefix(msg.Reply, b.inboxPrefix()) {
+			return
+		}
+		userID, err := uuid.FromString(string(msg.Data))
+		if err != nil {
+			b.Log.Error(err)
+			return
+		}
+		if entries := b.mailboxes.get(userID); len(entries) != 0 {
+			b.reply(msg.Reply, entries)
+		}
+	case natsSyncSubject:
+		if len(msg.Reply) == 0 || strings.HasPrefix(msg.Reply, b.inboxPrefix()) {
+			return
+		}
+		b.reply(msg.Reply, b.mailboxes.all())
+	}
+}
+
+// storeEntry stores an entry published on the store subject. If its recipient registered on this node while it was
+// sent, before their subscription was active, it is delivered to their sessions and retracted instead.
+func (b *NatsBroker) storeEntry(entry natsMailboxEntry) {
+	b.mu.Lock()
+	sessions := b.clients.sessions(entry.RecipientID)
+	if len(sessions) == 0 {
+		b.mailboxes.store(entry)
+	}
+	b.mu.Unlock()
+	if len(sessions) == 0 {
+		return
+	}
+	if b.deliveries.first(entry.ID) {
+		for _, client := range sessions {
+			client.deliver(entry.Message)
+		}
+	}
+	b.retract(entry)
+}
+
+// reply publishes the given entries on the reply subject of a request, as JSON arrays split to fit in the maximum
+// payload of the NATS server. At least one array is published, even if there are no entries. The entries that can't fit
+// alone are discarded.
+func (b *NatsBroker) reply(subject string, entries []natsMailboxEntry) {
+	maxPayload := int(b.conn.MaxPayload())
+	chunk := []byte{'['}
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			b.Log.Error(err)
+			continue
+		}
+		if len(data)+2 > maxPayload {
+			b.Log.WithField("message_id", entry.Message.MessageID).Warn("Discarding a message too large to be copied")
+			continue
+		}
+		if len(chunk) > 1 && len(chunk)+len(data)+2 > maxPayload {
+			if err := b.conn.Publish(subject, append(chunk, ']')); err != nil {
+				b.Log.Error(err)
+			}
+			chunk = []byte{'['}
+		}
+		if len(chunk) > 1 {
+			chunk = append(chunk, ',')
+		}
+		chunk = append(chunk, data...)
+	}
+	if err := b.conn.Publish(subject, append(chunk, ']')); err != nil {
+		b.Log.Error(err)
+	}
+}
+
+// synchronize asks the peers of the node for their mailboxes, and replaces the ones of the node with their content.
+// The messages stored by the node in the meantime are kept, and the mailboxes are left untouched if no peer answers
+// within DeliveryTimeout.
+func (b *NatsBroker) synchronize() {
+	startedAt := time.Now()
+	replies, reply := b.newRequest(64)
+	defer b.cancelRequest(reply)
+	if err := b.conn.PublishRequest(natsSyncSubject, reply, nil); err != nil {
+		b.Log.Error(err)
+		return
+	}
+	var entries []natsMailboxEntry
+	answered := false
+	timeout := time.After(b.DeliveryTimeout)
+	for {
+		select {
+		case msg := <-replies:
+			var chunk []natsMailboxEntry
+			if err := json.Unmarshal(msg.Data, &chunk); err != nil {
+				b.Log.Error(err)
+				continue
+			}
+			entries = append(entries, chunk...)
+			answered = true
+		case <-timeout:
+			if answered {
+				b.mailboxes.replace(entries, startedAt)
+			}
+			return
+		}
+	}
+}
+
+// Poll removes the expired messages from the mailboxes of the node until the given context is done. The messages are
+// delivered by the subscriptions of the node, and the connection to the NATS servers is restored by the client.
+func (b *NatsBroker) Poll(ctx context.Context) error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.mailboxes.sweep()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// CheckHealth is the implementation of HealthChecker.CheckHealth for NatsBroker. It fails if the node is disconnected
+// from NATS, or if the NATS server doesn't answer to a PING.
+func (b *NatsBroker) CheckHealth() error {
+	if !b.conn.IsConnected() {
+		return ErrSubscriptionClosed
+	}
+	return b.conn.FlushTimeout(natsDialTimeout)
+}
+
+// Close closes the connection to the NATS server.
+func (b *NatsBroker) Close() {
+	b.conn.Close()
+}
+
+// natsMailboxes is the copy of the mailboxes kept by a node of a NatsBroker.
+type natsMailboxes struct {
+	size    int
+	mu      sync.Mutex
+	entries map[uuid.UUID][]natsMailboxEntry
+}
+
+// newNatsMailboxes creates empty mailboxes keeping at most size messages for each user.
+func newNatsMailboxes(size int) *natsMailboxes {
+	return &natsMailboxes{size: size, entries: make(map[uuid.UUID][]natsMailboxEntry)}
+}
+
+// store appends the given entry to the mailbox of its recipient, discarding the oldest messages if it is full. Expired
+// entries and the entries already stored are ignored.
+func (m *natsMailboxes) store(entry natsMailboxEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(entry, time.Now())
+}
+
+// add is the implementation of store. The caller must hold m.mu.
+func (m *natsMailboxes) add(entry natsMailboxEntry, now time.Time) {
+	if m.size <= 0 || entry.Message == nil || entry.ExpiresAt.Before(now) {
+		return
+	}
+	mailbox := m.entries[entry.RecipientID]
+	for _, stored := range mailbox {
+		if stored.ID == entry.ID {
+			return
+		}
+	}
+	if entry.storedAt.IsZero() {
+		entry.storedAt = now
+	}
+	mailbox = append(mailbox, entry)
+	if len(mailbox) > m.size {
+		for range mailbox[:len(mailbox)-m.size] {
+			droppedMessages.inc(dropMailboxFull)
+		}
+		mailbox = mailbox[len(mailbox)-m.size:]
+	}
+	m.entries[entry.RecipientID] = mailbox
+}
+
+// retract removes the entry of the given ID from the mailbox of the given user.
+func (m *natsMailboxes) retract(userID uuid.UUID, id uuid.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mailbox := m.entries[userID]
+	for i, entry := range mailbox {
+		if entry.ID == id {
+			mailbox = append(mailbox[:i:i], mailbox[i+1:]...)
+			break
+		}
+	}
+	if len(mailbox) == 0 {
+		delete(m.entries, userID)
+	} else {
+		m.entries[userID] = mailbox
+	}
+}
+
+// take removes the mailbox of the given user, and returns the entries it contains that didn't expire.
+func (m *natsMailboxes) take(userID uuid.UUID) []natsMailboxEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := m.getLocked(userID)
+	delete(m.entries, userID)
+	return entries
+}
+
+// get returns the entries of the mailbox of the given user that didn't expire.
+func (m *natsMailboxes) get(userID uuid.UUID) []natsMailboxEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.getLocked(userID)
+}
+
+// getLocked is the implementation of get. The caller must hold m.mu.
+func (m *natsMailboxes) getLocked(userID uuid.UUID) []natsMailboxEntry {
+	now := time.Now()
+	var entries []natsMailboxEntry
+	for _, entry := range m.entries[userID] {
+		if !entry.ExpiresAt.Before(now) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// all returns the entries of all the mailboxes that didn't expire.
+func (m *natsMailboxes) all() []natsMailboxEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var entries []natsMailboxEntry
+	for _, mailbox := range m.entries {
+		for _, entry := range mailbox {
+			if !entry.ExpiresAt.Before(now) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// replace replaces the content of the mailboxes with the given entries, keeping the entries stored since the given
+// time.
+func (m *natsMailboxes) replace(entries []natsMailboxEntry, since time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous := m.entries
+	m.entries = make(map[uuid.UUID][]natsMailboxEntry)
+	now := time.Now()
+	for _, entry := range entries {
+		m.add(entry, now)
+	}
+	for _, mailbox := range previous {
+		for _, entry := range mailbox {
+			if !entry.storedAt.Before(since) {
+				m.add(entry, now)
+			}
+		}
+	}
+}
+
+// sweep removes the expired messages from all the mailboxes.
+func (m *natsMailboxes) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, mailbox := range m.entries {
+		kept := mailbox[:0]
+		for _, entry := range mailbox {
+			if !entry.ExpiresAt.Before(now) {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.entries, id)
+		} else {
+			m.entries[id] = kept
+		}
+	}
+}
+
+// natsDeliveries remembers the entries recently delivered by a node, so that a message published on the subject of its
+// recipient, stored or returned by several nodes is delivered once. The entries are forgotten after one to two
+// natsLateAckTimeout. The zero value is ready to use.
+type natsDeliveries struct {
+	mu        sync.Mutex
+	current   map[uuid.UUID]struct{}
+	previous  map[uuid.UUID]struct{}
+	rotatedAt time.Time
+}
+
+// first records the delivery of the entry of the given ID, and reports whether it wasn't delivered yet.
+func (d *natsDeliveries) first(id uuid.UUID) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now := time.Now(); now.Sub(d.rotatedAt) >= natsLateAckTimeout {
+		d.previous, d.current, d.rotatedAt = d.current, make(map[uuid.UUID]struct{}), now
+	}
+	if _, ok := d.current[id]; ok {
+		return false
+	}
+	if _, ok := d.previous[id]; ok {
+		return false
+	}
+	d.current[id] = struct{}{}
+	return true
+}
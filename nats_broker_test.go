@@ -0,0 +1,256 @@
+package texto
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/go-nats"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// runNatsServer starts an in-process NATS server on the given port, or on a random one if it is server.RANDOM_PORT.
+// The server is shut down at the end of the test.
+func runNatsServer(t *testing.T, port int) *server.Server {
+	options := test.DefaultTestOptions
+	options.Port = port
+	srv := test.RunServer(&options)
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+// natsURL returns the URL of the given NATS server.
+func natsURL(srv *server.Server) string {
+	return "nats://" + srv.Addr().String()
+}
+
+// newTestNatsBroker returns a NatsBroker connected to the given server and polling until the end of the test.
+func newTestNatsBroker(t *testing.T, srv *server.Server) *NatsBroker {
+	broker, err := NewNatsBroker(newLogger(), natsURL(srv), DefaultMailboxTTL, DefaultMailboxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(broker.Close)
+	broker.DeliveryTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go broker.Poll(ctx)
+	return broker
+}
+
+// expectReceive waits for the given Client to receive a message with the given text.
+func expectReceive(t *testing.T, client *Client, text string) {
+	select {
+	case received := <-client.outboundChan:
+		if assert.Equal(t, ReceiveMessageKind, received.Kind) {
+			assert.Equal(t, text, received.Data.(ReceiveMessagePayload).Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message %q was not delivered", text)
+	}
+}
+
+// expectMailbox registers a new Client of the given user, and checks that it receives exactly the given texts.
+func expectMailbox(t *testing.T, broker *NatsBroker, userID uuid.UUID, texts ...string) {
+	client := NewClient(newLogger(), nil, broker)
+	client.ID = userID
+	assert.Nil(t, broker.Register(client))
+	expected := make(map[string]bool)
+	received := make(map[string]bool)
+	for _, text := range texts {
+		expected[text] = true
+		select {
+		case message := <-client.outboundChan:
+			received[message.Data.(ReceiveMessagePayload).Text] = true
+		case <-time.After(time.Second):
+			t.Fatal("message was not delivered")
+		}
+	}
+	assert.Equal(t, expected, received)
+	time.Sleep(2 * broker.DeliveryTimeout)
+	assert.Len(t, client.outboundChan, 0)
+}
+
+// sendTexts sends the given texts to the given user.
+func sendTexts(t *testing.T, broker *NatsBroker, userID uuid.UUID, texts ...string) {
+	for _, text := range texts {
+		assert.Nil(t, broker.Send(userID, &BrokerMessage{
+			MessageID:   uuid.NewV4(),
+			SenderID:    uuid.NewV4(),
+			RecipientID: userID,
+			Text:        text,
+		}))
+	}
+}
+
+func TestNatsBroker_Send(t *testing.T) {
+	srv := runNatsServer(t, server.RANDOM_PORT)
+	sender := newTestNatsBroker(t, srv)
+	receiver := newTestNatsBroker(t, srv)
+	first := NewClient(newLogger(), nil, receiver)
+	second := NewClient(newLogger(), nil, sender)
+	second.ID = first.ID
+	assert.Nil(t, receiver.Register(first))
+	assert.Nil(t, sender.Register(second))
+
+	message := &BrokerMessage{
+		MessageID:   uuid.NewV4(),
+		SenderID:    uuid.NewV4(),
+		RecipientID: first.ID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	}
+	assert.Nil(t, sender.Send(first.ID, message))
+	expectReceive(t, first, message.Text)
+	expectReceive(t, second, message.Text)
+
+	assert.Nil(t, receiver.Unregister(first))
+	assert.Nil(t, sender.Send(first.ID, message))
+	expectReceive(t, second, message.Text)
+	assert.Len(t, first.outboundChan, 0)
+
+	message.Text = string(make([]byte, sender.conn.MaxPayload()+1))
+	assert.Equal(t, nats.ErrMaxPayload, sender.Send(first.ID, message))
+}
+
+func TestNatsBroker_Mailbox(t *testing.T) {
+	srv := runNatsServer(t, server.RANDOM_PORT)
+	sender := newTestNatsBroker(t, srv)
+	receiver := newTestNatsBroker(t, srv)
+	recipientID := uuid.NewV4()
+	sendTexts(t, sender, recipientID, "first", "second")
+	time.Sleep(4 * sender.DeliveryTimeout)
+	assert.Len(t, sender.mailboxes.all(), 2)
+	assert.Len(t, receiver.mailboxes.all(), 2)
+
+	expectMailbox(t, receiver, recipientID, "first", "second")
+	assert.Len(t, sender.mailboxes.all(), 0)
+	assert.Len(t, receiver.mailboxes.all(), 0)
+}
+
+func TestNatsBroker_Fetch(t *testing.T) {
+	srv := runNatsServer(t, server.RANDOM_PORT)
+	sender := newTestNatsBroker(t, srv)
+	receiver := newTestNatsBroker(t, srv)
+	recipientID := uuid.NewV4()
+	sendTexts(t, sender, recipientID, "first", "second")
+	time.Sleep(4 * sender.DeliveryTimeout)
+	conn, err := nats.Connect(natsURL(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reply, err := conn.Request(natsFetchSubject, []byte(recipientID.String()), time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var entries []natsMailboxEntry
+	assert.Nil(t, json.Unmarshal(reply.Data, &entries))
+	assert.Len(t, entries, 2)
+	time.Sleep(2 * sender.DeliveryTimeout)
+	assert.Len(t, sender.mailboxes.all(), 2)
+	assert.Len(t, receiver.mailboxes.all(), 2)
+
+	expectMailbox(t, receiver, recipientID, "first", "second")
+	assert.Len(t, sender.mailboxes.all(), 0)
+	assert.Len(t, receiver.mailboxes.all(), 0)
+}
+
+func TestNatsBroker_StoreRegistered(t *testing.T) {
+	srv := runNatsServer(t, server.RANDOM_PORT)
+	sender := newTestNatsBroker(t, srv)
+	receiver := newTestNatsBroker(t, srv)
+	client := NewClient(newLogger(), nil, receiver)
+	assert.Nil(t, receiver.Register(client))
+	time.Sleep(2 * receiver.DeliveryTimeout)
+
+	entry := natsMailboxEntry{
+		ID:          uuid.NewV4(),
+		RecipientID: client.ID,
+		Message:     &BrokerMessage{MessageID: uuid.NewV4(), SenderID: uuid.NewV4(), RecipientID: client.ID, Text: "late"},
+		ExpiresAt:   time.Now().Add(time.Minute),
+	}
+	assert.Nil(t, sender.publish(natsStoreSubject, entry))
+	assert.Nil(t, sender.publish(natsStoreSubject, entry))
+	expectReceive(t, client, "late")
+	time.Sleep(2 * receiver.DeliveryTimeout)
+	assert.Len(t, client.outboundChan, 0)
+	assert.Len(t, sender.mailboxes.all(), 0)
+	assert.Len(t, receiver.mailboxes.all(), 0)
+}
+
+func TestNatsBroker_LateAck(t *testing.T) {
+	srv := runNatsServer(t, server.RANDOM_PORT)
+	broker := newTestNatsBroker(t, srv)
+	conn, err := nats.Connect(natsURL(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	recipientID := uuid.NewV4()
+	acked := make(chan error, 1)
+	_, err = conn.Subscribe(userSubject(recipientID), func(msg *nats.Msg) {
+		time.Sleep(4 * broker.DeliveryTimeout)
+		acked <- conn.Publish(msg.Reply, nil)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, conn.Flush())
+
+	sendTexts(t, broker, recipientID, "late")
+	deadline := time.Now().Add(time.Second)
+	for len(broker.mailboxes.all()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the message was not stored")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Nil(t, <-acked)
+	for len(broker.mailboxes.all()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the message was not retracted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNatsBroker_Synchronize(t *testing.T) {
+	srv := runNatsServer(t, server.RANDOM_PORT)
+	first := newTestNatsBroker(t, srv)
+	recipientID := uuid.NewV4()
+	sendTexts(t, first, recipientID, "first", "second")
+	time.Sleep(4 * first.DeliveryTimeout)
+
+	second := newTestNatsBroker(t, srv)
+	assert.Len(t, second.mailboxes.all(), 2)
+	first.Close()
+	expectMailbox(t, second, recipientID, "first", "second")
+}
+
+func TestNatsBroker_Reconnect(t *testing.T) {
+	srv := runNatsServer(t, server.RANDOM_PORT)
+	broker := newTestNatsBroker(t, srv)
+	client := NewClient(newLogger(), nil, broker)
+	assert.Nil(t, broker.Register(client))
+	assert.Nil(t, broker.CheckHealth())
+
+	port := srv.Addr().(*net.TCPAddr).Port
+	srv.Shutdown()
+	runNatsServer(t, port)
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.CheckHealth() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the broker didn't reconnect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Nil(t, broker.Send(client.ID, &BrokerMessage{
+		SenderID:    uuid.NewV4(),
+		RecipientID: client.ID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	}))
+	expectReceive(t, client, "Lorem ipsum dolor sit amet...")
+}
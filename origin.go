@@ -0,0 +1,79 @@
+package texto
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// An originPattern is an origin from which WebSocket connections are accepted. Its host may start with a "*." wildcard
+// matching any subdomain.
+type originPattern struct {
+	scheme string
+	host   string
+}
+
+// parseOriginPattern parses an allowed origin of the form scheme://host[:port], where host may start with "*.".
+func parseOriginPattern(origin string) (originPattern, bool) {
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 || len(strings.Trim(u.Path, "/")) != 0 ||
+		u.User != nil || len(u.RawQuery) != 0 || len(u.Fragment) != 0 || strings.Contains(u.Host[1:], "*") {
+		return originPattern{}, false
+	}
+	if strings.HasPrefix(u.Host, "*") && !strings.HasPrefix(u.Host, "*.") {
+		return originPattern{}, false
+	}
+	return originPattern{scheme: strings.ToLower(u.Scheme), host: strings.ToLower(u.Host)}, true
+}
+
+// matches reports whether the given origin, whose scheme and host are lowercase, matches the pattern.
+func (p originPattern) matches(scheme, host string) bool {
+	if p.scheme != scheme {
+		return false
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		return strings.HasSuffix(host, p.host[1:]) && len(host) > len(p.host)-1
+	}
+	return p.host == host
+}
+
+// checkOrigin returns the function deciding whether a WebSocket connection can be opened from the origin of a
+// request. The connections are accepted if they don't come from a browser (which always sends an Origin header), if
+// their origin is the host serving the request, or if it matches one of the allowed origins, "*" accepting all of
+// them. The rejected upgrades are logged and counted.
+func checkOrigin(log *logrus.Logger, allowed []string) func(r *http.Request) bool {
+	all := false
+	var patterns []originPattern
+	for _, origin := range allowed {
+		if origin == "*" {
+			all = true
+		} else if pattern, ok := parseOriginPattern(origin); ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 || all {
+			return true
+		}
+		if u, err := url.Parse(origin); err == nil {
+			scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+			if host == strings.ToLower(r.Host) {
+				return true
+			}
+			for _, pattern := range patterns {
+				if pattern.matches(scheme, host) {
+					return true
+				}
+			}
+		}
+		rejectedUpgrades.inc(rejectOrigin)
+		log.
+			WithField("origin", origin).
+			WithField("remote", r.RemoteAddr).
+			Warn("Rejected connection from a disallowed origin")
+		return false
+	}
+}
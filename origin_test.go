@@ -0,0 +1,46 @@
+package texto
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOriginPattern(t *testing.T) {
+	pattern, ok := parseOriginPattern("HTTPS://*.Example.com:8443")
+	assert.True(t, ok)
+	assert.Equal(t, originPattern{scheme: "https", host: "*.example.com:8443"}, pattern)
+	for _, invalid := range []string{"example.com", "https://", "https://example.com/chat", "https://a.*.example.com",
+		"https://*example.com", "https://user@example.com", "https://example.com?a=b"} {
+		_, ok := parseOriginPattern(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	check := checkOrigin(newLogger(), []string{"https://example.com", "https://*.example.org"})
+	request := httptest.NewRequest("GET", "http://texto.example.net/v1/texto", nil)
+	assert.True(t, check(request))
+	rejected := rejectedUpgrades.get(rejectOrigin)
+	for origin, allowed := range map[string]bool{
+		"https://texto.example.net":    true,
+		"https://EXAMPLE.com":          true,
+		"http://example.com":           false,
+		"https://example.com:8443":     false,
+		"https://chat.example.org":     true,
+		"https://a.chat.example.org":   true,
+		"https://example.org":          false,
+		"https://evilexample.org":      false,
+		"https://example.org.evil.com": false,
+		"null":                         false,
+	} {
+		request.Header.Set("Origin", origin)
+		assert.Equal(t, allowed, check(request), origin)
+	}
+	assert.Equal(t, rejected+6, rejectedUpgrades.get(rejectOrigin))
+
+	request.Header.Set("Origin", "https://evil.com")
+	assert.False(t, checkOrigin(newLogger(), nil)(request))
+	assert.True(t, checkOrigin(newLogger(), []string{"*"})(request))
+}
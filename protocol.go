@@ -4,6 +4,7 @@ import (
 	"github.com/satori/go.uuid"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 const (
@@ -19,6 +20,42 @@ const (
 	ReceiveMessageKind = "receive"
 	// AcknowledgeMessageKind is sent after a SendMessageKind or a ReceiveMessageKind was properly processed by the node.
 	AcknowledgeMessageKind = "ack"
+	// DeliveredKind is sent by a Server to a Client when a message it sent was acknowledged by one of its recipients.
+	DeliveredKind = "delivered"
+	// ReadKind is sent by a Client when the user read a received message, and relayed by the Server to the sender.
+	ReadKind = "read"
+	// HistoryKind is sent by a Client to fetch the previous messages of a conversation, and by the Server in response.
+	HistoryKind = "history"
+	// CreateRoomKind is sent by a Client when it wants to create a new room, of which it will be the first member.
+	CreateRoomKind = "create_room"
+	// JoinRoomKind is sent by a Client when it wants to become a member of an existing room.
+	JoinRoomKind = "join"
+	// LeaveRoomKind is sent by a Client when it doesn't want to be a member of a room anymore.
+	LeaveRoomKind = "leave"
+	// RoomMembersKind is sent by a Client when it wants to list the members of a room.
+	RoomMembersKind = "members"
+	// RoomKind is sent by a Server in response to a CreateRoomKind or a RoomMembersKind. It includes the room members.
+	RoomKind = "room"
+	// SubscribePresenceKind is sent by a Client when it wants to be notified of the presence of a set of users.
+	SubscribePresenceKind = "subscribe_presence"
+	// UnsubscribePresenceKind is sent by a Client when it doesn't want to be notified of the presence of users anymore.
+	UnsubscribePresenceKind = "unsubscribe_presence"
+	// PresenceKind is sent by a Server to a Client when the presence of a user it is subscribed to changes.
+	PresenceKind = "presence"
+	// PingKind is sent by a Client to check that its connection is alive, when it can't send WebSocket pings.
+	PingKind = "ping"
+	// PongKind is sent by a Server in response to a PingKind.
+	PongKind = "pong"
+	// ResumeKind is sent by a Client to resume the session of a lost connection. The Server answers with a
+	// ConnectionMessageKind, followed by the messages the Client missed.
+	ResumeKind = "resume"
+)
+
+const (
+	// PresenceOnline is the status of a user with at least one open session.
+	PresenceOnline = "online"
+	// PresenceOffline is the status of a user without any open session.
+	PresenceOffline = "offline"
 )
 
 // A ChatMessage conforms to the schema that the chat clients and servers use to communicate.
@@ -31,6 +68,9 @@ type ChatMessage struct {
 	Kind string `json:"kind"`
 	// The actual content of the message, if any.
 	Data interface{} `json:"data"`
+
+	// If not nil, written is called once the message was written on the WebSocket connection.
+	written func()
 }
 
 // _ChatMessage is a shadow type which sole purpose is to avoid recursion in ChatMessage_UnmarshalJSON.
@@ -70,8 +110,60 @@ func (m *ChatMessage) UnmarshalJSON(input []byte) error {
 			return err
 		}
 		tmp.Data = payload
+	case JoinRoomKind, LeaveRoomKind, RoomMembersKind, RoomKind:
+		var payload RoomMessagePayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return err
+		}
+		tmp.Data = payload
+	case HistoryKind:
+		var payload HistoryMessagePayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return err
+		}
+		tmp.Data = payload
+	case DeliveredKind, ReadKind:
+		var payload ReceiptMessagePayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return err
+		}
+		tmp.Data = payload
+	case SubscribePresenceKind, UnsubscribePresenceKind:
+		var payload PresenceSubscriptionPayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return err
+		}
+		tmp.Data = payload
+	case PresenceKind:
+		var payload PresenceMessagePayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return err
+		}
+		tmp.Data = payload
+	case CreateRoomKind:
 	case RegistrationKind:
+		if len(data) != 0 {
+			var payload RegistrationMessagePayload
+			if err := json.Unmarshal(data, &payload); err != nil {
+				return err
+			}
+			tmp.Data = payload
+		}
 	case AcknowledgeMessageKind:
+		if len(data) != 0 && string(data) != "null" {
+			var payload AckMessagePayload
+			if err := json.Unmarshal(data, &payload); err != nil {
+				return err
+			}
+			tmp.Data = payload
+		}
+	case ResumeKind:
+		var payload ResumeMessagePayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return err
+		}
+		tmp.Data = payload
+	case PingKind, PongKind:
 	default:
 		return fmt.Errorf("Unknown message kind: %s", tmp.Kind)
 	}
@@ -83,11 +175,35 @@ func (m *ChatMessage) UnmarshalJSON(input []byte) error {
 type ErrorMessagePayload struct {
 	Code        string `json:"code"`
 	Description string `json:"description"`
+	// The number of milliseconds after which the request can be retried, for the ERATE errors.
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+// An AckMessagePayload is the payload of the ack answering a send message. It contains the time at which the server
+// accepted the message, and its sequence number in the conversation if the server numbers the messages.
+type AckMessagePayload struct {
+	SentAt   time.Time `json:"sent_at"`
+	Sequence uint64    `json:"sequence,omitempty"`
+}
+
+// A RegistrationMessagePayload optionally contains the durable ID of the user opening the session.
+type RegistrationMessagePayload struct {
+	UserID uuid.UUID `json:"user_id"`
 }
 
-// A ConnectionMessagePayload contains the id of a newly registered client.
+// A ConnectionMessagePayload contains the id of a newly registered client, and the id of its session. If the server
+// supports the resumption of the sessions, it also contains the token with which the session can be resumed.
 type ConnectionMessagePayload struct {
-	ClientID uuid.UUID `json:"client_id"`
+	ClientID    uuid.UUID `json:"client_id"`
+	SessionID   uuid.UUID `json:"session_id"`
+	ResumeToken string    `json:"resume_token,omitempty"`
+}
+
+// A ResumeMessagePayload contains the token of the session to resume, and the session sequence number of the last
+// receive message the Client got from it.
+type ResumeMessagePayload struct {
+	Token        string `json:"token"`
+	LastSequence uint64 `json:"last_sequence"`
 }
 
 // A SendMessagePayload contains the receiver's ID and the content of the message.
@@ -96,10 +212,57 @@ type SendMessagePayload struct {
 	Text       string `json:"text"`
 }
 
-// A ReceiveMessagePayload contains the sender's ID and the content of the message.
+// A ReceiveMessagePayload contains the sender's ID and the content of the message. If the message was sent to a room,
+// it also contains the ID of the room. Sequence is the position of the message in its conversation: it increases by 1
+// with each message, so that a gap reveals a missed message. It is omitted if the server doesn't number the messages.
+// SessionSequence is the position of the message in the ones transmitted to the session, with which the session is
+// resumed. It is omitted if the session can't be resumed.
 type ReceiveMessagePayload struct {
-	SenderID uuid.UUID `json:"sender_id"`
-	Text     string `json:"text"`
+	MessageID       uuid.UUID  `json:"message_id"`
+	SenderID        uuid.UUID  `json:"sender_id"`
+	RoomID          *uuid.UUID `json:"room_id,omitempty"`
+	Text            string     `json:"text"`
+	SentAt          time.Time  `json:"sent_at"`
+	Sequence        uint64     `json:"sequence,omitempty"`
+	SessionSequence uint64     `json:"session_sequence,omitempty"`
+}
+
+// A HistoryMessagePayload describes a page of the history of the conversation with a peer, which is either a user or a
+// room. In requests, Before, BeforeID and Limit select the page, and in responses Messages contains the page in
+// chronological order.
+type HistoryMessagePayload struct {
+	PeerID   uuid.UUID               `json:"peer_id"`
+	Before   *time.Time              `json:"before,omitempty"`
+	BeforeID *uuid.UUID              `json:"before_id,omitempty"`
+	Limit    int                     `json:"limit,omitempty"`
+	Messages []ReceiveMessagePayload `json:"messages"`
+}
+
+// A RoomMessagePayload contains the ID of a room and, in RoomKind messages, the IDs of its members.
+type RoomMessagePayload struct {
+	RoomID  uuid.UUID   `json:"room_id"`
+	Members []uuid.UUID `json:"members,omitempty"`
+}
+
+// A ReceiptMessagePayload references a message that was delivered to or read by one of its recipients. The sender_id
+// is the ID of the user who sent the original message, and the recipient_id the ID of the user who received it.
+type ReceiptMessagePayload struct {
+	MessageID   uuid.UUID `json:"message_id"`
+	SenderID    uuid.UUID `json:"sender_id"`
+	RecipientID uuid.UUID `json:"recipient_id"`
+}
+
+// A PresenceSubscriptionPayload contains the IDs of the users whose presence a Client (un)subscribes to.
+type PresenceSubscriptionPayload struct {
+	UserIDs []uuid.UUID `json:"user_ids"`
+}
+
+// A PresenceMessagePayload contains the presence status of a user, and the last time it was seen online if it is
+// offline and this time is known.
+type PresenceMessagePayload struct {
+	UserID   uuid.UUID  `json:"user_id"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
 }
 
 // NewErrorMessage creates a new ChatMessage of kind "error", with an ErrorMessagePayload.
@@ -199,3 +362,96 @@ func NewReceiveMessage(messageID *uuid.UUID, clientID uuid.UUID, payload Receive
 	}
 }
 
+// newChatMessage creates a new ChatMessage of the given kind. If messageID is nil, a new random ID is generated.
+func newChatMessage(messageID *uuid.UUID, clientID uuid.UUID, kind string, payload interface{}) *ChatMessage {
+	var mID uuid.UUID
+	if messageID == nil {
+		mID = uuid.NewV4()
+	} else {
+		mID = *messageID
+	}
+	return &ChatMessage{
+		ID:       mID,
+		ClientID: clientID,
+		Kind:     kind,
+		Data:     payload,
+	}
+}
+
+// NewCreateRoomMessage creates a new ChatMessage of kind "create_room".
+func NewCreateRoomMessage(messageID *uuid.UUID, clientID uuid.UUID) *ChatMessage {
+	return newChatMessage(messageID, clientID, CreateRoomKind, nil)
+}
+
+// NewJoinRoomMessage creates a new ChatMessage of kind "join", with a RoomMessagePayload.
+func NewJoinRoomMessage(messageID *uuid.UUID, clientID uuid.UUID, payload RoomMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, JoinRoomKind, payload)
+}
+
+// NewLeaveRoomMessage creates a new ChatMessage of kind "leave", with a RoomMessagePayload.
+func NewLeaveRoomMessage(messageID *uuid.UUID, clientID uuid.UUID, payload RoomMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, LeaveRoomKind, payload)
+}
+
+// NewRoomMembersMessage creates a new ChatMessage of kind "members", with a RoomMessagePayload.
+func NewRoomMembersMessage(messageID *uuid.UUID, clientID uuid.UUID, payload RoomMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, RoomMembersKind, payload)
+}
+
+// NewRoomMessage creates a new ChatMessage of kind "room", with a RoomMessagePayload.
+func NewRoomMessage(messageID *uuid.UUID, clientID uuid.UUID, payload RoomMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, RoomKind, payload)
+}
+
+// NewSubscribePresenceMessage creates a new ChatMessage of kind "subscribe_presence", with a
+// PresenceSubscriptionPayload.
+func NewSubscribePresenceMessage(messageID *uuid.UUID, clientID uuid.UUID, payload PresenceSubscriptionPayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, SubscribePresenceKind, payload)
+}
+
+// NewUnsubscribePresenceMessage creates a new ChatMessage of kind "unsubscribe_presence", with a
+// PresenceSubscriptionPayload.
+func NewUnsubscribePresenceMessage(messageID *uuid.UUID, clientID uuid.UUID, payload PresenceSubscriptionPayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, UnsubscribePresenceKind, payload)
+}
+
+// NewPresenceMessage creates a new ChatMessage of kind "presence", with a PresenceMessagePayload.
+func NewPresenceMessage(messageID *uuid.UUID, clientID uuid.UUID, payload PresenceMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, PresenceKind, payload)
+}
+
+// NewDeliveredMessage creates a new ChatMessage of kind "delivered", with a ReceiptMessagePayload.
+func NewDeliveredMessage(messageID *uuid.UUID, clientID uuid.UUID, payload ReceiptMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, DeliveredKind, payload)
+}
+
+// NewReadMessage creates a new ChatMessage of kind "read", with a ReceiptMessagePayload.
+func NewReadMessage(messageID *uuid.UUID, clientID uuid.UUID, payload ReceiptMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, ReadKind, payload)
+}
+
+// NewHistoryMessage creates a new ChatMessage of kind "history", with a HistoryMessagePayload.
+func NewHistoryMessage(messageID *uuid.UUID, clientID uuid.UUID, payload HistoryMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, HistoryKind, payload)
+}
+
+// NewSendAckMessage creates a new ChatMessage of kind "acknowledge" answering a send message, with an
+// AckMessagePayload.
+func NewSendAckMessage(messageID *uuid.UUID, clientID uuid.UUID, payload AckMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, AcknowledgeMessageKind, payload)
+}
+
+// NewResumeMessage creates a new ChatMessage of kind "resume", with a ResumeMessagePayload.
+func NewResumeMessage(messageID *uuid.UUID, clientID uuid.UUID, payload ResumeMessagePayload) *ChatMessage {
+	return newChatMessage(messageID, clientID, ResumeKind, payload)
+}
+
+// NewPingMessage creates a new ChatMessage of kind "ping".
+func NewPingMessage(messageID *uuid.UUID, clientID uuid.UUID) *ChatMessage {
+	return newChatMessage(messageID, clientID, PingKind, nil)
+}
+
+// NewPongMessage creates a new ChatMessage of kind "pong".
+func NewPongMessage(messageID *uuid.UUID, clientID uuid.UUID) *ChatMessage {
+	return newChatMessage(messageID, clientID, PongKind, nil)
+}
@@ -1,7 +1,9 @@
 package texto
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
@@ -81,6 +83,42 @@ const ackChatMessage = `
 }
 `
 
+const joinChatMessage = `
+{
+	"client_id": "b50bff94-4f43-4e24-9c71-dea94d3db825",
+	"id": "b857e508-3993-46b9-b227-ca7528f2861d",
+	"kind": "join",
+	"data": {
+		"room_id": "8f718542-0e5a-4d9a-9ce9-eb8ad1912359"
+	}
+}
+`
+
+const presenceChatMessage = `
+{
+	"client_id": "b50bff94-4f43-4e24-9c71-dea94d3db825",
+	"id": "b857e508-3993-46b9-b227-ca7528f2861d",
+	"kind": "presence",
+	"data": {
+		"user_id": "8f718542-0e5a-4d9a-9ce9-eb8ad1912359",
+		"status": "offline",
+		"last_seen": "2017-10-01T12:00:00Z"
+	}
+}
+`
+
+const readChatMessage = `
+{
+	"id": "b857e508-3993-46b9-b227-ca7528f2861d",
+	"client_id": "8f718542-0e5a-4d9a-9ce9-eb8ad1912359",
+	"kind": "read",
+	"data": {
+		"message_id": "3c2b1f7e-5a4d-4e3b-8c9f-0a1b2c3d4e5f",
+		"sender_id": "754cd3a0-27b3-4c51-a66e-466fed82b667"
+	}
+}
+`
+
 func TestMessageUnmarshalJSON(t *testing.T) {
 	var invalidMsg ChatMessage
 	assert.NotNil(t, invalidMsg.UnmarshalJSON([]byte(invalidChatMessage)))
@@ -117,6 +155,25 @@ func TestMessageUnmarshalJSON(t *testing.T) {
 		assert.Equal(t, "Lorem ipsum dolor si amet.", receiveMsg.Data.(ReceiveMessagePayload).Text)
 	}
 
+	var joinMsg ChatMessage
+	if assert.NoError(t, joinMsg.UnmarshalJSON([]byte(joinChatMessage))) {
+		assert.Equal(t, "b857e508-3993-46b9-b227-ca7528f2861d", joinMsg.ID.String())
+		assert.Equal(t, "8f718542-0e5a-4d9a-9ce9-eb8ad1912359", joinMsg.Data.(RoomMessagePayload).RoomID.String())
+	}
+
+	var presenceMsg ChatMessage
+	if assert.NoError(t, presenceMsg.UnmarshalJSON([]byte(presenceChatMessage))) {
+		assert.Equal(t, "8f718542-0e5a-4d9a-9ce9-eb8ad1912359", presenceMsg.Data.(PresenceMessagePayload).UserID.String())
+		assert.Equal(t, PresenceOffline, presenceMsg.Data.(PresenceMessagePayload).Status)
+		assert.Equal(t, int64(1506859200), presenceMsg.Data.(PresenceMessagePayload).LastSeen.Unix())
+	}
+
+	var readMsg ChatMessage
+	if assert.NoError(t, readMsg.UnmarshalJSON([]byte(readChatMessage))) {
+		assert.Equal(t, "3c2b1f7e-5a4d-4e3b-8c9f-0a1b2c3d4e5f", readMsg.Data.(ReceiptMessagePayload).MessageID.String())
+		assert.Equal(t, "754cd3a0-27b3-4c51-a66e-466fed82b667", readMsg.Data.(ReceiptMessagePayload).SenderID.String())
+	}
+
 	var ackMsg ChatMessage
 	if assert.NoError(t, ackMsg.UnmarshalJSON([]byte(ackChatMessage))) {
 		assert.Equal(t, "b857e508-3993-46b9-b227-ca7528f2861d", ackMsg.ID.String())
@@ -126,7 +183,7 @@ func TestMessageUnmarshalJSON(t *testing.T) {
 func TestNewErrorMessage(t *testing.T) {
 	var defaultID uuid.UUID
 	clientID := uuid.NewV4()
-	errorPayload := ErrorMessagePayload{"ENOMEM", "Out-of-memory"}
+	errorPayload := ErrorMessagePayload{Code: "ENOMEM", Description: "Out-of-memory"}
 	msg := NewErrorMessage(nil, clientID, errorPayload)
 	assert.NotEqual(t, defaultID.String(), msg.ID.String())
 	assert.Equal(t, clientID.String(), msg.ClientID.String())
@@ -148,10 +205,23 @@ func TestNewAckMessage(t *testing.T) {
 	assert.Equal(t, msg.ID, answer.ID)
 }
 
+func TestNewSendAckMessage(t *testing.T) {
+	clientID := uuid.NewV4()
+	payload := AckMessagePayload{SentAt: time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC), Sequence: 42}
+	msg := NewSendAckMessage(nil, clientID, payload)
+	assert.Equal(t, AcknowledgeMessageKind, msg.Kind)
+	marshaled, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	var unmarshaled ChatMessage
+	assert.Nil(t, json.Unmarshal(marshaled, &unmarshaled))
+	assert.Equal(t, payload, unmarshaled.Data)
+	assert.Nil(t, json.Unmarshal([]byte(`{"kind":"ack","data":null}`), &unmarshaled))
+}
+
 func TestNewConnectionMessage(t *testing.T) {
 	var defaultID uuid.UUID
 	clientID := uuid.NewV4()
-	connectionPayload := ConnectionMessagePayload{clientID}
+	connectionPayload := ConnectionMessagePayload{ClientID: clientID, SessionID: uuid.NewV4()}
 	msg := NewConnectionMessage(nil, clientID, connectionPayload)
 	assert.NotEqual(t, defaultID.String(), msg.ID.String())
 	assert.Equal(t, clientID.String(), msg.ClientID.String())
@@ -0,0 +1,108 @@
+package texto
+
+import (
+	"fmt"
+)
+
+// An OverflowPolicy decides what happens to the messages sent to a user whose send queue is full, because they don't
+// read them fast enough.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest queued message to make room for the new one.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest discards the new message.
+	OverflowDropNewest
+	// OverflowDisconnect closes the connection with the CloseSlowConsumer code. The user is expected to reconnect and
+	// fetch the messages they missed.
+	OverflowDisconnect
+)
+
+// ParseOverflowPolicy returns the OverflowPolicy of the given name: drop_oldest, drop_newest or disconnect.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "drop_oldest":
+		return OverflowDropOldest, nil
+	case "drop_newest":
+		return OverflowDropNewest, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	default:
+		return 0, fmt.Errorf("unknown overflow policy %q, expected drop_oldest, drop_newest or disconnect", name)
+	}
+}
+
+// DefaultSendQueueSize is the default number of messages waiting to be written to a user.
+const DefaultSendQueueSize = 64
+
+// CloseSlowConsumer is the code of the close frame sent to the users disconnected by OverflowDisconnect.
+const CloseSlowConsumer = 4000
+
+// SlowConsumerCloseReason is the reason of the close frame sent to the users disconnected by OverflowDisconnect.
+const SlowConsumerCloseReason = "slow consumer"
+
+// enqueue adds the given message to the send queue of the Client, in order, applying its OverflowPolicy if the queue
+// is full. It never blocks.
+func (c *Client) enqueue(message *ChatMessage) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if c.queueClosed {
+		return
+	}
+	for {
+		select {
+		case c.outboundChan <- message:
+			queuedMessages.add(1)
+			sendQueueDepth.observe(float64(len(c.outboundChan)))
+			return
+		default:
+		}
+		switch c.overflow {
+		case OverflowDropOldest:
+			select {
+			case <-c.outboundChan:
+				queuedMessages.add(-1)
+				droppedMessages.inc(dropSendQueueFull)
+			default:
+			}
+		case OverflowDropNewest:
+			droppedMessages.inc(dropSendQueueFull)
+			return
+		default:
+			droppedMessages.inc(dropSendQueueFull)
+			select {
+			case c.slow <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// dequeued records that a message was taken from the send queue.
+func (c *Client) dequeued() {
+	queuedMessages.add(-1)
+}
+
+// isQueueClosed reports whether closeQueue was called.
+func (c *Client) isQueueClosed() bool {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return c.queueClosed
+}
+
+// closeQueue discards the messages left in the send queue, and the ones enqueued afterwards. It is called once the
+// connection is lost and the Client lingers, or once it is unregistered from the Broker.
+func (c *Client) closeQueue() {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	c.queueClosed = true
+	for {
+		select {
+		case <-c.outboundChan:
+			queuedMessages.add(-1)
+		default:
+			return
+		}
+	}
+}
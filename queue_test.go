@@ -0,0 +1,79 @@
+package texto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// queuedTexts returns the texts of the receive messages waiting in the send queue of the given Client.
+func queuedTexts(client *Client) []string {
+	var texts []string
+	for len(client.outboundChan) != 0 {
+		texts = append(texts, (<-client.outboundChan).Data.(ReceiveMessagePayload).Text)
+	}
+	return texts
+}
+
+func TestClient_Enqueue(t *testing.T) {
+	for _, test := range []struct {
+		overflow OverflowPolicy
+		texts    []string
+		slow     bool
+	}{
+		{OverflowDropOldest, []string{"c", "d"}, false},
+		{OverflowDropNewest, []string{"a", "b"}, false},
+		{OverflowDisconnect, []string{"a", "b"}, true},
+	} {
+		client := NewClient(newLogger(), nil, NewMemoryBroker(newLogger()))
+		client.outboundChan = make(chan *ChatMessage, 2)
+		client.overflow = test.overflow
+		dropped := droppedMessages.get(dropSendQueueFull)
+		for _, text := range []string{"a", "b", "c", "d"} {
+			client.deliver(&BrokerMessage{RecipientID: client.ID, Text: text})
+		}
+		assert.Equal(t, dropped+2, droppedMessages.get(dropSendQueueFull))
+		assert.Equal(t, test.slow, len(client.slow) == 1)
+		assert.Equal(t, test.texts, queuedTexts(client))
+	}
+
+	client := NewClient(newLogger(), nil, NewMemoryBroker(newLogger()))
+	client.deliver(&BrokerMessage{RecipientID: client.ID, Text: "a"})
+	client.closeQueue()
+	client.deliver(&BrokerMessage{RecipientID: client.ID, Text: "b"})
+	assert.Len(t, client.outboundChan, 0)
+}
+
+func TestClient_SlowConsumer(t *testing.T) {
+	conn, peer := newTestConn(t)
+	client := NewClient(newLogger(), conn, NewMemoryBroker(newLogger()))
+	client.outboundChan = make(chan *ChatMessage, 1)
+	client.overflow = OverflowDisconnect
+	client.enqueue(NewAckMessage(nil, client.ID))
+	client.enqueue(NewAckMessage(nil, client.ID))
+	go client.Run(time.Minute)
+
+	var err error
+	for err == nil {
+		_, _, err = peer.ReadMessage()
+	}
+	if assert.True(t, websocket.IsCloseError(err, CloseSlowConsumer)) {
+		assert.Equal(t, SlowConsumerCloseReason, err.(*websocket.CloseError).Text)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for name, expected := range map[string]OverflowPolicy{
+		"drop_oldest": OverflowDropOldest,
+		"drop_newest": OverflowDropNewest,
+		"disconnect":  OverflowDisconnect,
+	} {
+		policy, err := ParseOverflowPolicy(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, policy)
+	}
+	_, err := ParseOverflowPolicy("block")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,147 @@
+package texto
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// A RateLimit configures a token bucket, holding at most Burst tokens and refilled with Rate tokens per second. A zero
+// Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// The default rate limits of the messages sent by the users.
+var (
+	// DefaultClientRateLimit is the default rate limit of each session.
+	DefaultClientRateLimit = RateLimit{Rate: 10, Burst: 20}
+	// DefaultUserRateLimit is the default rate limit shared by all the sessions of a user on a node.
+	DefaultUserRateLimit = RateLimit{Rate: 20, Burst: 40}
+)
+
+// DefaultMaxRateViolations is the default number of consecutive messages rejected by the rate limits after which a
+// session is closed.
+const DefaultMaxRateViolations = 100
+
+// rateLimitedKind reports whether the messages of the given kind are subject to the rate limits. The acknowledgements
+// and errors answer the messages sent by the server, so they are only bounded by them.
+func rateLimitedKind(kind string) bool {
+	return kind != AcknowledgeMessageKind && kind != ErrorMessageKind
+}
+
+// A tokenBucket implements the token bucket algorithm. Its zero value is a full bucket.
+type tokenBucket struct {
+	// used is the number of tokens missing from the bucket at the time last.
+	used float64
+	last time.Time
+}
+
+// refill updates the number of tokens of the bucket at the given time.
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.used = math.Max(0, b.used-now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+}
+
+// take removes a token from the bucket at the given time. If the bucket is empty, it returns the duration after which
+// a token will be available, and zero otherwise.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) time.Duration {
+	if limit.Rate <= 0 {
+		return 0
+	}
+	b.refill(limit, now)
+	if b.used+1 > float64(limit.Burst) {
+		return time.Duration((b.used + 1 - float64(limit.Burst)) / limit.Rate * float64(time.Second))
+	}
+	b.used++
+	return 0
+}
+
+// full reports whether the bucket holds all its tokens at the given time, in which case it can be forgotten.
+func (b *tokenBucket) full(limit RateLimit, now time.Time) bool {
+	b.refill(limit, now)
+	return b.used == 0
+}
+
+// A userRateLimiter holds the token buckets shared by the sessions of each user.
+type userRateLimiter struct {
+	limit   RateLimit
+	mu      sync.Mutex
+	buckets map[uuid.UUID]*tokenBucket
+	// sweepAt is the number of buckets from which the full ones are removed before adding a new one.
+	sweepAt int
+}
+
+// minRateLimiterSweep is the minimum number of buckets a userRateLimiter holds before removing the full ones.
+const minRateLimiterSweep = 1024
+
+// newUserRateLimiter returns a userRateLimiter enforcing the given limit.
+func newUserRateLimiter(limit RateLimit) *userRateLimiter {
+	return &userRateLimiter{
+		limit:   limit,
+		buckets: make(map[uuid.UUID]*tokenBucket),
+		sweepAt: minRateLimiterSweep,
+	}
+}
+
+// take removes a token from the bucket of the given user, as tokenBucket.take.
+func (l *userRateLimiter) take(userID uuid.UUID, now time.Time) time.Duration {
+	if l.limit.Rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[userID]
+	if !ok {
+		if len(l.buckets) >= l.sweepAt {
+			for id, candidate := range l.buckets {
+				if candidate.full(l.limit, now) {
+					delete(l.buckets, id)
+				}
+			}
+			l.sweepAt = 2 * len(l.buckets)
+			if l.sweepAt < minRateLimiterSweep {
+				l.sweepAt = minRateLimiterSweep
+			}
+		}
+		bucket = new(tokenBucket)
+		l.buckets[userID] = bucket
+	}
+	return bucket.take(l.limit, now)
+}
+
+// A clientRateLimiter enforces the rate limits of a session, and counts the consecutive messages it rejected.
+type clientRateLimiter struct {
+	limit         RateLimit
+	bucket        tokenBucket
+	users         *userRateLimiter
+	maxViolations int
+	violations    int
+}
+
+// allow reports whether a message of the given user can be processed at the given time. If it can't, it returns the
+// duration after which it could be.
+func (l *clientRateLimiter) allow(userID uuid.UUID, now time.Time) time.Duration {
+	retryAfter := l.bucket.take(l.limit, now)
+	if retryAfter == 0 && l.users != nil {
+		if retryAfter = l.users.take(userID, now); retryAfter != 0 && l.limit.Rate > 0 {
+			l.bucket.used--
+		}
+	}
+	if retryAfter != 0 {
+		l.violations++
+	} else {
+		l.violations = 0
+	}
+	return retryAfter
+}
+
+// abusive reports whether the session kept sending messages despite being rate limited, and must be closed.
+func (l *clientRateLimiter) abusive() bool {
+	return l.maxViolations > 0 && l.violations >= l.maxViolations
+}
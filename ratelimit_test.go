@@ -0,0 +1,71 @@
+package texto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := RateLimit{Rate: 2, Burst: 2}
+	now := time.Now()
+	var bucket tokenBucket
+	assert.Equal(t, time.Duration(0), bucket.take(limit, now))
+	assert.Equal(t, time.Duration(0), bucket.take(limit, now))
+	assert.Equal(t, 500*time.Millisecond, bucket.take(limit, now))
+	assert.Equal(t, 250*time.Millisecond, bucket.take(limit, now.Add(250*time.Millisecond)))
+	assert.Equal(t, time.Duration(0), bucket.take(limit, now.Add(500*time.Millisecond)))
+	assert.False(t, bucket.full(limit, now.Add(time.Second)))
+	assert.True(t, bucket.full(limit, now.Add(2*time.Second)))
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, time.Duration(0), bucket.take(RateLimit{}, now))
+	}
+}
+
+func TestUserRateLimiter(t *testing.T) {
+	limiter := newUserRateLimiter(RateLimit{Rate: 1, Burst: 1})
+	now := time.Now()
+	for i := 0; i < minRateLimiterSweep; i++ {
+		assert.Equal(t, time.Duration(0), limiter.take(uuid.NewV4(), now))
+	}
+	userID := uuid.NewV4()
+	assert.Equal(t, time.Duration(0), limiter.take(userID, now.Add(time.Second)))
+	assert.Len(t, limiter.buckets, 1)
+	assert.Equal(t, time.Second, limiter.take(userID, now.Add(time.Second)))
+}
+
+func TestClientRateLimiter(t *testing.T) {
+	users := newUserRateLimiter(RateLimit{Rate: 1, Burst: 3})
+	first := &clientRateLimiter{limit: RateLimit{Rate: 1, Burst: 2}, users: users, maxViolations: 2}
+	second := &clientRateLimiter{limit: RateLimit{Rate: 1, Burst: 2}, users: users, maxViolations: 2}
+	userID := uuid.NewV4()
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), first.allow(userID, now))
+	assert.Equal(t, time.Duration(0), first.allow(userID, now))
+	assert.NotEqual(t, time.Duration(0), first.allow(userID, now))
+	assert.False(t, first.abusive())
+	assert.Equal(t, time.Duration(0), second.allow(userID, now))
+	assert.NotEqual(t, time.Duration(0), second.allow(userID, now))
+	assert.Equal(t, float64(1), second.bucket.used)
+	assert.NotEqual(t, time.Duration(0), first.allow(userID, now))
+	assert.True(t, first.abusive())
+	assert.Equal(t, time.Duration(0), first.allow(userID, now.Add(time.Second)))
+	assert.False(t, first.abusive())
+}
+
+func TestClient_HandleRateLimit(t *testing.T) {
+	client := NewClient(newLogger(), nil, NewMemoryBroker(newLogger()))
+	client.limiter = &clientRateLimiter{limit: RateLimit{Rate: 1, Burst: 1}}
+	registration := NewRegistrationMessage(nil, client.ID)
+	assert.Equal(t, ConnectionMessageKind, client.HandleMessage(registration).Kind)
+	response := client.HandleMessage(registration)
+	if assert.Equal(t, ErrorMessageKind, response.Kind) {
+		payload := response.Data.(ErrorMessagePayload)
+		assert.Equal(t, "ERATE", payload.Code)
+		assert.InDelta(t, 1000, payload.RetryAfter, 10)
+	}
+	assert.Nil(t, client.HandleMessage(NewAckMessage(nil, client.ID)))
+}
@@ -0,0 +1,342 @@
+package texto
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// A redisStub is a minimal in-process stand-in for a Redis server. It speaks the RESP protocol and implements PING,
+// PUBLISH and the subscription commands, which is enough to exercise the subscriber of a RedisBroker. Other commands
+// can be implemented by the tests using handlers.
+type redisStub struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[*redisStubConn]struct{}
+	handlers map[string]func(conn *redisStubConn, args []string)
+}
+
+// A redisStubConn is a connection to a redisStub.
+type redisStubConn struct {
+	net.Conn
+	stub     *redisStub
+	reader   *bufio.Reader
+	writeMu  sync.Mutex
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// newRedisStub starts a new redisStub listening on a random local port. It is closed at the end of the test.
+func newRedisStub(t testing.TB) *redisStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startRedisStub(t, listener)
+}
+
+// newRedisTLSStub starts a new redisStub accepting TLS connections on a random local port.
+func newRedisTLSStub(t testing.TB, config *tls.Config) *redisStub {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startRedisStub(t, listener)
+}
+
+// startRedisStub starts a new redisStub accepting connections from the given listener.
+func startRedisStub(t testing.TB, listener net.Listener) *redisStub {
+	stub := &redisStub{
+		listener: listener,
+		conns:    make(map[*redisStubConn]struct{}),
+		handlers: make(map[string]func(conn *redisStubConn, args []string)),
+	}
+	go stub.serve()
+	t.Cleanup(stub.close)
+	return stub
+}
+
+// addr returns the address on which the stub is listening.
+func (s *redisStub) addr() string {
+	return s.listener.Addr().String()
+}
+
+// dial opens a new connection to the stub.
+func (s *redisStub) dial(options ...redis.DialOption) (redis.Conn, error) {
+	return redis.Dial("tcp", s.addr(), options...)
+}
+
+// handle registers the handler of the given command.
+func (s *redisStub) handle(command string, handler func(conn *redisStubConn, args []string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[command] = handler
+}
+
+// close stops the stub and closes all its connections.
+func (s *redisStub) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// serve accepts the incoming connections.
+func (s *redisStub) serve() {
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := &redisStubConn{
+			Conn:     netConn,
+			stub:     s,
+			reader:   bufio.NewReader(netConn),
+			channels: make(map[string]struct{}),
+			patterns: make(map[string]struct{}),
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go conn.serve()
+	}
+}
+
+// serve reads and executes the commands sent on the connection.
+func (c *redisStubConn) serve() {
+	defer func() {
+		c.stub.mu.Lock()
+		delete(c.stub.conns, c)
+		c.stub.mu.Unlock()
+		c.Close()
+	}()
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			return
+		}
+		c.execute(strings.ToUpper(args[0]), args[1:])
+	}
+}
+
+// readCommand reads a command encoded as an array of bulk strings.
+func (c *redisStubConn) readCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, errors.New("invalid command")
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count <= 0 {
+		return nil, errors.New("invalid command")
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("invalid argument")
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF.
+func (c *redisStubConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// execute executes the given command.
+func (c *redisStubConn) execute(command string, args []string) {
+	c.stub.mu.Lock()
+	handler, ok := c.stub.handlers[command]
+	c.stub.mu.Unlock()
+	if ok {
+		handler(c, args)
+		return
+	}
+	switch command {
+	case "PING":
+		if c.subscribed() {
+			message := ""
+			if len(args) != 0 {
+				message = args[0]
+			}
+			c.reply([]interface{}{"pong", message})
+		} else {
+			c.reply(redisStubStatus("PONG"))
+		}
+	case "PUBLISH":
+		if len(args) != 2 {
+			c.reply(errors.New("ERR wrong number of arguments for 'publish' command"))
+			return
+		}
+		c.reply(int64(c.stub.publish(args[0], args[1])))
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		c.updateSubscriptions(command, args)
+	default:
+		c.reply(fmt.Errorf("ERR unknown command '%s'", command))
+	}
+}
+
+// updateSubscriptions executes a (un)subscription command.
+func (c *redisStubConn) updateSubscriptions(command string, args []string) {
+	c.stub.mu.Lock()
+	subscriptions := c.channels
+	if strings.HasPrefix(command, "P") {
+		subscriptions = c.patterns
+	}
+	if len(args) == 0 && strings.Contains(command, "UNSUBSCRIBE") {
+		for name := range subscriptions {
+			args = append(args, name)
+		}
+	}
+	replies := make([][]interface{}, 0, len(args))
+	for _, name := range args {
+		if strings.Contains(command, "UNSUBSCRIBE") {
+			delete(subscriptions, name)
+		} else {
+			subscriptions[name] = struct{}{}
+		}
+		replies = append(replies, []interface{}{
+			strings.ToLower(command),
+			name,
+			int64(len(c.channels) + len(c.patterns)),
+		})
+	}
+	c.stub.mu.Unlock()
+	for _, reply := range replies {
+		c.reply(reply)
+	}
+}
+
+// subscribed reports whether the connection is subscribed to at least one channel or pattern.
+func (c *redisStubConn) subscribed() bool {
+	c.stub.mu.Lock()
+	defer c.stub.mu.Unlock()
+	return len(c.channels)+len(c.patterns) != 0
+}
+
+// publish sends the given message to the subscribers of the given channel, and returns their number.
+func (s *redisStub) publish(channel, message string) int {
+	type delivery struct {
+		conn  *redisStubConn
+		reply []interface{}
+	}
+	var deliveries []delivery
+	s.mu.Lock()
+	for conn := range s.conns {
+		if _, ok := conn.channels[channel]; ok {
+			deliveries = append(deliveries, delivery{conn, []interface{}{"message", channel, message}})
+		}
+		for pattern := range conn.patterns {
+			if matched, _ := path.Match(pattern, channel); matched {
+				deliveries = append(deliveries, delivery{conn, []interface{}{"pmessage", pattern, channel, message}})
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, d := range deliveries {
+		d.conn.reply(d.reply)
+	}
+	return len(deliveries)
+}
+
+// A redisStubStatus is a status reply, such as +OK.
+type redisStubStatus string
+
+// reply writes the given value on the connection: a redisStubStatus is written as a status, a string as a bulk string,
+// an int64 as an integer, an error as an error, nil as a null bulk string and a slice as an array.
+func (c *redisStubConn) reply(value interface{}) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	writer := bufio.NewWriter(c.Conn)
+	writeRESP(writer, value)
+	writer.Flush()
+}
+
+// writeRESP encodes the given value using the RESP protocol.
+func writeRESP(w *bufio.Writer, value interface{}) {
+	switch v := value.(type) {
+	case redisStubStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v.Error())
+	case nil:
+		w.WriteString("$-1\r\n")
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRESP(w, item)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRESP(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported RESP value %#v", value))
+	}
+}
+
+func TestRedisStub(t *testing.T) {
+	stub := newRedisStub(t)
+	conn, err := stub.dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	pong, err := redis.String(conn.Do("PING"))
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+
+	subscriber, err := stub.dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	pubSubConn := redis.PubSubConn{Conn: subscriber}
+	defer pubSubConn.Close()
+	assert.Nil(t, pubSubConn.Subscribe("texto:a"))
+	assert.Nil(t, pubSubConn.PSubscribe("texto:*"))
+	assert.IsType(t, redis.Subscription{}, pubSubConn.Receive())
+	assert.IsType(t, redis.Subscription{}, pubSubConn.Receive())
+	receivers, err := redis.Int(conn.Do("PUBLISH", "texto:a", "hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, receivers)
+	assert.Equal(t, redis.Message{Channel: "texto:a", Data: []byte("hello")}, pubSubConn.Receive())
+	assert.Equal(t, redis.PMessage{Pattern: "texto:*", Channel: "texto:a", Data: []byte("hello")}, pubSubConn.Receive())
+}
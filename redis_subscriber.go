@@ -0,0 +1,311 @@
+package texto
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/satori/go.uuid"
+)
+
+// A RedisRouting is a strategy used by a RedisBroker to receive the messages intended for the users connected to its
+// node.
+type RedisRouting int
+
+const (
+	// RedisRoutingTargeted subscribes to the channel of each user connected to the node, and to the presence channel of
+	// each user watched by one of its Clients. A node only receives the messages it can deliver.
+	RedisRoutingTargeted RedisRouting = iota
+	// RedisRoutingPattern subscribes to the channels of all users using a single pattern. Every node receives every
+	// message, and discards the ones intended for users it doesn't host.
+	RedisRoutingPattern
+)
+
+const (
+	// subscriberPingInterval is the interval at which the subscriber pings the Redis server. The subscriber connection
+	// is considered dead if nothing is received for twice this interval.
+	subscriberPingInterval = 15 * time.Second
+	// subscribeTimeout is the maximum duration for which Register waits for the subscription to the channel of the
+	// user to be confirmed.
+	subscribeTimeout = 5 * time.Second
+)
+
+// A redisSubscription tracks the connection of the subscriber of a RedisBroker, and the channels whose subscription
+// wasn't confirmed yet. The zero value is a disconnected subscription.
+type redisSubscription struct {
+	mu      sync.Mutex
+	conn    *redis.PubSubConn
+	pending map[string][]chan struct{}
+}
+
+// subscribe subscribes to the given channel, and returns a channel closed once the subscription is confirmed. It
+// returns nil while the subscriber is disconnected: all the channels are subscribed again when it reconnects. The caller
+// must hold s.mu.
+func (s *redisSubscription) subscribe(channel string) <-chan struct{} {
+	if s.conn == nil {
+		return nil
+	}
+	if err := s.conn.Subscribe(channel); err != nil {
+		return nil
+	}
+	if s.pending == nil {
+		s.pending = make(map[string][]chan struct{})
+	}
+	confirmed := make(chan struct{})
+	s.pending[channel] = append(s.pending[channel], confirmed)
+	return confirmed
+}
+
+// unsubscribe unsubscribes from the given channel. The caller must hold s.mu.
+func (s *redisSubscription) unsubscribe(channel string) {
+	if s.conn != nil {
+		s.conn.Unsubscribe(channel)
+	}
+}
+
+// confirm signals that the subscription to the given channel is confirmed.
+func (s *redisSubscription) confirm(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, confirmed := range s.pending[channel] {
+		close(confirmed)
+	}
+	delete(s.pending, channel)
+}
+
+// reset marks the subscription as disconnected, and releases the callers waiting for a confirmation.
+func (s *redisSubscription) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = nil
+	for _, pending := range s.pending {
+		for _, confirmed := range pending {
+			close(confirmed)
+		}
+	}
+	s.pending = nil
+}
+
+// channels returns all the channels the subscriber must be subscribed to when using RedisRoutingTargeted.
+func (b *RedisBroker) channels() []string {
+	var channels []string
+	for _, userID := range b.clients.userIDs() {
+		channels = append(channels, messageChannel(userID))
+	}
+	for _, userID := range b.presence.userIDs() {
+		channels = append(channels, presenceChannel(userID))
+	}
+	return channels
+}
+
+// addClient adds the given Client to the registry, and subscribes to the channel of its user if it is the first
+// session of this node. It returns a channel closed once the subscription is confirmed, or nil if there is nothing to
+// wait for.
+func (b *RedisBroker) addClient(client *Client) <-chan struct{} {
+	b.subscription.mu.Lock()
+	defer b.subscription.mu.Unlock()
+	if !b.clients.add(client) || b.Routing != RedisRoutingTargeted {
+		return nil
+	}
+	return b.subscription.subscribe(messageChannel(client.ID))
+}
+
+// removeClient removes the given Client from the registry and from the presence subscriptions, and unsubscribes from
+// the channels no other Client of this node needs.
+func (b *RedisBroker) removeClient(client *Client) {
+	b.subscription.mu.Lock()
+	defer b.subscription.mu.Unlock()
+	last := b.clients.remove(client)
+	unwatched := b.presence.removeAll(client)
+	if b.Routing != RedisRoutingTargeted {
+		return
+	}
+	if last {
+		b.subscription.unsubscribe(messageChannel(client.ID))
+	}
+	for _, userID := range unwatched {
+		b.subscription.unsubscribe(presenceChannel(userID))
+	}
+}
+
+// addPresenceSubscriptions subscribes the given Client to the presence of the given users, and subscribes to the
+// presence channels of the users no other Client of this node watched. It returns the channels closed once these
+// subscriptions are confirmed.
+func (b *RedisBroker) addPresenceSubscriptions(client *Client, userIDs []uuid.UUID) []<-chan struct{} {
+	b.subscription.mu.Lock()
+	defer b.subscription.mu.Unlock()
+	var confirmations []<-chan struct{}
+	for _, userID := range userIDs {
+		if b.presence.add(userID, client) && b.Routing == RedisRoutingTargeted {
+			confirmations = append(confirmations, b.subscription.subscribe(presenceChannel(userID)))
+		}
+	}
+	return confirmations
+}
+
+// removePresenceSubscriptions unsubscribes the given Client from the presence of the given users, and unsubscribes
+// from the presence channels no other Client of this node needs.
+func (b *RedisBroker) removePresenceSubscriptions(client *Client, userIDs []uuid.UUID) {
+	b.subscription.mu.Lock()
+	defer b.subscription.mu.Unlock()
+	for _, userID := range userIDs {
+		if b.presence.remove(userID, client) && b.Routing == RedisRoutingTargeted {
+			b.subscription.unsubscribe(presenceChannel(userID))
+		}
+	}
+}
+
+// waitSubscribed waits for the given subscriptions to be confirmed, for at most subscribeTimeout.
+func (b *RedisBroker) waitSubscribed(confirmations ...<-chan struct{}) {
+	timeout := time.After(subscribeTimeout)
+	for _, confirmed := range confirmations {
+		if confirmed == nil {
+			continue
+		}
+		select {
+		case <-confirmed:
+		case <-timeout:
+			b.Log.Warn("Timed out waiting for the confirmation of a Redis subscription")
+			return
+		}
+	}
+}
+
+// A redisPingConn is a connection used by a redis.PubSubConn, which may not be subscribed to any channel. It turns the
+// answers to the pings sent outside of the subscribed state into pong notifications.
+type redisPingConn struct {
+	redis.Conn
+}
+
+// Receive receives a single reply from the Redis server.
+func (c redisPingConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	switch reply := reply.(type) {
+	case string:
+		return []interface{}{[]byte("pong"), []byte(nil)}, err
+	case []byte:
+		return []interface{}{[]byte("pong"), reply}, err
+	}
+	return reply, err
+}
+
+// PumpMessages subscribes to the channels required by the Routing of the Broker using the given connection, reads all
+// incoming messages and sends them into the given channel. It returns when the connection fails, or nil once ctx is
+// done. The server is pinged every subscriberPingInterval, so that a dead connection is detected by its read timeout.
+// The Broker is marked as subscribed once the subscription is confirmed, or right away if there is nothing to subscribe
+// to yet, and the caller must reset it after PumpMessages returns.
+func (b *RedisBroker) PumpMessages(ctx context.Context, conn redis.PubSubConn, out chan<- *redis.Message) error {
+	conn.Conn = redisPingConn{conn.Conn}
+	b.subscription.mu.Lock()
+	var err error
+	if b.Routing == RedisRoutingPattern {
+		err = conn.PSubscribe(RedisBrokerPrefix + "*")
+	} else if channels := b.channels(); len(channels) != 0 {
+		err = conn.Subscribe(redis.Args{}.AddFlat(channels)...)
+	} else {
+		b.markSubscribed()
+	}
+	if err == nil {
+		b.subscription.conn = &conn
+	}
+	b.subscription.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer b.subscription.reset()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(subscriberPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.subscription.mu.Lock()
+				err := conn.Ping("")
+				b.subscription.mu.Unlock()
+				if err != nil {
+					return
+				}
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		var received *redis.Message
+		switch n := conn.Receive().(type) {
+		case redis.Subscription:
+			if n.Kind == "subscribe" {
+				b.subscription.confirm(n.Channel)
+			}
+			if n.Kind == "psubscribe" || n.Kind == "subscribe" {
+				b.markSubscribed()
+			}
+		case redis.Message:
+			received = &n
+		case redis.PMessage:
+			received = &redis.Message{Channel: n.Channel, Data: n.Data}
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return n
+		}
+		if received == nil {
+			continue
+		}
+		b.Log.
+			WithField("channel", received.Channel).
+			Info("Received message")
+		select {
+		case out <- received:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// markSubscribed marks the Broker as subscribed, once the first subscription of a new connection of the subscriber was
+// confirmed.
+func (b *RedisBroker) markSubscribed() {
+	if atomic.CompareAndSwapInt32(&b.subscribed, 0, 1) {
+		b.Log.Info("Subscribed to Redis channels")
+	}
+}
+
+// subscribe keeps the subscriber connected until ctx is done. When the connection is lost, it reconnects with an
+// exponential backoff and subscribes again to all the channels.
+func (b *RedisBroker) subscribe(ctx context.Context, out chan<- *redis.Message) {
+	delay := b.ReconnectMinDelay
+	for {
+		conn, err := b.dial(redis.DialReadTimeout(2 * subscriberPingInterval))
+		if err == nil {
+			err = b.PumpMessages(ctx, redis.PubSubConn{Conn: conn}, out)
+			conn.Close()
+		}
+		if atomic.SwapInt32(&b.subscribed, 0) == 1 {
+			delay = b.ReconnectMinDelay
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		b.Log.
+			WithError(err).
+			WithField("retry_in", delay.String()).
+			Warn("Lost the subscription to Redis channels, reconnecting")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > b.ReconnectMaxDelay {
+			delay = b.ReconnectMaxDelay
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package texto
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisBroker_TargetedSubscriptions(t *testing.T) {
+	log := newLogger()
+	pubSubConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log:  log,
+		pool: newMockPool(redigomock.NewConn()),
+	}
+	broker.subscription.conn = &redis.PubSubConn{Conn: pubSubConn}
+	subscribe := pubSubConn.GenericCommand("SUBSCRIBE")
+	unsubscribe := pubSubConn.GenericCommand("UNSUBSCRIBE")
+	firstSession := NewClient(log, nil, &broker)
+	secondSession := NewClient(log, nil, &broker)
+	secondSession.ID = firstSession.ID
+	watched := uuid.NewV4()
+
+	assert.NotNil(t, broker.addClient(firstSession))
+	assert.Nil(t, broker.addClient(secondSession))
+	assert.Len(t, broker.addPresenceSubscriptions(secondSession, []uuid.UUID{watched}), 1)
+	assert.Empty(t, broker.addPresenceSubscriptions(firstSession, []uuid.UUID{watched}))
+	assert.Len(t, broker.channels(), 2)
+	broker.subscription.confirm("texto:" + firstSession.ID.String())
+	assert.Len(t, broker.subscription.pending, 1)
+
+	broker.removeClient(firstSession)
+	broker.removeClient(secondSession)
+	assert.Empty(t, broker.channels())
+	for {
+		if _, err := pubSubConn.Receive(); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, 2, pubSubConn.Stats(subscribe))
+	assert.Equal(t, 2, pubSubConn.Stats(unsubscribe))
+	broker.subscription.reset()
+	assert.Nil(t, broker.subscription.pending)
+}
+
+// startRedisNode starts polling a new RedisBroker connected to the given stub, and waits for its subscriber to be
+// connected.
+func startRedisNode(t testing.TB, ctx context.Context, stub *redisStub, routing RedisRouting) *RedisBroker {
+	broker, err := newRedisBroker(newLogger(), stub.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Routing = routing
+	go broker.Poll(ctx)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&broker.subscribed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the subscriber didn't connect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return broker
+}
+
+func TestRedisBroker_TargetedRouting(t *testing.T) {
+	stub := newRedisStub(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host := startRedisNode(t, ctx, stub, RedisRoutingTargeted)
+	other := startRedisNode(t, ctx, stub, RedisRoutingTargeted)
+	client := NewClient(newLogger(), nil, host)
+	host.waitSubscribed(host.addClient(client))
+
+	publisher, err := stub.dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer publisher.Close()
+	marshaled, _ := json.Marshal(&BrokerMessage{
+		MessageID:   uuid.NewV4(),
+		SenderID:    uuid.NewV4(),
+		RecipientID: client.ID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	})
+	receivers, err := redis.Int(publisher.Do("PUBLISH", messageChannel(client.ID), marshaled))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, receivers)
+	select {
+	case received := <-client.outboundChan:
+		assert.Equal(t, ReceiveMessageKind, received.Kind)
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	watcher := NewClient(newLogger(), nil, other)
+	other.addClient(watcher)
+	other.waitSubscribed(other.addPresenceSubscriptions(watcher, []uuid.UUID{client.ID})...)
+	receivers, err = redis.Int(publisher.Do("PUBLISH", presenceChannel(client.ID), "{}"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, receivers)
+
+	host.removeClient(client)
+	other.removeClient(watcher)
+	time.Sleep(10 * time.Millisecond)
+	receivers, err = redis.Int(publisher.Do("PUBLISH", messageChannel(client.ID), marshaled))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, receivers)
+}
+
+// BenchmarkRedisBroker_Routing compares the routing strategies of the RedisBroker, with several nodes sharing the same
+// server. The discarded/op metric is the number of messages received by a node not hosting their recipient.
+func BenchmarkRedisBroker_Routing(b *testing.B) {
+	for _, bench := range []struct {
+		name    string
+		routing RedisRouting
+	}{
+		{"Targeted", RedisRoutingTargeted},
+		{"Pattern", RedisRoutingPattern},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			benchmarkRedisRouting(b, bench.routing)
+		})
+	}
+}
+
+const (
+	benchmarkRedisNodes        = 4
+	benchmarkRedisUsersPerNode = 25
+)
+
+func benchmarkRedisRouting(b *testing.B, routing RedisRouting) {
+	stub := newRedisStub(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	delivered := make(chan struct{}, 1024)
+	var payloads [][]byte
+	var channels []string
+	for i := 0; i < benchmarkRedisNodes; i++ {
+		broker := startRedisNode(b, ctx, stub, routing)
+		for j := 0; j < benchmarkRedisUsersPerNode; j++ {
+			client := NewClient(newLogger(), nil, broker)
+			broker.waitSubscribed(broker.addClient(client))
+			payload, _ := json.Marshal(&BrokerMessage{
+				SenderID:    uuid.NewV4(),
+				RecipientID: client.ID,
+				Text:        "Lorem ipsum dolor sit amet...",
+			})
+			payloads = append(payloads, payload)
+			channels = append(channels, messageChannel(client.ID))
+			go func() {
+				for {
+					select {
+					case <-client.outboundChan:
+						delivered <- struct{}{}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+	}
+	publisher, err := stub.dial()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer publisher.Close()
+	discarded := droppedMessages.get(dropUnknownRecipient)
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			publisher.Send("PUBLISH", channels[i%len(channels)], payloads[i%len(payloads)])
+		}
+		publisher.Flush()
+	}()
+	for i := 0; i < b.N; i++ {
+		<-delivered
+	}
+	b.StopTimer()
+	b.ReportMetric((droppedMessages.get(dropUnknownRecipient)-discarded)/float64(b.N), "discarded/op")
+}
+
+func TestRedisPingConn(t *testing.T) {
+	stub := newRedisStub(t)
+	conn, err := stub.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pubSubConn := redis.PubSubConn{Conn: redisPingConn{conn}}
+	assert.Nil(t, pubSubConn.Ping(""))
+	assert.Equal(t, redis.Pong{}, pubSubConn.Receive())
+	assert.Nil(t, pubSubConn.Subscribe("texto:channel"))
+	assert.IsType(t, redis.Subscription{}, pubSubConn.Receive())
+	assert.Nil(t, pubSubConn.Ping("data"))
+	assert.Equal(t, redis.Pong{Data: "data"}, pubSubConn.Receive())
+}
@@ -0,0 +1,610 @@
+package texto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// DefaultSentinelPort is the port of the sentinels whose address doesn't specify one.
+	DefaultSentinelPort = "26379"
+	// sentinelTimeout bounds the time spent querying a single sentinel.
+	sentinelTimeout = 2 * time.Second
+	// redisClusterSlots is the number of hash slots of a Redis Cluster.
+	redisClusterSlots = 16384
+	// redisClusterMaxRedirects is the number of MOVED or ASK redirections followed by a command before giving up.
+	redisClusterMaxRedirects = 5
+)
+
+var (
+	// ErrNoSentinel is returned when none of the sentinels of a sentinel:// URL could be reached.
+	ErrNoSentinel = errors.New("redis: no sentinel is reachable")
+	// ErrTooManyRedirects is returned when a command sent to a Redis Cluster was redirected too many times.
+	ErrTooManyRedirects = errors.New("redis: too many cluster redirections")
+)
+
+// newRedisDialer returns a function opening connections to the Redis deployment described by the given address, which
+// is either a plain "host:port" address or one of the following URLs:
+//
+//	redis://[:password@]host[:port][/db]
+//	rediss://[:password@]host[:port][/db]
+//	sentinel://[:password@]host[:port][,host[:port]...]/master[/db]
+//	redis+cluster://[:password@]host:port[,host:port...]
+//
+// The rediss:// scheme uses TLS, and so do the sentinels:// and rediss+cluster:// schemes. The password is the one of
+// the Redis servers, the sentinels themselves are not authenticated.
+func newRedisDialer(addr string) (func(options ...redis.DialOption) (redis.Conn, error), error) {
+	if !strings.Contains(addr, "://") {
+		return func(options ...redis.DialOption) (redis.Conn, error) {
+			return redis.Dial("tcp", addr, options...)
+		}, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		return func(options ...redis.DialOption) (redis.Conn, error) {
+			return redis.DialURL(addr, options...)
+		}, nil
+	case "sentinel", "sentinels":
+		path := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(path) > 2 || len(path[0]) == 0 {
+			return nil, fmt.Errorf("redis: invalid sentinel URL path %q, expected /master[/db]", u.Path)
+		}
+		options, err := redisURLOptions(u, path[1:])
+		if err != nil {
+			return nil, err
+		}
+		sentinel := &redisSentinel{
+			addrs:   splitRedisHosts(u.Host, DefaultSentinelPort),
+			master:  path[0],
+			scheme:  strings.Replace(u.Scheme, "sentinel", "redis", 1),
+			options: options,
+		}
+		return sentinel.dial, nil
+	case "redis+cluster", "rediss+cluster":
+		if len(strings.Trim(u.Path, "/")) != 0 {
+			return nil, errors.New("redis: a cluster doesn't support database selection")
+		}
+		options, err := redisURLOptions(u, nil)
+		if err != nil {
+			return nil, err
+		}
+		cluster := &redisCluster{
+			seeds:   splitRedisHosts(u.Host, "6379"),
+			scheme:  strings.TrimSuffix(u.Scheme, "+cluster"),
+			options: options,
+		}
+		return cluster.dial, nil
+	}
+	return nil, fmt.Errorf("redis: unsupported URL scheme %q", u.Scheme)
+}
+
+// isRedisClusterURL reports whether the given address, in one of the forms accepted by newRedisDialer, is the one of a
+// Redis Cluster.
+func isRedisClusterURL(addr string) bool {
+	scheme := strings.SplitN(addr, "://", 2)[0]
+	return strings.Contains(addr, "://") && (scheme == "redis+cluster" || scheme == "rediss+cluster")
+}
+
+// redisURLOptions returns the options selecting the password and the database given in a URL.
+func redisURLOptions(u *url.URL, db []string) ([]redis.DialOption, error) {
+	var options []redis.DialOption
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options = append(options, redis.DialPassword(password))
+		}
+	}
+	if len(db) != 0 && len(db[0]) != 0 {
+		index, err := strconv.Atoi(db[0])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid database %q", db[0])
+		}
+		options = append(options, redis.DialDatabase(index))
+	}
+	return options, nil
+}
+
+// splitRedisHosts splits a comma-separated list of addresses, adding the given port to the ones without one.
+func splitRedisHosts(hosts, defaultPort string) []string {
+	var addrs []string
+	for _, host := range strings.Split(hosts, ",") {
+		if len(host) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, defaultPort)
+		}
+		addrs = append(addrs, host)
+	}
+	return addrs
+}
+
+// appendDialOptions returns the concatenation of the given option lists, without modifying them.
+func appendDialOptions(options []redis.DialOption, extra ...redis.DialOption) []redis.DialOption {
+	return append(append([]redis.DialOption(nil), options...), extra...)
+}
+
+// A redisSentinel opens connections to the current master of a group monitored by Redis Sentinel. The sentinels are
+// asked for the address of the master every time a connection is opened, so that new connections follow failovers.
+type redisSentinel struct {
+	mu      sync.Mutex
+	addrs   []string
+	master  string
+	scheme  string
+	options []redis.DialOption
+}
+
+// dial opens a connection to the current master, and checks that the server is indeed a master.
+func (s *redisSentinel) dial(options ...redis.DialOption) (redis.Conn, error) {
+	addr, err := s.masterAddr(options)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := redis.DialURL(s.scheme+"://"+addr, appendDialOptions(s.options, options...)...)
+	if err != nil {
+		return nil, err
+	}
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err == nil && (len(role) == 0 || fmt.Sprintf("%s", role[0]) != "master") {
+		err = fmt.Errorf("redis: %s is not the master of %s", addr, s.master)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &redisSentinelConn{Conn: conn}, nil
+}
+
+// masterAddr asks the sentinels for the address of the master, in turn. The first sentinel that answers is moved to
+// the front of the list, so that it is asked first next time.
+func (s *redisSentinel) masterAddr(options []redis.DialOption) (string, error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+	err := ErrNoSentinel
+	for i, addr := range addrs {
+		var master string
+		master, err = s.queryMaster(addr, options)
+		if err != nil {
+			continue
+		}
+		if i != 0 {
+			s.mu.Lock()
+			s.addrs = append([]string{addr}, append(addrs[:i:i], addrs[i+1:]...)...)
+			s.mu.Unlock()
+		}
+		return master, nil
+	}
+	return "", err
+}
+
+// queryMaster asks the sentinel at the given address for the address of the master.
+func (s *redisSentinel) queryMaster(addr string, options []redis.DialOption) (string, error) {
+	conn, err := redis.DialURL(s.scheme+"://"+addr, appendDialOptions(
+		options,
+		redis.DialConnectTimeout(sentinelTimeout),
+		redis.DialReadTimeout(sentinelTimeout),
+		redis.DialWriteTimeout(sentinelTimeout),
+	)...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.master))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("redis: sentinel %s doesn't know the master %s", addr, s.master)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("redis: invalid reply of sentinel %s: %q", addr, reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// A redisSentinelConn is a connection to a master found by a redisSentinel. It reports an error once the server refuses
+// writes, which happens when it was demoted by a failover, so that the connection is discarded by its pool.
+type redisSentinelConn struct {
+	redis.Conn
+	mu  sync.Mutex
+	err error
+}
+
+// Do is the implementation of redis.Conn.Do for redisSentinelConn.
+func (c *redisSentinelConn) Do(command string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(command, args...)
+	c.check(err)
+	return reply, err
+}
+
+// Receive is the implementation of redis.Conn.Receive for redisSentinelConn.
+func (c *redisSentinelConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+// Err is the implementation of redis.Conn.Err for redisSentinelConn.
+func (c *redisSentinelConn) Err() error {
+	if err := c.Conn.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// check records the given error if it means that the server is not the master anymore.
+func (c *redisSentinelConn) check(err error) {
+	if err, ok := err.(redis.Error); ok && strings.HasPrefix(string(err), "READONLY") {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+	}
+}
+
+// A redisCluster opens connections to a Redis Cluster. The map of the hash slots is shared by its connections, loaded
+// from the first reachable seed node and updated when a command is redirected.
+type redisCluster struct {
+	mu      sync.RWMutex
+	seeds   []string
+	scheme  string
+	options []redis.DialOption
+	loaded  bool
+	slots   [redisClusterSlots]string
+}
+
+// dial opens a connection to the cluster.
+func (c *redisCluster) dial(options ...redis.DialOption) (redis.Conn, error) {
+	conn := &redisClusterConn{
+		cluster: c,
+		options: appendDialOptions(c.options, options...),
+		nodes:   make(map[string]redis.Conn),
+	}
+	var err error
+	for _, seed := range c.seeds {
+		if conn.main, err = conn.node(seed); err == nil {
+			break
+		}
+	}
+	if conn.main == nil {
+		if err == nil {
+			err = errors.New("redis: no cluster node given")
+		}
+		return nil, err
+	}
+	c.mu.RLock()
+	loaded := c.loaded
+	c.mu.RUnlock()
+	if !loaded {
+		if err := c.loadSlots(conn.main); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// loadSlots loads the map of the hash slots from the given node.
+func (c *redisCluster) loadSlots(conn redis.Conn) error {
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, value := range ranges {
+		fields, err := redis.Values(value, nil)
+		if err != nil || len(fields) < 3 {
+			return fmt.Errorf("redis: invalid CLUSTER SLOTS reply %v", value)
+		}
+		var start, end int
+		var host string
+		var port int
+		master, err := redis.Values(fields[2], nil)
+		if err == nil && len(master) < 2 {
+			err = errors.New("missing master address")
+		}
+		if err == nil {
+			_, err = redis.Scan(append(fields[:2:2], master[:2]...), &start, &end, &host, &port)
+		}
+		if err != nil || start < 0 || end >= redisClusterSlots {
+			return fmt.Errorf("redis: invalid CLUSTER SLOTS reply %v", value)
+		}
+		for slot := start; slot <= end; slot++ {
+			c.slots[slot] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+	c.loaded = true
+	return nil
+}
+
+// slotAddr returns the address of the node serving the given slot, or an empty string if it is unknown.
+func (c *redisCluster) slotAddr(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[slot]
+}
+
+// moveSlot records that the given slot is now served by the node at the given address.
+func (c *redisCluster) moveSlot(slot int, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slots[slot] = addr
+}
+
+// A redisClusterConn is a connection to a Redis Cluster, made of a connection to each of the nodes it talked to. The
+// commands operating on a key are sent to the node serving its hash slot, and the other ones to the main node. Pub/Sub
+// works with any node, since the messages published on a cluster are broadcast to all its nodes.
+type redisClusterConn struct {
+	cluster *redisCluster
+	options []redis.DialOption
+	main    redis.Conn
+	nodes   map[string]redis.Conn
+	// pending lists the commands written by Send whose replies weren't received yet, in order.
+	pending []redisClusterCommand
+}
+
+// A redisClusterCommand is a command sent to a node of a Redis Cluster, whose reply wasn't received yet.
+type redisClusterCommand struct {
+	conn redis.Conn
+	// The hash slot of the key of the command, or -1 if it has no key.
+	slot int
+}
+
+// node returns the connection to the node at the given address, opening it if needed.
+func (c *redisClusterConn) node(addr string) (redis.Conn, error) {
+	if conn, ok := c.nodes[addr]; ok && conn.Err() == nil {
+		return conn, nil
+	}
+	conn, err := redis.DialURL(c.cluster.scheme+"://"+addr, c.options...)
+	if err != nil {
+		return nil, err
+	}
+	if previous, ok := c.nodes[addr]; ok {
+		previous.Close()
+	}
+	c.nodes[addr] = conn
+	return conn, nil
+}
+
+// slotConn returns the connection to the node at the given address, or the main connection if it is empty.
+func (c *redisClusterConn) slotConn(addr string) (redis.Conn, error) {
+	if len(addr) == 0 {
+		return c.main, nil
+	}
+	return c.node(addr)
+}
+
+// commandSlot returns the hash slot of the key on which the given command operates, or -1 if it has no key.
+func commandSlot(command string, args []interface{}) int {
+	key, ok := redisCommandKey(command, args)
+	if !ok {
+		return -1
+	}
+	return redisSlot(key)
+}
+
+// parseRedirect returns the address given by a MOVED or ASK redirection, and whether it is an ASK redirection.
+func parseRedirect(err error) (addr string, asking bool, ok bool) {
+	redirect, ok := err.(redis.Error)
+	if !ok {
+		return "", false, false
+	}
+	fields := strings.Fields(string(redirect))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", false, false
+	}
+	return fields[2], fields[0] == "ASK", true
+}
+
+// Do is the implementation of redis.Conn.Do for redisClusterConn. It receives the replies of the commands written by
+// Send first, and follows the MOVED and ASK redirections.
+func (c *redisClusterConn) Do(command string, args ...interface{}) (interface{}, error) {
+	pendingErr := c.receivePending()
+	if command == "" {
+		return nil, pendingErr
+	}
+	slot := commandSlot(command, args)
+	if slot < 0 {
+		reply, err := c.main.Do(command, args...)
+		if err == nil {
+			err = pendingErr
+		}
+		return reply, err
+	}
+	addr := c.cluster.slotAddr(slot)
+	asking := false
+	for redirects := 0; redirects <= redisClusterMaxRedirects; redirects++ {
+		conn, err := c.slotConn(addr)
+		if err != nil {
+			return nil, err
+		}
+		if asking {
+			if _, err := conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := conn.Do(command, args...)
+		var redirected bool
+		if addr, asking, redirected = parseRedirect(err); !redirected {
+			if err == nil {
+				err = pendingErr
+			}
+			return reply, err
+		}
+		if !asking {
+			c.cluster.moveSlot(slot, addr)
+		}
+	}
+	return nil, ErrTooManyRedirects
+}
+
+// receivePending flushes the commands written by Send and receives their replies. It returns the first error among
+// them, as redis.Conn.Do does.
+func (c *redisClusterConn) receivePending() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	var err error
+	if flushErr := c.Flush(); flushErr != nil {
+		err = flushErr
+	}
+	for len(c.pending) != 0 {
+		if _, receiveErr := c.Receive(); err == nil {
+			err = receiveErr
+		}
+	}
+	return err
+}
+
+// Send is the implementation of redis.Conn.Send for redisClusterConn. The command is written to the node serving the
+// hash slot of its key, as known when it is sent: pipelined commands don't follow redirections, but update the map of
+// the hash slots.
+func (c *redisClusterConn) Send(command string, args ...interface{}) error {
+	slot := commandSlot(command, args)
+	addr := ""
+	if slot >= 0 {
+		addr = c.cluster.slotAddr(slot)
+	}
+	conn, err := c.slotConn(addr)
+	if err != nil {
+		return err
+	}
+	if err := conn.Send(command, args...); err != nil {
+		return err
+	}
+	c.pending = append(c.pending, redisClusterCommand{conn: conn, slot: slot})
+	return nil
+}
+
+// Flush is the implementation of redis.Conn.Flush for redisClusterConn. It flushes the connections to which commands
+// were written, or the main connection if there are none.
+func (c *redisClusterConn) Flush() error {
+	if len(c.pending) == 0 {
+		return c.main.Flush()
+	}
+	var err error
+	flushed := make(map[redis.Conn]bool)
+	for _, command := range c.pending {
+		if flushed[command.conn] {
+			continue
+		}
+		flushed[command.conn] = true
+		if flushErr := command.conn.Flush(); flushErr != nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Receive is the implementation of redis.Conn.Receive for redisClusterConn. It receives the reply of the oldest pending
+// command from the node it was sent to, or the next Pub/Sub message from the main node if no command is pending.
+func (c *redisClusterConn) Receive() (interface{}, error) {
+	if len(c.pending) == 0 {
+		return c.main.Receive()
+	}
+	command := c.pending[0]
+	c.pending = c.pending[1:]
+	reply, err := command.conn.Receive()
+	if addr, asking, ok := parseRedirect(err); ok && !asking && command.slot >= 0 {
+		c.cluster.moveSlot(command.slot, addr)
+	}
+	return reply, err
+}
+
+// Err is the implementation of redis.Conn.Err for redisClusterConn. It returns the error of any of the connections to
+// the nodes, so that the pool discards the connection.
+func (c *redisClusterConn) Err() error {
+	if err := c.main.Err(); err != nil {
+		return err
+	}
+	for _, conn := range c.nodes {
+		if err := conn.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is the implementation of redis.Conn.Close for redisClusterConn.
+func (c *redisClusterConn) Close() error {
+	var err error
+	for _, conn := range c.nodes {
+		if closeErr := conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// redisCommandKey returns the key on which the given command operates, if any.
+func redisCommandKey(command string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(command) {
+	case "", "PING", "ECHO", "AUTH", "SELECT", "PUBLISH", "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE",
+		"SCRIPT", "CLUSTER", "INFO", "ROLE", "ASKING":
+		return "", false
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return "", false
+		}
+		if redisArgString(args[1]) == "0" {
+			return "", false
+		}
+		return redisArgString(args[2]), true
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return redisArgString(args[0]), true
+}
+
+// redisArgString returns the string representation of a command argument.
+func redisArgString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	}
+	return fmt.Sprint(arg)
+}
+
+// redisSlot returns the hash slot of the given key. Only the part between the first braces is hashed, if it is not
+// empty, so that related keys can be stored on the same node.
+func redisSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % redisClusterSlots
+}
+
+// crc16 returns the CRC16-CCITT (XMODEM) checksum of the given data, as used by Redis Cluster.
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,425 @@
+package texto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTLSConfigs returns the TLS configurations of a server using a self-signed certificate for 127.0.0.1, and of a
+// client trusting it.
+func newTestTLSConfigs(t testing.TB) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: roots}
+}
+
+// A stubCommands records the arguments of the commands received by a redisStub, by command.
+type stubCommands struct {
+	mu   sync.Mutex
+	args map[string][]string
+}
+
+// newStubCommands returns a stubCommands replying OK to the given commands of the given stub.
+func newStubCommands(stub *redisStub, commands ...string) *stubCommands {
+	s := &stubCommands{args: make(map[string][]string)}
+	for _, command := range commands {
+		command := command
+		stub.handle(command, func(conn *redisStubConn, args []string) {
+			s.record(command, args)
+			conn.reply(redisStubStatus("OK"))
+		})
+	}
+	return s
+}
+
+// record records the arguments of the given command.
+func (s *stubCommands) record(command string, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.args[command] = args
+}
+
+// get returns the arguments of the last given command received.
+func (s *stubCommands) get(command string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.args[command]
+}
+
+func TestNewRedisDialer(t *testing.T) {
+	stub := newRedisStub(t)
+	commands := newStubCommands(stub, "AUTH", "SELECT")
+	for _, addr := range []string{stub.addr(), "redis://" + stub.addr(), "redis://:secret@" + stub.addr() + "/3"} {
+		dial, err := newRedisDialer(addr)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		conn, err := dial()
+		if !assert.Nil(t, err) {
+			continue
+		}
+		_, err = conn.Do("PING")
+		assert.Nil(t, err)
+		conn.Close()
+	}
+	assert.Equal(t, []string{"secret"}, commands.get("AUTH"))
+	assert.Equal(t, []string{"3"}, commands.get("SELECT"))
+
+	for _, addr := range []string{
+		"unix://" + stub.addr(),
+		"sentinel://" + stub.addr(),
+		"sentinel://" + stub.addr() + "/master/zero",
+		"redis+cluster://" + stub.addr() + "/1",
+	} {
+		_, err := newRedisDialer(addr)
+		assert.NotNil(t, err, addr)
+	}
+}
+
+func TestNewRedisDialer_TLS(t *testing.T) {
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+	stub := newRedisTLSStub(t, serverConfig)
+	dial, err := newRedisDialer("rediss://" + stub.addr())
+	if !assert.Nil(t, err) {
+		return
+	}
+	conn, err := dial(redis.DialTLSConfig(clientConfig))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	pong, err := redis.String(conn.Do("PING"))
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+
+	_, err = dial()
+	assert.NotNil(t, err)
+}
+
+// A sentinelGroup is a group of Redis servers monitored by a stub sentinel.
+type sentinelGroup struct {
+	mu       sync.Mutex
+	sentinel *redisStub
+	servers  []*redisStub
+	master   int
+}
+
+// newSentinelGroup starts a sentinel monitoring the given number of servers under the name "mymaster". The first
+// server is the master, and the other ones refuse writes.
+func newSentinelGroup(t *testing.T, size int) *sentinelGroup {
+	group := &sentinelGroup{sentinel: newRedisStub(t)}
+	group.sentinel.handle("SENTINEL", func(conn *redisStubConn, args []string) {
+		if len(args) != 2 || args[0] != "get-master-addr-by-name" || args[1] != "mymaster" {
+			conn.reply(nil)
+			return
+		}
+		group.mu.Lock()
+		host, port, _ := net.SplitHostPort(group.servers[group.master].addr())
+		group.mu.Unlock()
+		conn.reply([]string{host, port})
+	})
+	for i := 0; i < size; i++ {
+		i := i
+		server := newRedisStub(t)
+		server.handle("ROLE", func(conn *redisStubConn, args []string) {
+			if group.isMaster(i) {
+				conn.reply([]interface{}{"master", int64(0), []interface{}{}})
+			} else {
+				conn.reply([]interface{}{"slave", "127.0.0.1", int64(6379), "connected", int64(0)})
+			}
+		})
+		server.handle("SET", func(conn *redisStubConn, args []string) {
+			if group.isMaster(i) {
+				conn.reply(redisStubStatus("OK"))
+			} else {
+				conn.reply(errors.New("READONLY You can't write against a read only replica."))
+			}
+		})
+		group.servers = append(group.servers, server)
+	}
+	return group
+}
+
+// isMaster reports whether the given server is the current master.
+func (g *sentinelGroup) isMaster(server int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.master == server
+}
+
+// failover promotes the given server.
+func (g *sentinelGroup) failover(server int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.master = server
+}
+
+func TestNewRedisDialer_Sentinel(t *testing.T) {
+	group := newSentinelGroup(t, 2)
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	down.Close()
+	dial, err := newRedisDialer(fmt.Sprintf("sentinel://%s,%s/mymaster", down.Addr(), group.sentinel.addr()))
+	if !assert.Nil(t, err) {
+		return
+	}
+	conn, err := dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Do("SET", "key", "value")
+	assert.Nil(t, err)
+	assert.Nil(t, conn.Err())
+
+	group.failover(1)
+	_, err = conn.Do("SET", "key", "value")
+	assert.NotNil(t, err)
+	assert.NotNil(t, conn.Err())
+	promoted, err := dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer promoted.Close()
+	_, err = promoted.Do("SET", "key", "value")
+	assert.Nil(t, err)
+
+	unknown, err := newRedisDialer("sentinel://" + group.sentinel.addr() + "/unknown")
+	if assert.Nil(t, err) {
+		_, err = unknown()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestNewRedisBroker_Sentinel(t *testing.T) {
+	group := newSentinelGroup(t, 1)
+	broker, err := NewRedisBroker(newLogger(), "sentinel://"+group.sentinel.addr()+"/mymaster")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, broker.pool.Close())
+}
+
+func TestNewRedisDialer_Cluster(t *testing.T) {
+	// The cluster is made of two nodes serving half of the slots each, but node 0 advertises every slot. It redirects
+	// the commands for the second half with MOVED, except for the migrating slot, which it redirects with ASK.
+	nodes := []*redisStub{newRedisStub(t), newRedisStub(t)}
+	received := []*stubCommands{newStubCommands(nodes[0]), newStubCommands(nodes[1])}
+	host, port, _ := net.SplitHostPort(nodes[0].addr())
+	portNumber, _ := net.LookupPort("tcp", port)
+	slots := []interface{}{
+		[]interface{}{int64(0), int64(redisClusterSlots - 1), []interface{}{host, int64(portNumber), "node0"}},
+	}
+	owner := func(key string) int {
+		return redisSlot(key) * len(nodes) / redisClusterSlots
+	}
+	var keys [2][]string
+	for i := 0; len(keys[0]) < 3 || len(keys[1]) < 4; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		keys[owner(key)] = append(keys[owner(key)], key)
+	}
+	migrating := keys[1][3]
+	keys[1] = keys[1][:3]
+	for i, node := range nodes {
+		i := i
+		node.handle("SET", func(conn *redisStubConn, args []string) {
+			switch slot := redisSlot(args[0]); {
+			case owner(args[0]) != i && args[0] == migrating:
+				conn.reply(fmt.Errorf("ASK %d %s", slot, nodes[owner(args[0])].addr()))
+			case owner(args[0]) != i:
+				conn.reply(fmt.Errorf("MOVED %d %s", slot, nodes[owner(args[0])].addr()))
+			default:
+				received[i].record("SET "+args[0], args[1:])
+				conn.reply(redisStubStatus("OK"))
+			}
+		})
+		node.handle("ASKING", func(conn *redisStubConn, args []string) {
+			received[i].record("ASKING", args)
+			conn.reply(redisStubStatus("OK"))
+		})
+		node.handle("CLUSTER", func(conn *redisStubConn, args []string) {
+			conn.reply(slots)
+		})
+	}
+	dial, err := newRedisDialer("redis+cluster://" + nodes[0].addr())
+	if !assert.Nil(t, err) {
+		return
+	}
+	conn, err := dial()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	cluster := conn.(*redisClusterConn).cluster
+
+	for i := range keys {
+		for _, key := range keys[i] {
+			_, err := conn.Do("SET", key, "value")
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"value"}, received[i].get("SET "+key))
+			assert.Nil(t, received[1-i].get("SET "+key))
+		}
+	}
+	assert.Equal(t, nodes[1].addr(), cluster.slotAddr(redisSlot(keys[1][0])))
+
+	assert.Nil(t, received[1].get("ASKING"))
+	_, err = conn.Do("SET", migrating, "value")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"value"}, received[1].get("SET "+migrating))
+	assert.NotNil(t, received[1].get("ASKING"))
+	assert.Equal(t, nodes[0].addr(), cluster.slotAddr(redisSlot(migrating)))
+
+	pong, err := redis.String(conn.Do("PING"))
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+
+	assert.Nil(t, conn.Send("SET", keys[1][1], "pipelined"))
+	assert.Nil(t, conn.Send("PING"))
+	assert.Nil(t, conn.Send("SET", keys[0][1], "pipelined"))
+	assert.Nil(t, conn.Flush())
+	for _, expected := range []string{"OK", "PONG", "OK"} {
+		reply, err := redis.String(conn.Receive())
+		assert.Nil(t, err)
+		assert.Equal(t, expected, reply)
+	}
+	assert.Equal(t, []string{"pipelined"}, received[1].get("SET "+keys[1][1]))
+	assert.Equal(t, []string{"pipelined"}, received[0].get("SET "+keys[0][1]))
+
+	assert.Nil(t, conn.Send("SET", keys[1][2], "pending"))
+	_, err = conn.Do("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"pending"}, received[1].get("SET "+keys[1][2]))
+	assert.Nil(t, conn.Err())
+}
+
+// newRedisClusterStub returns a stub of a Redis Cluster made of a single node serving every slot. Like a real cluster,
+// it rejects the scripts whose keys don't hash to the same slot, and passes the keys and the arguments of the other
+// ones to the given function.
+func newRedisClusterStub(t testing.TB, script func(conn *redisStubConn, keys []string, args []string)) *redisStub {
+	stub := newRedisStub(t)
+	host, port, _ := net.SplitHostPort(stub.addr())
+	portNumber, _ := net.LookupPort("tcp", port)
+	stub.handle("CLUSTER", func(conn *redisStubConn, args []string) {
+		conn.reply([]interface{}{
+			[]interface{}{int64(0), int64(redisClusterSlots - 1), []interface{}{host, int64(portNumber), "node0"}},
+		})
+	})
+	eval := func(conn *redisStubConn, args []string) {
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count > len(args)-2 {
+			conn.reply(errors.New("ERR Number of keys can't be greater than number of args"))
+			return
+		}
+		keys := args[2 : 2+count]
+		for _, key := range keys {
+			if redisSlot(key) != redisSlot(keys[0]) {
+				conn.reply(errors.New("CROSSSLOT Keys in request don't hash to the same slot"))
+				return
+			}
+		}
+		script(conn, keys, args[2+count:])
+	}
+	stub.handle("EVAL", eval)
+	stub.handle("EVALSHA", eval)
+	return stub
+}
+
+func TestRedisBroker_SendRoomCluster(t *testing.T) {
+	roomID := uuid.NewV4()
+	sender := uuid.NewV4()
+	members := []uuid.UUID{uuid.NewV4(), uuid.NewV4()}
+	var mu sync.Mutex
+	var recipients []string
+	stub := newRedisClusterStub(t, func(conn *redisStubConn, keys []string, args []string) {
+		mu.Lock()
+		recipients = append(recipients, keys[0])
+		mu.Unlock()
+		conn.reply(int64(1))
+	})
+	stub.handle("SMEMBERS", func(conn *redisStubConn, args []string) {
+		conn.reply([]interface{}{sender.String(), members[0].String(), members[1].String()})
+	})
+	broker, err := NewRedisBroker(newLogger(), "redis+cluster://"+stub.addr())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer broker.pool.Close()
+
+	assert.Nil(t, broker.SendRoom(&BrokerMessage{SenderID: sender, RecipientID: roomID, RoomID: roomID, Text: "Hello"}))
+	expected := []string{sessionsKey(members[0]), sessionsKey(members[1])}
+	sort.Strings(expected)
+	sort.Strings(recipients)
+	assert.Equal(t, expected, recipients)
+}
+
+func TestRedisSlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31C3), crc16("123456789"))
+	assert.Equal(t, 12182, redisSlot("foo"))
+	assert.Equal(t, redisSlot("user1000"), redisSlot("{user1000}.following"))
+	assert.Equal(t, redisSlot("{}.following"), redisSlot("{}.following"))
+	assert.NotEqual(t, redisSlot("{}a"), redisSlot("{}b"))
+	userID := uuid.NewV4()
+	assert.Equal(t, redisSlot(sessionsKey(userID)), redisSlot(mailboxKey(userID)))
+	assert.Equal(t, redisSlot(sessionsKey(userID)), redisSlot(lastSeenKey(userID)))
+}
+
+func TestRedisCommandKey(t *testing.T) {
+	for _, test := range []struct {
+		command string
+		args    []interface{}
+		key     string
+		ok      bool
+	}{
+		{"GET", []interface{}{"key"}, "key", true},
+		{"ZADD", []interface{}{[]byte("key"), 1, "member"}, "key", true},
+		{"EVALSHA", []interface{}{"sha", 2, "first", "second"}, "first", true},
+		{"EVAL", []interface{}{"return 1", 0}, "", false},
+		{"PUBLISH", []interface{}{"channel", "message"}, "", false},
+		{"PING", nil, "", false},
+	} {
+		key, ok := redisCommandKey(test.command, test.args)
+		assert.Equal(t, test.key, key, test.command)
+		assert.Equal(t, test.ok, ok, test.command)
+	}
+}
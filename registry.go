@@ -0,0 +1,175 @@
+package texto
+
+import (
+	"sync"
+
+	"github.com/satori/go.uuid"
+)
+
+// A clientRegistry indexes the Clients connected to the current node by user ID. A user may have several sessions open
+// at the same time, each one being represented by its own Client. The Clients are indexed by identity rather than by
+// session ID, since a resumed session shares its ID with the Client of the lost connection until it is unregistered.
+// The zero value is an empty registry ready to use.
+type clientRegistry struct {
+	mu      sync.RWMutex
+	clients map[uuid.UUID]map[*Client]struct{}
+}
+
+// add registers the given Client and reports whether it is the first session of its user on this node.
+func (r *clientRegistry) add(client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients == nil {
+		r.clients = make(map[uuid.UUID]map[*Client]struct{})
+	}
+	sessions, ok := r.clients[client.ID]
+	if !ok {
+		sessions = make(map[*Client]struct{})
+		r.clients[client.ID] = sessions
+	}
+	sessions[client] = struct{}{}
+	return !ok
+}
+
+// remove unregisters the given Client and reports whether it was the last session of its user on this node.
+func (r *clientRegistry) remove(client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions, ok := r.clients[client.ID]
+	if !ok {
+		return false
+	}
+	if _, ok := sessions[client]; !ok {
+		return false
+	}
+	delete(sessions, client)
+	if len(sessions) != 0 {
+		return false
+	}
+	delete(r.clients, client.ID)
+	return true
+}
+
+// sessions returns all the Clients of the given user connected to this node.
+func (r *clientRegistry) sessions(userID uuid.UUID) []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sessions := make([]*Client, 0, len(r.clients[userID]))
+	for client := range r.clients[userID] {
+		sessions = append(sessions, client)
+	}
+	return sessions
+}
+
+// userIDs returns the IDs of the users having at least one session on this node.
+func (r *clientRegistry) userIDs() []uuid.UUID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	userIDs := make([]uuid.UUID, 0, len(r.clients))
+	for userID := range r.clients {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// len returns the number of sessions registered on this node.
+func (r *clientRegistry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	length := 0
+	for _, sessions := range r.clients {
+		length += len(sessions)
+	}
+	return length
+}
+
+// A presenceRegistry indexes the Clients connected to the current node by the users whose presence they subscribed
+// to. The zero value is an empty registry ready to use.
+type presenceRegistry struct {
+	mu       sync.RWMutex
+	watchers map[uuid.UUID]map[*Client]struct{}
+	watched  map[*Client]map[uuid.UUID]struct{}
+}
+
+// add subscribes the given Client to the presence of the given user, and reports whether it is the first Client of this
+// node subscribed to it.
+func (r *presenceRegistry) add(userID uuid.UUID, client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.watchers == nil {
+		r.watchers = make(map[uuid.UUID]map[*Client]struct{})
+		r.watched = make(map[*Client]map[uuid.UUID]struct{})
+	}
+	_, watched := r.watchers[userID]
+	if !watched {
+		r.watchers[userID] = make(map[*Client]struct{})
+	}
+	r.watchers[userID][client] = struct{}{}
+	if _, ok := r.watched[client]; !ok {
+		r.watched[client] = make(map[uuid.UUID]struct{})
+	}
+	r.watched[client][userID] = struct{}{}
+	return !watched
+}
+
+// remove unsubscribes the given Client from the presence of the given user, and reports whether no Client of this node
+// is subscribed to it anymore.
+func (r *presenceRegistry) remove(userID uuid.UUID, client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.removeLocked(userID, client)
+}
+
+// removeAll unsubscribes the given Client from the presence of all users, and returns the IDs of the users to which no
+// Client of this node is subscribed anymore.
+func (r *presenceRegistry) removeAll(client *Client) []uuid.UUID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unwatched []uuid.UUID
+	for userID := range r.watched[client] {
+		if r.removeLocked(userID, client) {
+			unwatched = append(unwatched, userID)
+		}
+	}
+	return unwatched
+}
+
+// removeLocked unsubscribes the given Client from the presence of the given user, and reports whether no Client of
+// this node is subscribed to it anymore. The caller must hold r.mu.
+func (r *presenceRegistry) removeLocked(userID uuid.UUID, client *Client) bool {
+	if _, ok := r.watchers[userID][client]; !ok {
+		return false
+	}
+	delete(r.watchers[userID], client)
+	unwatched := len(r.watchers[userID]) == 0
+	if unwatched {
+		delete(r.watchers, userID)
+	}
+	delete(r.watched[client], userID)
+	if len(r.watched[client]) == 0 {
+		delete(r.watched, client)
+	}
+	return unwatched
+}
+
+// userIDs returns the IDs of the users to which at least one Client of this node is subscribed.
+func (r *presenceRegistry) userIDs() []uuid.UUID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	userIDs := make([]uuid.UUID, 0, len(r.watchers))
+	for userID := range r.watchers {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// subscribers returns the Clients subscribed to the presence of the given user.
+func (r *presenceRegistry) subscribers(userID uuid.UUID) []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subscribers := make([]*Client, 0, len(r.watchers[userID]))
+	for client := range r.watchers[userID] {
+		subscribers = append(subscribers, client)
+	}
+	return subscribers
+}
@@ -0,0 +1,57 @@
+package texto
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientRegistry(t *testing.T) {
+	var registry clientRegistry
+	log := newLogger()
+	firstSession := NewClient(log, nil, nil)
+	secondSession := NewClient(log, nil, nil)
+	secondSession.ID = firstSession.ID
+	otherUser := NewClient(log, nil, nil)
+
+	assert.True(t, registry.add(firstSession))
+	assert.False(t, registry.add(secondSession))
+	assert.True(t, registry.add(otherUser))
+	assert.Equal(t, 3, registry.len())
+	assert.Len(t, registry.sessions(firstSession.ID), 2)
+	assert.Len(t, registry.sessions(otherUser.ID), 1)
+
+	assert.False(t, registry.remove(firstSession))
+	assert.Len(t, registry.sessions(firstSession.ID), 1)
+	assert.True(t, registry.remove(secondSession))
+	assert.Empty(t, registry.sessions(firstSession.ID))
+	assert.False(t, registry.remove(secondSession))
+	assert.Equal(t, 1, registry.len())
+	assert.Equal(t, []uuid.UUID{otherUser.ID}, registry.userIDs())
+}
+
+func TestPresenceRegistry(t *testing.T) {
+	var registry presenceRegistry
+	log := newLogger()
+	watcher := NewClient(log, nil, nil)
+	otherWatcher := NewClient(log, nil, nil)
+	firstUser := uuid.NewV4()
+	secondUser := uuid.NewV4()
+
+	assert.True(t, registry.add(firstUser, watcher))
+	assert.True(t, registry.add(secondUser, watcher))
+	assert.False(t, registry.add(firstUser, otherWatcher))
+	assert.Len(t, registry.subscribers(firstUser), 2)
+	assert.Len(t, registry.subscribers(secondUser), 1)
+	assert.Len(t, registry.userIDs(), 2)
+
+	assert.False(t, registry.remove(firstUser, otherWatcher))
+	assert.False(t, registry.remove(firstUser, otherWatcher))
+	assert.Equal(t, []*Client{watcher}, registry.subscribers(firstUser))
+
+	assert.Len(t, registry.removeAll(watcher), 2)
+	assert.Empty(t, registry.subscribers(firstUser))
+	assert.Empty(t, registry.subscribers(secondUser))
+	assert.Empty(t, registry.watched)
+}
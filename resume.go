@@ -0,0 +1,313 @@
+package texto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// DefaultResumeWindow is the default duration during which a session can be resumed after its connection is lost.
+const DefaultResumeWindow = 2 * time.Minute
+
+// DefaultResumeBufferSize is the default number of messages kept to be transmitted again when a session is resumed.
+const DefaultResumeBufferSize = 100
+
+// CloseSessionResumed is the code of the close frame sent on a connection whose session was resumed on another one.
+const CloseSessionResumed = 4001
+
+// SessionResumedCloseReason is the reason of the close frame sent on a connection whose session was resumed on another
+// one.
+const SessionResumedCloseReason = "session resumed on another connection"
+
+// A clientSession makes the session of a Client resumable, by buffering the messages transmitted to it in a
+// ResumeBroker.
+type clientSession struct {
+	broker ResumeBroker
+	window time.Duration
+	size   int
+	// owner identifies the Client in the ResumeBroker.
+	owner string
+
+	// mu protects state, resuming and held. It is held while a message is buffered and queued, so that the messages are
+	// queued in the order of their sequence numbers.
+	mu    sync.Mutex
+	state SessionState
+	// resuming is set while the Client resumes the session of a lost connection. The messages received in the meantime
+	// are held, to be transmitted after the ones that were missed.
+	resuming bool
+	held     []*BrokerMessage
+}
+
+// newResumeToken returns a new random token with which a session can be resumed.
+func newResumeToken() (string, error) {
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// makeResumable allows the session of the Client to be resumed on another connection during the given window after
+// its connection is lost, transmitting again at most size messages.
+func (c *Client) makeResumable(broker ResumeBroker, window time.Duration, size int) error {
+	token, err := newResumeToken()
+	if err != nil {
+		return err
+	}
+	session := &clientSession{
+		broker: broker,
+		window: window,
+		size:   size,
+		owner:  uuid.NewV4().String(),
+	}
+	session.state = SessionState{
+		Token:     token,
+		UserID:    c.ID,
+		SessionID: c.SessionID,
+		Owner:     session.owner,
+	}
+	if err := broker.SaveSession(session.state, window); err != nil {
+		return err
+	}
+	c.session = session
+	return nil
+}
+
+// currentSession returns the state of the resumable session of the Client.
+func (c *Client) currentSession() SessionState {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	return c.session.state
+}
+
+// resumeToken returns the token with which the session of the Client can be resumed, or an empty string if it can't.
+func (c *Client) resumeToken() string {
+	if c.session == nil {
+		return ""
+	}
+	return c.currentSession().Token
+}
+
+// updateSession moves the resumable session to the current ID of the user, after it changed.
+func (c *Client) updateSession() error {
+	if c.session == nil {
+		return nil
+	}
+	c.session.mu.Lock()
+	c.session.state.UserID = c.ID
+	state := c.session.state
+	c.session.mu.Unlock()
+	return c.session.broker.SaveSession(state, c.session.window)
+}
+
+// transmitBuffered appends the given text message to the buffer of the session, then transmits it to the user along
+// with its sequence number in the session. The caller must hold c.session.mu.
+func (c *Client) transmitBuffered(message *BrokerMessage) {
+	if c.session.resuming {
+		c.session.held = append(c.session.held, message)
+		return
+	}
+	sequence, err := c.session.broker.BufferMessage(c.session.state, message, c.session.size, c.session.window)
+	switch err {
+	case nil:
+	case ErrSessionResumed:
+		// The user is now connected to the session on another connection, which receives the message.
+		c.supersede()
+		return
+	default:
+		c.log.Error(err)
+	}
+	c.enqueueReceive(message, sequence)
+	if sequence != 0 && message.written != nil && c.isQueueClosed() {
+		// The connection is lost, but the message is safe in the buffer of the session.
+		message.written()
+	}
+}
+
+// supersede notifies the Client that its session was resumed on another connection.
+func (c *Client) supersede() {
+	select {
+	case c.resumed <- struct{}{}:
+	default:
+	}
+}
+
+// A replayKey identifies a message transmitted again when a session is resumed.
+type replayKey struct {
+	senderID  uuid.UUID
+	messageID uuid.UUID
+}
+
+// handleResumeMessage resumes the session of a lost connection of the user: the current connection takes it over, and
+// receives the messages transmitted to it after the last one the user got.
+func (c *Client) handleResumeMessage(msg *ChatMessage) *ChatMessage {
+	if c.session == nil {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "ENOTSUP",
+			Description: "Session resumption is not supported by this server.",
+		})
+	}
+	payload, ok := msg.Data.(ResumeMessagePayload)
+	if !ok || len(payload.Token) == 0 {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EINVAL",
+			Description: "The data payload doesn't match the given kind",
+		})
+	}
+	state, err := c.session.broker.LoadSession(payload.Token)
+	if err == nil && state.UserID != c.ID && c.authenticated {
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EAUTH",
+			Description: "The session is authenticated as another user.",
+		})
+	}
+	if err == nil {
+		err = c.resume(payload, state.UserID, msg.ID)
+	}
+	switch err {
+	case nil:
+		return nil
+	case ErrUnknownSession:
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "ESESSION",
+			Description: "The session doesn't exist or expired.",
+		})
+	default:
+		c.log.Error(err)
+		return NewErrorMessage(&msg.ID, c.ID, ErrorMessagePayload{
+			Code:        "EBROKER",
+			Description: "Unable to resume the session.",
+		})
+	}
+}
+
+// resume takes over the session of the given user requested by the given payload. Once resumed, the connection message
+// answering the resume message of the given ID is queued, followed by the missed messages.
+//
+// The Client is registered for the user before the session is taken over, so that the messages sent to the user in
+// the meantime are either buffered by the previous Client and transmitted again, or held by this one.
+func (c *Client) resume(payload ResumeMessagePayload, userID uuid.UUID, messageID uuid.UUID) error {
+	c.session.mu.Lock()
+	c.session.resuming = true
+	c.session.mu.Unlock()
+	if userID != c.ID {
+		if err := c.rebind(userID, c.SessionID); err != nil {
+			c.finishResume(nil)
+			return err
+		}
+	}
+	state, messages, err := c.session.broker.ResumeSession(
+		payload.Token,
+		userID,
+		c.session.owner,
+		payload.LastSequence,
+		c.session.window,
+	)
+	if err != nil {
+		if err := c.updateSession(); err != nil {
+			c.log.Error(err)
+		}
+		c.finishResume(nil)
+		return err
+	}
+	c.session.mu.Lock()
+	previous := c.session.state
+	c.session.state = state
+	c.session.mu.Unlock()
+	if previous.Token != state.Token {
+		if err := c.session.broker.CloseSession(previous); err != nil {
+			c.log.Error(err)
+		}
+	}
+	if state.SessionID != c.SessionID {
+		// The session ID is shared with the previous Client, which releases it once it is done.
+		if err := c.rebind(c.ID, state.SessionID); err != nil {
+			c.log.Error(err)
+		}
+	}
+	c.enqueue(NewConnectionMessage(&messageID, c.ID, ConnectionMessagePayload{
+		ClientID:    c.ID,
+		SessionID:   c.SessionID,
+		ResumeToken: state.Token,
+	}))
+	c.finishResume(messages)
+	return nil
+}
+
+// releaseSession gives the Client a new session ID if its session was resumed on another connection, which now uses
+// the same session ID, so that unregistering the Client doesn't remove the session of the other connection. It must be
+// called once the Client is done, before it is unregistered.
+func (c *Client) releaseSession() {
+	if c.session == nil {
+		return
+	}
+	state, err := c.session.broker.LoadSession(c.currentSession().Token)
+	if err != nil || state.Owner == c.session.owner {
+		return
+	}
+	c.idMu.Lock()
+	c.SessionID = uuid.NewV4()
+	c.idMu.Unlock()
+}
+
+// finishResume transmits the given buffered messages again, then the messages held while the session was being
+// resumed, except the ones that were also buffered.
+func (c *Client) finishResume(messages []BufferedMessage) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	replayed := make(map[replayKey]struct{}, len(messages))
+	for _, buffered := range messages {
+		replayed[replayKey{buffered.Message.SenderID, buffered.Message.MessageID}] = struct{}{}
+		c.enqueueReceive(buffered.Message, buffered.Sequence)
+	}
+	held := c.session.held
+	c.session.held = nil
+	c.session.resuming = false
+	for _, message := range held {
+		if _, ok := replayed[replayKey{message.SenderID, message.MessageID}]; ok && message.MessageID != uuid.Nil {
+			continue
+		}
+		c.transmitBuffered(message)
+	}
+}
+
+// linger keeps the session of the Client registered for the resume window after its connection was lost, buffering
+// the messages transmitted to it, until it is resumed on another connection. If the server is shutting down, the
+// session stays resumable but linger returns at once, and the messages sent to the user in the meantime are kept in
+// their mailbox. The sessions closed by the user can't be resumed.
+func (c *Client) linger(draining bool) {
+	if c.session == nil {
+		return
+	}
+	state := c.currentSession()
+	if atomic.LoadInt32(&c.closedByUser) != 0 {
+		if err := c.session.broker.CloseSession(state); err != nil {
+			c.log.Error(err)
+		}
+		return
+	}
+	if err := c.session.broker.SaveSession(state, c.session.window); err != nil {
+		if err != ErrSessionResumed {
+			c.log.Error(err)
+		}
+		return
+	}
+	if draining {
+		return
+	}
+	c.closeQueue()
+	timer := time.NewTimer(c.session.window)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		if err := c.session.broker.CloseSession(c.currentSession()); err != nil {
+			c.log.Error(err)
+		}
+	case <-c.resumed:
+	case <-c.stop:
+	}
+}
@@ -0,0 +1,242 @@
+package texto
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// newResumableClient returns a Client registered in the given Broker, whose session can be resumed.
+func newResumableClient(t *testing.T, broker *MemoryBroker) *Client {
+	client := NewClient(newLogger(), nil, broker)
+	assert.Nil(t, client.makeResumable(broker, time.Minute, 3))
+	assert.Nil(t, broker.Register(client))
+	return client
+}
+
+// sessionSequences returns the session sequence numbers of the receive messages waiting in the send queue of the
+// given Client.
+func sessionSequences(client *Client) []uint64 {
+	var sequences []uint64
+	for len(client.outboundChan) != 0 {
+		sequences = append(sequences, (<-client.outboundChan).Data.(ReceiveMessagePayload).SessionSequence)
+	}
+	return sequences
+}
+
+func TestClient_Resume(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	senderID := uuid.NewV4()
+	send := func(recipientID uuid.UUID) {
+		assert.Nil(t, broker.Send(recipientID, &BrokerMessage{
+			MessageID:   uuid.NewV4(),
+			SenderID:    senderID,
+			RecipientID: recipientID,
+		}))
+	}
+	previous := newResumableClient(t, broker)
+	userID := previous.ID
+	token := previous.resumeToken()
+	for i := 0; i < 3; i++ {
+		send(userID)
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, sessionSequences(previous))
+	previous.closeQueue()
+	send(userID)
+	send(userID)
+
+	client := newResumableClient(t, broker)
+	freshToken := client.resumeToken()
+	assert.Nil(t, client.HandleMessage(NewResumeMessage(nil, client.ID, ResumeMessagePayload{
+		Token:        token,
+		LastSequence: 2,
+	})))
+	connection := (<-client.outboundChan).Data.(ConnectionMessagePayload)
+	assert.Equal(t, ConnectionMessagePayload{
+		ClientID:    userID,
+		SessionID:   previous.SessionID,
+		ResumeToken: token,
+	}, connection)
+	assert.Equal(t, userID, client.ID)
+	assert.Equal(t, []uint64{3, 4, 5}, sessionSequences(client))
+	_, err := broker.LoadSession(freshToken)
+	assert.Equal(t, ErrUnknownSession, err)
+
+	send(userID)
+	assert.Equal(t, []uint64{6}, sessionSequences(client))
+	assert.Len(t, previous.resumed, 1)
+
+	answer := client.HandleMessage(NewResumeMessage(nil, client.ID, ResumeMessagePayload{Token: "unknown"}))
+	assert.Equal(t, "ESESSION", answer.Data.(ErrorMessagePayload).Code)
+	other := newResumableClient(t, broker)
+	other.authenticated = true
+	answer = other.HandleMessage(NewResumeMessage(nil, other.ID, ResumeMessagePayload{Token: token}))
+	assert.Equal(t, "EAUTH", answer.Data.(ErrorMessagePayload).Code)
+	answer = NewClient(newLogger(), nil, broker).HandleMessage(NewResumeMessage(nil, uuid.Nil, ResumeMessagePayload{
+		Token: token,
+	}))
+	assert.Equal(t, "ENOTSUP", answer.Data.(ErrorMessagePayload).Code)
+}
+
+func TestClient_ResumeRegistry(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	previous := newResumableClient(t, broker)
+	previous.closeQueue()
+	client := newResumableClient(t, broker)
+	assert.Nil(t, client.HandleMessage(NewResumeMessage(nil, client.ID, ResumeMessagePayload{
+		Token: previous.resumeToken(),
+	})))
+	<-client.outboundChan
+	assert.Equal(t, previous.SessionID, client.SessionID)
+	assert.Equal(t, 2, broker.clients.len())
+
+	previous.releaseSession()
+	assert.NotEqual(t, previous.SessionID, client.SessionID)
+	assert.Nil(t, broker.Unregister(previous))
+	assert.Equal(t, []*Client{client}, broker.clients.sessions(client.ID))
+
+	client.releaseSession()
+	assert.Equal(t, previous.resumeToken(), client.resumeToken())
+	assert.Nil(t, broker.Unregister(client))
+	assert.Equal(t, 0, broker.clients.len())
+	assert.Empty(t, broker.clients.clients)
+}
+
+func TestClient_Linger(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+
+	client := newResumableClient(t, broker)
+	client.closedByUser = 1
+	client.linger(false)
+	_, err := broker.LoadSession(client.resumeToken())
+	assert.Equal(t, ErrUnknownSession, err)
+
+	client = newResumableClient(t, broker)
+	client.linger(true)
+	_, err = broker.LoadSession(client.resumeToken())
+	assert.Nil(t, err)
+	assert.False(t, client.isQueueClosed())
+
+	client = newResumableClient(t, broker)
+	client.session.window = 10 * time.Millisecond
+	client.linger(false)
+	_, err = broker.LoadSession(client.resumeToken())
+	assert.Equal(t, ErrUnknownSession, err)
+
+	client = newResumableClient(t, broker)
+	client.supersede()
+	lingered := make(chan struct{})
+	go func() {
+		client.linger(false)
+		close(lingered)
+	}()
+	select {
+	case <-lingered:
+	case <-time.After(time.Second):
+		t.Fatal("linger didn't return once the session was resumed")
+	}
+}
+
+func TestMemoryBroker_Sessions(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	var _ ResumeBroker = broker
+	state := SessionState{Token: "token", UserID: uuid.NewV4(), SessionID: uuid.NewV4(), Owner: "first"}
+	assert.Nil(t, broker.SaveSession(state, time.Minute))
+	loaded, err := broker.LoadSession(state.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, state, loaded)
+
+	var messages []*BrokerMessage
+	for i := 0; i < 4; i++ {
+		messages = append(messages, &BrokerMessage{MessageID: uuid.NewV4()})
+		sequence, err := broker.BufferMessage(state, messages[i], 3, time.Minute)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i+1), sequence)
+	}
+
+	_, _, err = broker.ResumeSession(state.Token, uuid.NewV4(), "second", 0, time.Minute)
+	assert.Equal(t, ErrUnknownSession, err)
+	resumed, buffered, err := broker.ResumeSession(state.Token, state.UserID, "second", 2, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", resumed.Owner)
+	assert.Equal(t, []BufferedMessage{{3, messages[2]}, {4, messages[3]}}, buffered)
+
+	assert.Equal(t, ErrSessionResumed, broker.SaveSession(state, time.Minute))
+	_, err = broker.BufferMessage(state, messages[0], 3, time.Minute)
+	assert.Equal(t, ErrSessionResumed, err)
+	assert.Nil(t, broker.CloseSession(state))
+	sequence, err := broker.BufferMessage(resumed, messages[0], 3, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), sequence)
+
+	assert.Nil(t, broker.CloseSession(resumed))
+	_, err = broker.LoadSession(state.Token)
+	assert.Equal(t, ErrUnknownSession, err)
+
+	assert.Nil(t, broker.SaveSession(state, -time.Second))
+	_, err = broker.LoadSession(state.Token)
+	assert.Equal(t, ErrUnknownSession, err)
+	broker.sweep()
+	assert.Empty(t, broker.sessions)
+}
+
+func TestRedisBroker_Sessions(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log:  newLogger(),
+		pool: newMockPool(mockConn),
+	}
+	var _ ResumeBroker = &broker
+	state := SessionState{Token: "token", UserID: uuid.NewV4(), SessionID: uuid.NewV4(), Owner: "owner"}
+	key := "texto:resume:{token}"
+	bufferKey := "texto:resume:{token}:buffer"
+
+	mockConn.Script(
+		[]byte(redisSaveSessionScriptSource), 2, key, bufferKey,
+		"owner", state.UserID.String(), state.SessionID.String(), int64(60000),
+	).Expect(int64(1)).Expect(int64(0))
+	assert.Nil(t, broker.SaveSession(state, time.Minute))
+	assert.Equal(t, ErrSessionResumed, broker.SaveSession(state, time.Minute))
+
+	message := &BrokerMessage{MessageID: uuid.NewV4(), SenderID: uuid.NewV4(), RecipientID: state.UserID}
+	marshaled, _ := json.Marshal(message)
+	mockConn.Script(
+		[]byte(redisBufferMessageScriptSource), 2, key, bufferKey,
+		"owner", state.UserID.String(), state.SessionID.String(), int64(60000), 10, marshaled,
+	).Expect(int64(4))
+	sequence, err := broker.BufferMessage(state, message, 10, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), sequence)
+
+	mockConn.Command("HMGET", key, "owner", "user", "session").
+		Expect([]interface{}{[]byte("owner"), []byte(state.UserID.String()), []byte(state.SessionID.String())}).
+		Expect([]interface{}{nil, nil, nil})
+	loaded, err := broker.LoadSession(state.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, state, loaded)
+	_, err = broker.LoadSession(state.Token)
+	assert.Equal(t, ErrUnknownSession, err)
+
+	mockConn.Script(
+		[]byte(redisResumeSessionScriptSource), 2, key, bufferKey, "other", state.UserID.String(), int64(60000),
+	).Expect([]interface{}{
+		[]byte(state.SessionID.String()),
+		[]interface{}{[]byte("3 " + string(marshaled)), []byte("4 " + string(marshaled))},
+	}).Expect(nil)
+	resumed, buffered, err := broker.ResumeSession(state.Token, state.UserID, "other", 3, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, SessionState{Token: "token", UserID: state.UserID, SessionID: state.SessionID, Owner: "other"}, resumed)
+	if assert.Len(t, buffered, 1) {
+		assert.Equal(t, uint64(4), buffered[0].Sequence)
+		assert.Equal(t, message.MessageID, buffered[0].Message.MessageID)
+	}
+	_, _, err = broker.ResumeSession(state.Token, state.UserID, "other", 3, time.Minute)
+	assert.Equal(t, ErrUnknownSession, err)
+
+	mockConn.Script([]byte(redisCloseSessionScriptSource), 2, key, bufferKey, "other").Expect(int64(1))
+	assert.Nil(t, broker.CloseSession(resumed))
+}
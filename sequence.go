@@ -0,0 +1,154 @@
+package texto
+
+import (
+	"sort"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// DefaultReorderWindow is the default duration for which a Client holds a message received ahead of its turn, waiting
+// for the ones preceding it in its conversation.
+const DefaultReorderWindow = 200 * time.Millisecond
+
+// sentKind is the kind of the BrokerMessage sent to the sessions of a user when they send a numbered message from one of
+// them, so that the other ones don't wait for this message. It isn't transmitted to the user.
+const sentKind = "sent"
+
+// A conversationOrder restores the order of the messages of a conversation transmitted to a Client.
+type conversationOrder struct {
+	// next is the sequence number of the message expected next, or zero until it is known: the first message of the
+	// conversation, or the first one given to the session, is then held for the reorder window unless its sequence
+	// number is 1.
+	next uint64
+	// pending holds the messages received ahead of their turn, by sequence number. A nil message marks a sequence
+	// number that mustn't be waited for, because the message was sent by the user.
+	pending map[uint64]*BrokerMessage
+	// If not nil, timer releases the pending messages once the reorder window elapsed.
+	timer *time.Timer
+}
+
+// nextSequence returns the sequence number of the next message of the given conversation, or zero if the Broker
+// doesn't number the messages.
+func (c *Client) nextSequence(conversationID uuid.UUID) (uint64, error) {
+	sequences, ok := c.broker.(SequenceBroker)
+	if !ok {
+		return 0, nil
+	}
+	return sequences.NextSequence(conversationID)
+}
+
+// order returns the conversationOrder of the given conversation, creating it if needed. The caller must hold
+// c.orderMu.
+func (c *Client) order(conversationID uuid.UUID) *conversationOrder {
+	order, ok := c.orders[conversationID]
+	if !ok {
+		order = &conversationOrder{pending: make(map[uint64]*BrokerMessage)}
+		c.orders[conversationID] = order
+	}
+	return order
+}
+
+// deliverInOrder transmits the given text message to the user after the ones preceding it in its conversation. A
+// message received ahead of its turn is held until the missing ones arrive, or for at most the reorder window, after
+// which the user is left to detect the gap. The messages received after their turn are transmitted immediately.
+func (c *Client) deliverInOrder(message *BrokerMessage) {
+	conversationID := messageConversationID(message)
+	c.orderMu.Lock()
+	defer c.orderMu.Unlock()
+	order := c.order(conversationID)
+	switch {
+	case message.Sequence == order.next || order.next == 0 && message.Sequence == 1:
+		c.transmit(message)
+		order.next = message.Sequence + 1
+		c.advance(order)
+	case message.Sequence < order.next:
+		c.transmit(message)
+	default:
+		order.pending[message.Sequence] = message
+		if order.timer == nil {
+			var timer *time.Timer
+			timer = time.AfterFunc(c.reorderWindow, func() {
+				c.orderMu.Lock()
+				defer c.orderMu.Unlock()
+				if order.timer == timer {
+					c.release(order)
+				}
+			})
+			order.timer = timer
+		}
+	}
+}
+
+// skipSequence records that the message of the given sequence number was sent by the user, so that the messages of
+// the conversation transmitted to them don't wait for it.
+func (c *Client) skipSequence(conversationID uuid.UUID, sequence uint64) {
+	if sequence == 0 || c.reorderWindow <= 0 {
+		return
+	}
+	c.orderMu.Lock()
+	defer c.orderMu.Unlock()
+	order := c.order(conversationID)
+	switch {
+	case sequence == order.next || order.next == 0 && len(order.pending) == 0:
+		order.next = sequence + 1
+		c.advance(order)
+	case order.next == 0 || sequence > order.next:
+		order.pending[sequence] = nil
+	}
+}
+
+// notifySent tells all the sessions of the user that the given numbered message was sent from this one, so that the
+// messages of its conversation transmitted to the other sessions don't wait for it.
+func (c *Client) notifySent(message *BrokerMessage) {
+	if message.Sequence == 0 || c.reorderWindow <= 0 {
+		return
+	}
+	err := c.broker.Send(c.ID, &BrokerMessage{
+		Kind:        sentKind,
+		MessageID:   message.MessageID,
+		SenderID:    c.ID,
+		RecipientID: message.RecipientID,
+		RoomID:      message.RoomID,
+		Sequence:    message.Sequence,
+	})
+	if err != nil {
+		c.log.Error(err)
+	}
+}
+
+// advance transmits the pending messages directly following the last transmitted one. The caller must hold c.orderMu.
+func (c *Client) advance(order *conversationOrder) {
+	for {
+		message, ok := order.pending[order.next]
+		if !ok {
+			break
+		}
+		delete(order.pending, order.next)
+		if message != nil {
+			c.transmit(message)
+		}
+		order.next++
+	}
+	if len(order.pending) == 0 && order.timer != nil {
+		order.timer.Stop()
+		order.timer = nil
+	}
+}
+
+// release transmits all the pending messages in order, giving up on the missing ones. The caller must hold c.orderMu.
+func (c *Client) release(order *conversationOrder) {
+	sequences := make([]uint64, 0, len(order.pending))
+	for sequence := range order.pending {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	for _, sequence := range sequences {
+		if message := order.pending[sequence]; message != nil {
+			c.transmit(message)
+		}
+		delete(order.pending, sequence)
+		order.next = sequence + 1
+	}
+	order.timer = nil
+}
@@ -0,0 +1,165 @@
+package texto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_DeliverInOrder(t *testing.T) {
+	client := NewClient(newLogger(), nil, NewMemoryBroker(newLogger()))
+	client.reorderWindow = time.Hour
+	senderID := uuid.NewV4()
+	deliver := func(sequence uint64, text string) {
+		client.deliver(&BrokerMessage{SenderID: senderID, RecipientID: client.ID, Text: text, Sequence: sequence})
+	}
+
+	deliver(1, "a")
+	deliver(3, "c")
+	assert.Equal(t, []string{"a"}, queuedTexts(client))
+	deliver(2, "b")
+	assert.Equal(t, []string{"b", "c"}, queuedTexts(client))
+	deliver(2, "b")
+	assert.Equal(t, []string{"b"}, queuedTexts(client))
+
+	client.skipSequence(ConversationID(senderID, client.ID), 5)
+	deliver(6, "f")
+	assert.Empty(t, queuedTexts(client))
+	deliver(4, "d")
+	assert.Equal(t, []string{"d", "f"}, queuedTexts(client))
+	client.skipSequence(ConversationID(senderID, client.ID), 7)
+	deliver(8, "h")
+	assert.Equal(t, []string{"h"}, queuedTexts(client))
+	assert.Empty(t, client.orders[ConversationID(senderID, client.ID)].pending)
+}
+
+func TestClient_ReleaseAfterReorderWindow(t *testing.T) {
+	client := NewClient(newLogger(), nil, NewMemoryBroker(newLogger()))
+	client.reorderWindow = 10 * time.Millisecond
+	senderID := uuid.NewV4()
+	for _, sequence := range []uint64{1, 4, 3} {
+		client.deliver(&BrokerMessage{SenderID: senderID, RecipientID: client.ID, Sequence: sequence})
+	}
+	var sequences []uint64
+	for len(sequences) < 3 {
+		select {
+		case receive := <-client.outboundChan:
+			sequences = append(sequences, receive.Data.(ReceiveMessagePayload).Sequence)
+		case <-time.After(time.Second):
+			t.Fatal("the pending messages weren't released")
+		}
+	}
+	assert.Equal(t, []uint64{1, 3, 4}, sequences)
+
+	client.deliver(&BrokerMessage{SenderID: senderID, RecipientID: client.ID, Sequence: 5})
+	assert.Len(t, client.outboundChan, 1)
+}
+
+func TestClient_HoldFirstMessage(t *testing.T) {
+	client := NewClient(newLogger(), nil, NewMemoryBroker(newLogger()))
+	client.reorderWindow = time.Hour
+	senderID := uuid.NewV4()
+	deliver := func(sequence uint64, text string) {
+		client.deliver(&BrokerMessage{SenderID: senderID, RecipientID: client.ID, Text: text, Sequence: sequence})
+	}
+
+	deliver(2, "b")
+	assert.Empty(t, queuedTexts(client))
+	deliver(1, "a")
+	assert.Equal(t, []string{"a", "b"}, queuedTexts(client))
+
+	client.reorderWindow = 10 * time.Millisecond
+	otherID := uuid.NewV4()
+	client.deliver(&BrokerMessage{SenderID: otherID, RecipientID: client.ID, Text: "f", Sequence: 6})
+	client.deliver(&BrokerMessage{SenderID: otherID, RecipientID: client.ID, Text: "e", Sequence: 5})
+	assert.Empty(t, queuedTexts(client))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"e", "f"}, queuedTexts(client))
+}
+
+func TestClient_SentFromOtherSession(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	sender := NewClient(newLogger(), nil, broker)
+	otherSession := NewClient(newLogger(), nil, broker)
+	otherSession.ID = sender.ID
+	recipient := NewClient(newLogger(), nil, broker)
+	for _, client := range []*Client{sender, otherSession, recipient} {
+		client.reorderWindow = time.Hour
+		assert.Nil(t, broker.Register(client))
+	}
+	send := func(from, to *Client) {
+		ack := from.HandleMessage(NewSendMessage(nil, from.ID, SendMessagePayload{ReceiverID: to.ID, Text: "Hello"}))
+		assert.Equal(t, AcknowledgeMessageKind, ack.Kind)
+	}
+
+	send(recipient, sender)
+	assert.Len(t, queuedTexts(sender), 1)
+	assert.Len(t, queuedTexts(otherSession), 1)
+	send(sender, recipient)
+	assert.Empty(t, queuedTexts(otherSession))
+	assert.Empty(t, queuedTexts(sender))
+	send(recipient, sender)
+	assert.Len(t, queuedTexts(otherSession), 1)
+	assert.Empty(t, otherSession.orders[ConversationID(sender.ID, recipient.ID)].pending)
+}
+
+func TestClient_SendSequence(t *testing.T) {
+	broker := NewMemoryBroker(newLogger())
+	sender := NewClient(newLogger(), nil, broker)
+	recipient := NewClient(newLogger(), nil, broker)
+	for _, client := range []*Client{sender, recipient} {
+		client.reorderWindow = time.Hour
+		assert.Nil(t, broker.Register(client))
+	}
+	send := func(from, to *Client) AckMessagePayload {
+		ack := from.HandleMessage(NewSendMessage(nil, from.ID, SendMessagePayload{ReceiverID: to.ID, Text: "Hello"}))
+		assert.Equal(t, AcknowledgeMessageKind, ack.Kind)
+		return ack.Data.(AckMessagePayload)
+	}
+
+	before := time.Now().UTC()
+	first := send(sender, recipient)
+	assert.Equal(t, uint64(1), first.Sequence)
+	assert.False(t, first.SentAt.Before(before))
+	assert.Equal(t, uint64(2), send(sender, recipient).Sequence)
+	assert.Equal(t, uint64(3), send(recipient, sender).Sequence)
+	assert.Equal(t, uint64(4), send(sender, recipient).Sequence)
+
+	var received []ReceiveMessagePayload
+	for len(recipient.outboundChan) != 0 {
+		received = append(received, (<-recipient.outboundChan).Data.(ReceiveMessagePayload))
+	}
+	if assert.Len(t, received, 3) {
+		assert.Equal(t, first.SentAt, received[0].SentAt)
+		assert.Equal(t, []uint64{1, 2, 4}, []uint64{received[0].Sequence, received[1].Sequence, received[2].Sequence})
+	}
+
+	room := uuid.NewV4()
+	assert.Nil(t, broker.CreateRoom(room, sender.ID))
+	assert.Nil(t, broker.JoinRoom(room, recipient.ID))
+	ack := sender.HandleMessage(NewSendMessage(nil, sender.ID, SendMessagePayload{ReceiverID: room, Text: "Hello"}))
+	assert.Equal(t, uint64(1), ack.Data.(AckMessagePayload).Sequence)
+	receive := (<-recipient.outboundChan).Data.(ReceiveMessagePayload)
+	assert.Equal(t, uint64(1), receive.Sequence)
+}
+
+func TestRedisBroker_NextSequence(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	broker := RedisBroker{
+		Log:  newLogger(),
+		pool: newMockPool(mockConn),
+	}
+	var _ SequenceBroker = &broker
+	conversationID := uuid.NewV4()
+	mockConn.Command("INCR", "texto:seq:{"+conversationID.String()+"}").Expect(int64(1)).Expect(int64(2))
+
+	sequence, err := broker.NextSequence(conversationID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), sequence)
+	sequence, err = broker.NextSequence(conversationID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), sequence)
+}
@@ -4,7 +4,10 @@ package texto
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,62 +18,176 @@ import (
 
 // A Server bundles an HTTP Server and all the configuration required at runtime.
 type Server struct {
-	Log        *logrus.Logger
-	Broker     Broker
-	HTTPServer http.Server
-	cancelFunc context.CancelFunc
-	ctx        context.Context
+	Log           *logrus.Logger
+	Broker        Broker
+	Authenticator Authenticator
+	MessageStore  MessageStore
+	HTTPServer    http.Server
+	// The duration given to the connected users to receive their queued messages when the Server is stopped. A zero
+	// value stands for DefaultDrainTimeout.
+	DrainTimeout time.Duration
+	chat         *ChatHandler
+	cancelFunc   context.CancelFunc
+	ctx          context.Context
+	pollMu       sync.Mutex
+	pollErr      error
 }
 
-// NewServer returns an initialized Server.
-func NewServer(parent context.Context, log *logrus.Logger, addr string, broker Broker) (*Server, error) {
-	mux := http.NewServeMux()
-	mux.Handle("/v1/texto", &ChatHandler{
+// ErrNotPolling is reported by the health checks of a Server whose Broker isn't polling messages.
+var ErrNotPolling = errors.New("broker is not polling messages")
+
+// A ServerOption configures an optional feature of a Server.
+type ServerOption func(s *Server)
+
+// WithAuthenticator requires the users to be authenticated by the given Authenticator before opening a connection.
+func WithAuthenticator(authenticator Authenticator) ServerOption {
+	return func(s *Server) {
+		s.Authenticator = authenticator
+	}
+}
+
+// WithMessageStore records the messages sent by the users in the given MessageStore, and serves the history of the
+// conversations on /v1/conversations/.
+func WithMessageStore(store MessageStore) ServerOption {
+	return func(s *Server) {
+		s.MessageStore = store
+	}
+}
+
+// NewServer returns a Server configured by the given Config, which must be valid.
+func NewServer(parent context.Context, log *logrus.Logger, config *Config, broker Broker, options ...ServerOption) (*Server, error) {
+	s := &Server{
+		Log:          log,
+		Broker:       broker,
+		DrainTimeout: config.DrainTimeout,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	overflow, err := ParseOverflowPolicy(config.SendQueueOverflow)
+	if err != nil {
+		return nil, err
+	}
+	s.chat = &ChatHandler{
 		Log:    log,
 		Broker: broker,
 		Upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			ReadBufferSize:  config.ReadBufferSize,
+			WriteBufferSize: config.WriteBufferSize,
+			Subprotocols:    []string{Subprotocol},
+			CheckOrigin:     checkOrigin(log, config.AllowedOrigins),
 		},
-		Timeout: 5 * time.Minute,
-	})
+		Timeout:            config.ClientTimeout,
+		PingInterval:       config.PingInterval,
+		PongTimeout:        config.PongTimeout,
+		SendQueueSize:      config.SendQueueSize,
+		Overflow:           overflow,
+		ReorderWindow:      config.ReorderWindow,
+		DedupWindow:        config.DedupWindow,
+		ResumeWindow:       config.ResumeWindow,
+		ResumeBufferSize:   config.ResumeBufferSize,
+		Authenticator:      s.Authenticator,
+		InsecureIdentities: config.InsecureIdentities,
+		Store:              s.MessageStore,
+		ClientRateLimit:    RateLimit{Rate: config.ClientRate, Burst: config.ClientBurst},
+		UserRateLimit:      RateLimit{Rate: config.UserRate, Burst: config.UserBurst},
+		MaxRateViolations:  config.MaxRateViolations,
+	}
+	if s.Authenticator == nil && config.InsecureIdentities {
+		log.Warn("Authentication is disabled and insecure_identities is set: anyone can impersonate any user")
+	} else if s.Authenticator == nil {
+		log.Warn("Authentication is disabled: each connection is given a new random user ID")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/v1/texto", s.chat)
+	if s.MessageStore != nil && s.Authenticator == nil {
+		log.Warn("Authentication is disabled: the history of the conversations is only available over WebSocket")
+	} else if s.MessageStore != nil {
+		mux.Handle(historyPathPrefix, &HistoryHandler{
+			Log:           log,
+			Broker:        broker,
+			Store:         s.MessageStore,
+			Authenticator: s.Authenticator,
+		})
+	}
+	mux.Handle("/metrics", &MetricsHandler{})
+	mux.Handle("/healthz", &HealthHandler{Log: log, Check: s.checkLiveness})
+	mux.Handle("/readyz", &HealthHandler{Log: log, Check: s.checkReadiness})
 	statikFS, err := fs.New()
 	if err != nil {
 		return nil, err
 	}
 	mux.Handle("/", http.FileServer(statikFS))
-	ctx, cancel := context.WithCancel(parent)
-	return &Server{
-		Log:    log,
-		Broker: broker,
-		HTTPServer: http.Server{
-			Addr:              addr,
-			Handler:           mux,
-			ReadTimeout:       60 * time.Second,
-			ReadHeaderTimeout: 60 * time.Second,
-			WriteTimeout:      60 * time.Second,
-			IdleTimeout:       60 * time.Second,
-		},
-		cancelFunc: cancel,
-		ctx:        ctx,
-	}, nil
+	s.ctx, s.cancelFunc = context.WithCancel(parent)
+	s.pollErr = ErrNotPolling
+	s.HTTPServer = http.Server{
+		Addr:              ":" + strconv.Itoa(config.Port),
+		Handler:           mux,
+		ReadTimeout:       config.HTTPReadTimeout,
+		ReadHeaderTimeout: config.HTTPReadHeaderTimeout,
+		WriteTimeout:      config.HTTPWriteTimeout,
+		IdleTimeout:       config.HTTPIdleTimeout,
+	}
+	return s, nil
 }
 
 // Run tells the Server to start listening for incoming HTTP connections.
 func (s *Server) Run() error {
 	s.Log.WithField("addr", s.HTTPServer.Addr).Info("Starting HTTP server")
-	go s.Broker.Poll(s.ctx)
+	s.setPollError(nil)
+	go func() {
+		err := s.Broker.Poll(s.ctx)
+		if err != nil {
+			s.Log.WithError(err).Error("Broker stopped polling messages")
+		} else {
+			err = ErrNotPolling
+		}
+		s.setPollError(err)
+	}()
 	return s.HTTPServer.ListenAndServe()
 }
 
-// Stop gracefully stops the server.
-func (s *Server) Stop() error {
-	if err := s.HTTPServer.Shutdown(s.ctx); err != nil {
+// setPollError records the error returned by the Poll method of the Broker, or nil while it is running.
+func (s *Server) setPollError(err error) {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	s.pollErr = err
+}
+
+// checkLiveness reports whether the Broker is still polling messages.
+func (s *Server) checkLiveness() error {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	return s.pollErr
+}
+
+// checkReadiness reports whether the Server can accept new connections: the Broker must be polling messages, and be
+// healthy if it is a HealthChecker.
+func (s *Server) checkReadiness() error {
+	if err := s.checkLiveness(); err != nil {
 		return err
 	}
-	s.cancelFunc()
+	if checker, ok := s.Broker.(HealthChecker); ok {
+		return checker.CheckHealth()
+	}
 	return nil
 }
+
+// Stop gracefully stops the server. It stops accepting connections, asks the connected users to reconnect once the
+// messages queued for them are written or DrainTimeout has elapsed, and stops polling the Broker once their sessions are
+// unregistered. The users are asked to reconnect even if the HTTP server failed to stop, in which case its error is
+// returned.
+func (s *Server) Stop() error {
+	timeout := s.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	defer s.cancelFunc()
+	err := s.HTTPServer.Shutdown(ctx)
+	if chatErr := s.chat.Shutdown(ctx); err == nil {
+		err = chatErr
+	}
+	return err
+}
@@ -2,29 +2,93 @@ package texto
 
 import (
 	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewServer(t *testing.T) {
 	logger := newLogger()
-	addr := ":8080"
-	broker := newDummyBroker()
-	server, err := NewServer(context.Background(), logger, addr, broker)
+	config := DefaultConfig()
+	config.Port = 8081
+	broker := NewMemoryBroker(newLogger())
+	server, err := NewServer(context.Background(), logger, config, broker)
 	assert.Nil(t, err)
 	assert.Equal(t, logger, server.Log)
 	assert.Equal(t, broker, server.Broker)
-	assert.Equal(t, addr, server.HTTPServer.Addr)
+	assert.Equal(t, ":8081", server.HTTPServer.Addr)
+}
+
+func TestNewServerWithAuthenticator(t *testing.T) {
+	authenticator := &JWTAuthenticator{Secret: []byte("secret")}
+	server, err := NewServer(context.Background(), newLogger(), DefaultConfig(), NewMemoryBroker(newLogger()), WithAuthenticator(authenticator))
+	assert.Nil(t, err)
+	assert.Equal(t, authenticator, server.Authenticator)
+}
+
+func TestNewServerWithMessageStore(t *testing.T) {
+	store := &RedisMessageStore{}
+	server, err := NewServer(context.Background(), newLogger(), DefaultConfig(), NewMemoryBroker(newLogger()), WithMessageStore(store))
+	assert.Nil(t, err)
+	assert.Equal(t, store, server.MessageStore)
+	request := httptest.NewRequest("GET", "/v1/conversations/"+uuid.NewV4().String()+"/messages", nil)
+	_, pattern := server.HTTPServer.Handler.(*http.ServeMux).Handler(request)
+	assert.Equal(t, "/", pattern)
+
+	authenticator := &JWTAuthenticator{Secret: []byte("secret")}
+	server, err = NewServer(context.Background(), newLogger(), DefaultConfig(), NewMemoryBroker(newLogger()), WithMessageStore(store), WithAuthenticator(authenticator))
+	assert.Nil(t, err)
+	_, pattern = server.HTTPServer.Handler.(*http.ServeMux).Handler(request)
+	assert.Equal(t, historyPathPrefix, pattern)
+}
+
+func TestServer_Health(t *testing.T) {
+	server, err := NewServer(context.Background(), newLogger(), DefaultConfig(), NewMemoryBroker(newLogger()))
+	assert.Nil(t, err)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		recorder := httptest.NewRecorder()
+		server.HTTPServer.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	}
+	server.setPollError(nil)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		recorder := httptest.NewRecorder()
+		server.HTTPServer.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
 }
 
 func TestServer_Stop(t *testing.T) {
 	logger := newLogger()
-	addr := ":8080"
-	broker := newDummyBroker()
-	server, err := NewServer(context.Background(), logger, addr, broker)
+	broker := NewMemoryBroker(newLogger())
+	server, err := NewServer(context.Background(), logger, DefaultConfig(), broker)
 	assert.Nil(t, err)
 	go server.Run()
 	err = server.Stop()
 	assert.Nil(t, err)
 }
+
+func TestServer_StopHTTPError(t *testing.T) {
+	config := DefaultConfig()
+	config.DrainTimeout = 50 * time.Millisecond
+	server, err := NewServer(context.Background(), newLogger(), config, NewMemoryBroker(newLogger()))
+	assert.Nil(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	go server.HTTPServer.Serve(listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, server.Stop())
+	assert.True(t, server.chat.isDraining())
+}
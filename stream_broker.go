@@ -0,0 +1,1032 @@
+package texto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultNodeTTL is the default value of StreamBroker.NodeTTL.
+	DefaultNodeTTL = 30 * time.Second
+	// DefaultClaimIdle is the default value of StreamBroker.ClaimIdle.
+	DefaultClaimIdle = 30 * time.Second
+	// streamGroup is the name of the consumer group reading the stream of each node.
+	streamGroup = "texto"
+	// streamBatchSize is the maximum number of entries read from a stream at once.
+	streamBatchSize = 100
+	// streamReadBlock is the time for which a read of the stream of the node waits for new entries.
+	streamReadBlock = time.Second
+	// streamNodesKey is the key of the sorted set of the nodes using a StreamBroker, scored by the UNIX time at which
+	// they are considered dead if they don't refresh their registration.
+	streamNodesKey = RedisBrokerPrefix + "nodes"
+)
+
+// streamScriptPrelude starts the scripts adding entries to the streams of the nodes. KEYS[1] is the sorted set of the
+// registered nodes, and ARGV[1] the current UNIX time. The ARGV[2] following keys are the streams of the nodes whose IDs
+// are the ARGV[2] following arguments: they are the only streams a script can write to. The other keys and arguments
+// of the script are returned by key(i) and arg(i).
+const streamScriptPrelude = `
+local now = tonumber(ARGV[1])
+local node_count = tonumber(ARGV[2])
+local streams = {}
+for i = 1, node_count do
+	streams[ARGV[i + 2]] = KEYS[i + 1]
+end
+local function key(i)
+	return KEYS[node_count + 1 + i]
+end
+local function arg(i)
+	return ARGV[node_count + 2 + i]
+end
+local function live_streams(set, remove, nodes)
+	local live = {}
+	for _, node in ipairs(nodes) do
+		local expiry = redis.call("ZSCORE", KEYS[1], node)
+		if expiry and tonumber(expiry) >= now then
+			if not streams[node] then
+				return nil
+			end
+			table.insert(live, streams[node])
+		else
+			redis.call(remove, set, node)
+		end
+	end
+	return live
+end
+local function route(targets, mailbox, message, size, ttl)
+	for _, stream in ipairs(targets) do
+		redis.call("XADD", stream, "*", "message", message)
+	end
+	if #targets == 0 then
+		redis.call("RPUSH", mailbox, message)
+		redis.call("LTRIM", mailbox, -tonumber(size), -1)
+		redis.call("EXPIRE", mailbox, ttl)
+	end
+end
+`
+
+// streamSendScriptSource adds a message arg(1) to the stream of every live node on which the recipient has a session,
+// according to their nodes key(1), or to their mailbox key(2) if there isn't any, which keeps its last arg(2) messages
+// for arg(3) seconds. The dead nodes are forgotten. It returns the number of streams the message was added to, or -3 if
+// the stream of one of the nodes wasn't given. If the recipient is the room key(3), nothing is sent and -1 is returned.
+const streamSendScriptSource = `
+if redis.call("EXISTS", key(3)) == 1 then
+	return -1
+end
+local targets = live_streams(key(1), "ZREM", redis.call("ZRANGE", key(1), 0, -1))
+if not targets then
+	return -3
+end
+route(targets, key(2), arg(1), arg(2), arg(3))
+return #targets
+`
+
+// streamSendRoomScriptSource adds a message to the streams of the nodes of the other members of the room key(1) as
+// streamSendScriptSource, if the user arg(1) is one of its members. key(2 * i) and key(2 * i + 1) are the nodes and the
+// mailbox of the i-th other member, whose ID and message are arg(2 * i + 2) and arg(2 * i + 3). arg(2) and arg(3) are
+// the size and the TTL of the mailboxes. It returns -1 if the room doesn't exist, -2 if the user isn't a member, and -3
+// if the other members aren't the given ones or the stream of one of their nodes wasn't given.
+const streamSendRoomScriptSource = `
+local count = (#KEYS - node_count - 2) / 2
+if redis.call("EXISTS", key(1)) == 0 then
+	return -1
+end
+if redis.call("SISMEMBER", key(1), arg(1)) == 0 then
+	return -2
+end
+if redis.call("SCARD", key(1)) ~= count + 1 then
+	return -3
+end
+local targets = {}
+for i = 1, count do
+	if redis.call("SISMEMBER", key(1), arg(2 * i + 2)) == 0 then
+		return -3
+	end
+	targets[i] = live_streams(key(2 * i), "ZREM", redis.call("ZRANGE", key(2 * i), 0, -1))
+	if not targets[i] then
+		return -3
+	end
+end
+for i = 1, count do
+	route(targets[i], key(2 * i + 1), arg(2 * i + 3), arg(2), arg(3))
+end
+return count
+`
+
+// streamRegisterScriptSource adds the node arg(1) to the nodes of the user key(1), moves the messages of their mailbox
+// key(2) to the stream of the node, and adds the session arg(2) to their open sessions key(3) for arg(3) seconds. If
+// the user had no open session, the presence event arg(4) is added to the streams of the live nodes watching them
+// key(4). It returns the number of moved messages, or -3 if the stream of one of the watching nodes wasn't given.
+const streamRegisterScriptSource = `
+redis.call("ZREMRANGEBYSCORE", key(3), "-inf", now)
+local watchers = {}
+if redis.call("ZCARD", key(3)) == 0 then
+	watchers = live_streams(key(4), "SREM", redis.call("SMEMBERS", key(4)))
+	if not watchers then
+		return -3
+	end
+end
+redis.call("ZADD", key(1), 0, arg(1))
+local messages = redis.call("LRANGE", key(2), 0, -1)
+for _, message in ipairs(messages) do
+	redis.call("XADD", streams[arg(1)], "*", "message", message)
+end
+redis.call("DEL", key(2))
+redis.call("ZADD", key(3), now + tonumber(arg(3)), arg(2))
+redis.call("EXPIRE", key(3), arg(3))
+for _, stream in ipairs(watchers) do
+	redis.call("XADD", stream, "*", "presence", arg(4))
+end
+return #messages
+`
+
+// streamUnregisterScriptSource removes the node arg(1) from the nodes of the user key(1) if arg(2) is 1, and the
+// session arg(3) from their open sessions key(2). If the user has no open session left, the UNIX time arg(4) is stored
+// as their last seen time key(3) and the presence event arg(5) is added to the streams of the live nodes watching them
+// key(4). It returns the number of streams the event was added to, or -3 if the stream of one of the watching nodes
+// wasn't given. It can be run again after -3 is returned.
+const streamUnregisterScriptSource = `
+if arg(2) == "1" then
+	redis.call("ZREM", key(1), arg(1))
+end
+redis.call("ZREM", key(2), arg(3))
+redis.call("ZREMRANGEBYSCORE", key(2), "-inf", now)
+if redis.call("ZCARD", key(2)) > 0 then
+	return 0
+end
+local watchers = live_streams(key(4), "SREM", redis.call("SMEMBERS", key(4)))
+if not watchers then
+	return -3
+end
+redis.call("SET", key(3), arg(4))
+for _, stream in ipairs(watchers) do
+	redis.call("XADD", stream, "*", "presence", arg(5))
+end
+return #watchers
+`
+
+var (
+	streamSendScript       = redis.NewScript(-1, streamScriptPrelude+streamSendScriptSource)
+	streamSendRoomScript   = redis.NewScript(-1, streamScriptPrelude+streamSendRoomScriptSource)
+	streamRegisterScript   = redis.NewScript(-1, streamScriptPrelude+streamRegisterScriptSource)
+	streamUnregisterScript = redis.NewScript(-1, streamScriptPrelude+streamUnregisterScriptSource)
+)
+
+// maxStreamRouteAttempts is the number of times a StreamBroker tries to send a message or a presence event to the nodes
+// of its recipients, when these nodes change concurrently.
+const maxStreamRouteAttempts = 3
+
+// errStreamNodesChanged is returned when the nodes of a recipient changed while a message was sent to them.
+var errStreamNodesChanged = errors.New("recipient nodes changed while sending a message")
+
+// ErrStreamCluster is returned by NewStreamBroker when given the address of a Redis Cluster: its scripts involve the
+// keys of several nodes and users, which a cluster would reject.
+var ErrStreamCluster = errors.New("the Redis Streams broker doesn't support Redis Cluster")
+
+// runStreamScript runs the given script, starting with streamScriptPrelude, which can write to the streams of the given
+// nodes.
+func runStreamScript(conn redis.Conn, script *redis.Script, nodes []string, keys []interface{}, args ...interface{}) (interface{}, error) {
+	scriptKeys := append(make([]interface{}, 0, 1+len(nodes)+len(keys)), streamNodesKey)
+	scriptArgs := append(make([]interface{}, 0, 2+len(nodes)+len(args)), time.Now().Unix(), len(nodes))
+	for _, node := range nodes {
+		scriptKeys = append(scriptKeys, streamKey(node))
+		scriptArgs = append(scriptArgs, node)
+	}
+	scriptKeys = append(scriptKeys, keys...)
+	scriptArgs = append(scriptArgs, args...)
+	return script.Do(conn, append(append([]interface{}{len(scriptKeys)}, scriptKeys...), scriptArgs...)...)
+}
+
+// A StreamBroker is a Broker relying on Redis Streams, which provides an at-least-once delivery of the messages. Each
+// node reads its own stream, in which the messages for the users connected to it are added, and acknowledges an entry
+// once it was written on the WebSocket connection of every recipient session. The entries left unacknowledged are
+// delivered again after ClaimIdle, and the ones of the nodes that stopped are routed again by the other nodes.
+//
+// It requires Redis 5.0 or later, and doesn't support Redis Cluster.
+type StreamBroker struct {
+	Log *logrus.Logger
+	// MailboxTTL is the duration for which the messages sent to an offline user are kept.
+	MailboxTTL time.Duration
+	// MailboxSize is the maximum number of messages kept for an offline user.
+	MailboxSize int
+	// NodeTTL is the duration after which a node that didn't refresh its registration is considered dead.
+	NodeTTL time.Duration
+	// ClaimIdle is the duration after which an entry that wasn't acknowledged is delivered again.
+	ClaimIdle time.Duration
+	// PresenceTTL is the duration after which a session that didn't send any heartbeat is considered closed.
+	PresenceTTL time.Duration
+
+	clients  clientRegistry
+	presence presenceRegistry
+	pool     *redis.Pool
+	dial     func(options ...redis.DialOption) (redis.Conn, error)
+	nodeID   uuid.UUID
+	// reading is set to 1 while the stream of the node is being read. It must be accessed atomically.
+	reading int32
+	// deliveriesMu protects deliveries.
+	deliveriesMu sync.Mutex
+	// deliveries maps the IDs of the entries of the stream of the node being delivered to the sessions on which they
+	// were written, so that an entry delivered again is only transmitted to the sessions that missed it.
+	deliveries map[string]map[*Client]struct{}
+}
+
+// NewStreamBroker creates a new StreamBroker instance, connecting to Redis using the given address, which accepts the
+// same forms as the one of NewRedisBroker except the redis+cluster:// and rediss+cluster:// URLs, for which
+// ErrStreamCluster is returned.
+func NewStreamBroker(log *logrus.Logger, addr string) (*StreamBroker, error) {
+	if isRedisClusterURL(addr) {
+		return nil, ErrStreamCluster
+	}
+	dial, err := newRedisDialer(addr)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamBroker(log, dial)
+}
+
+// newStreamBroker creates a new StreamBroker instance opening its connections using the given function, and registers
+// the node.
+func newStreamBroker(log *logrus.Logger, dial func(options ...redis.DialOption) (redis.Conn, error)) (*StreamBroker, error) {
+	b := &StreamBroker{
+		Log:         log,
+		MailboxTTL:  DefaultMailboxTTL,
+		MailboxSize: DefaultMailboxSize,
+		NodeTTL:     DefaultNodeTTL,
+		ClaimIdle:   DefaultClaimIdle,
+		PresenceTTL: DefaultPresenceTTL,
+		pool:        newRedisPool(dial),
+		dial:        dial,
+		nodeID:      uuid.NewV4(),
+	}
+	conn := b.pool.Get()
+	defer conn.Close()
+	if err := b.setup(conn); err != nil {
+		b.pool.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// streamKey returns the key of the stream of the given node.
+func streamKey(nodeID string) string {
+	return RedisBrokerPrefix + "stream:" + nodeID
+}
+
+// userNodesKey returns the key of the sorted set storing the IDs of the nodes on which the given user has a session.
+func userNodesKey(id uuid.UUID) string {
+	return RedisBrokerPrefix + "usernodes:{" + id.String() + "}"
+}
+
+// watchersKey returns the key of the set storing the IDs of the nodes on which a session is subscribed to the presence
+// of the given user.
+func watchersKey(id uuid.UUID) string {
+	return RedisBrokerPrefix + "watchers:{" + id.String() + "}"
+}
+
+// setup creates the stream of the node and its consumer group if needed, and refreshes the registration of the node.
+func (b *StreamBroker) setup(conn redis.Conn) error {
+	_, err := conn.Do("XGROUP", "CREATE", streamKey(b.nodeID.String()), streamGroup, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return b.refresh(conn)
+}
+
+// refresh extends the registration of the node, and restores its presence subscriptions, which the other nodes remove
+// if they consider it dead.
+func (b *StreamBroker) refresh(conn redis.Conn) error {
+	if _, err := conn.Do("ZADD", streamNodesKey, time.Now().Add(b.NodeTTL).Unix(), b.nodeID.String()); err != nil {
+		return err
+	}
+	for _, userID := range b.presence.userIDs() {
+		if _, err := conn.Do("SADD", watchersKey(userID), b.nodeID.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register registers a Client in the internal Client registry of the Broker, adds the node to the nodes of its user,
+// moves the messages that were sent while the user was offline to the stream of the node and adds the session to their
+// open sessions.
+func (b *StreamBroker) Register(client *Client) error {
+	b.clients.add(client)
+	event, err := json.Marshal(PresenceMessagePayload{
+		UserID: client.ID,
+		Status: PresenceOnline,
+	})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < maxStreamRouteAttempts; attempt++ {
+		if err = b.register(client, event); err != errStreamNodesChanged {
+			return err
+		}
+	}
+	return err
+}
+
+// register makes a single attempt at running the registration script of the given Client, which can write to the
+// streams of the node and of the nodes watching the presence of its user.
+func (b *StreamBroker) register(client *Client, event []byte) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	watchers, err := redis.Strings(conn.Do("SMEMBERS", watchersKey(client.ID)))
+	if err != nil {
+		return err
+	}
+	node := b.nodeID.String()
+	moved, err := redis.Int(runStreamScript(
+		conn,
+		streamRegisterScript,
+		appendNode(watchers, node),
+		[]interface{}{userNodesKey(client.ID), mailboxKey(client.ID), sessionsKey(client.ID), watchersKey(client.ID)},
+		node,
+		client.SessionID.String(),
+		int(b.PresenceTTL/time.Second),
+		event,
+	))
+	if err == nil && moved == -3 {
+		err = errStreamNodesChanged
+	}
+	return err
+}
+
+// appendNode appends the given node to the given nodes, unless it is already one of them.
+func appendNode(nodes []string, node string) []string {
+	for _, existing := range nodes {
+		if existing == node {
+			return nodes
+		}
+	}
+	return append(nodes, node)
+}
+
+// Unregister removes a Client from the internal Client registry of the Broker, from its presence subscriptions and
+// from the open sessions of its user. The node is removed from the nodes of the user if it was their last session on
+// this node.
+func (b *StreamBroker) Unregister(client *Client) error {
+	last := b.clients.remove(client)
+	if err := b.unwatch(b.presence.removeAll(client)); err != nil {
+		return err
+	}
+	now := time.Now()
+	event, err := json.Marshal(PresenceMessagePayload{
+		UserID:   client.ID,
+		Status:   PresenceOffline,
+		LastSeen: &now,
+	})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < maxStreamRouteAttempts; attempt++ {
+		if err = b.unregister(client, last, now, event); err != errStreamNodesChanged {
+			return err
+		}
+	}
+	return err
+}
+
+// unregister makes a single attempt at running the unregistration script of the given Client, which can write to the
+// streams of the nodes watching the presence of its user.
+func (b *StreamBroker) unregister(client *Client, last bool, now time.Time, event []byte) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	watchers, err := redis.Strings(conn.Do("SMEMBERS", watchersKey(client.ID)))
+	if err != nil {
+		return err
+	}
+	removeNode := 0
+	if last {
+		removeNode = 1
+	}
+	notified, err := redis.Int(runStreamScript(
+		conn,
+		streamUnregisterScript,
+		watchers,
+		[]interface{}{userNodesKey(client.ID), sessionsKey(client.ID), lastSeenKey(client.ID), watchersKey(client.ID)},
+		b.nodeID.String(),
+		removeNode,
+		client.SessionID.String(),
+		now.Unix(),
+		event,
+	))
+	if err == nil && notified == -3 {
+		err = errStreamNodesChanged
+	}
+	return err
+}
+
+// Heartbeat extends the lifetime of the session of the given Client.
+func (b *StreamBroker) Heartbeat(client *Client) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	ttl := int(b.PresenceTTL / time.Second)
+	if _, err := conn.Do("ZADD", sessionsKey(client.ID), time.Now().Unix()+int64(ttl), client.SessionID.String()); err != nil {
+		return err
+	}
+	_, err := conn.Do("EXPIRE", sessionsKey(client.ID), ttl)
+	return err
+}
+
+// SubscribePresence subscribes the given Client to the presence events of the given users, adding the node to the
+// nodes watching them, and returns their current presence.
+func (b *StreamBroker) SubscribePresence(client *Client, userIDs []uuid.UUID) ([]PresenceMessagePayload, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	for _, userID := range userIDs {
+		if !b.presence.add(userID, client) {
+			continue
+		}
+		if _, err := conn.Do("SADD", watchersKey(userID), b.nodeID.String()); err != nil {
+			return nil, err
+		}
+	}
+	return loadRedisPresences(b.pool, userIDs)
+}
+
+// UnsubscribePresence unsubscribes the given Client from the presence events of the given users, removing the node
+// from the nodes watching the users no other Client of this node is subscribed to.
+func (b *StreamBroker) UnsubscribePresence(client *Client, userIDs []uuid.UUID) error {
+	var unwatched []uuid.UUID
+	for _, userID := range userIDs {
+		if b.presence.remove(userID, client) {
+			unwatched = append(unwatched, userID)
+		}
+	}
+	return b.unwatch(unwatched)
+}
+
+// unwatch removes the node from the nodes watching the presence of the given users.
+func (b *StreamBroker) unwatch(userIDs []uuid.UUID) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	for _, userID := range userIDs {
+		if _, err := conn.Do("SREM", watchersKey(userID), b.nodeID.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send adds the given message to the streams of the nodes on which the recipient has a session. If the recipient is
+// offline, the message is stored in their mailbox until they connect. If the recipient is a room, ErrRoomRecipient is
+// returned.
+func (b *StreamBroker) Send(receiverID uuid.UUID, message *BrokerMessage) error {
+	marshaled, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	defer redisPublishDuration.observeSince(time.Now())
+	for attempt := 0; attempt < maxStreamRouteAttempts; attempt++ {
+		if err = b.send(receiverID, marshaled); err != errStreamNodesChanged {
+			return err
+		}
+	}
+	return err
+}
+
+// send makes a single attempt at adding the given marshaled message to the streams of the nodes of the recipient.
+func (b *StreamBroker) send(receiverID uuid.UUID, marshaled []byte) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	nodes, err := redis.Strings(conn.Do("ZRANGE", userNodesKey(receiverID), 0, -1))
+	if err != nil {
+		return err
+	}
+	routed, err := redis.Int(runStreamScript(
+		conn,
+		streamSendScript,
+		nodes,
+		[]interface{}{userNodesKey(receiverID), mailboxKey(receiverID), roomKey(receiverID)},
+		marshaled,
+		b.MailboxSize,
+		int(b.MailboxTTL/time.Second),
+	))
+	switch {
+	case err != nil:
+		return err
+	case routed == -1:
+		return ErrRoomRecipient
+	case routed == -3:
+		return errStreamNodesChanged
+	}
+	return nil
+}
+
+// SendRoom adds the given message to the streams of the nodes of all the other members of its room, or stores it in the
+// mailboxes of the offline ones, in a single script.
+func (b *StreamBroker) SendRoom(message *BrokerMessage) error {
+	defer redisPublishDuration.observeSince(time.Now())
+	var err error
+	for attempt := 0; attempt < maxStreamRouteAttempts; attempt++ {
+		err = b.sendRoom(message)
+		if err != errStreamNodesChanged {
+			return err
+		}
+	}
+	return err
+}
+
+// sendRoom makes a single attempt at adding the given message to the streams of the nodes of the members of its room.
+func (b *StreamBroker) sendRoom(message *BrokerMessage) error {
+	members, err := b.RoomMembers(message.RoomID)
+	if err != nil {
+		return err
+	}
+	conn := b.pool.Get()
+	defer conn.Close()
+	var nodes []string
+	keys := []interface{}{roomKey(message.RoomID)}
+	args := []interface{}{message.SenderID.String(), b.MailboxSize, int(b.MailboxTTL / time.Second)}
+	for _, member := range members {
+		if member == message.SenderID {
+			continue
+		}
+		memberNodes, err := redis.Strings(conn.Do("ZRANGE", userNodesKey(member), 0, -1))
+		if err != nil {
+			return err
+		}
+		for _, node := range memberNodes {
+			nodes = appendNode(nodes, node)
+		}
+		copied := *message
+		copied.RecipientID = member
+		marshaled, err := json.Marshal(&copied)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, userNodesKey(member), mailboxKey(member))
+		args = append(args, member.String(), marshaled)
+	}
+	sent, err := redis.Int(runStreamScript(conn, streamSendRoomScript, nodes, keys, args...))
+	if err != nil {
+		return err
+	}
+	switch sent {
+	case -1:
+		return ErrUnknownRoom
+	case -2:
+		return ErrNotRoomMember
+	case -3:
+		return errStreamNodesChanged
+	}
+	return nil
+}
+
+// CreateRoom creates a new room, whose only member is the given user.
+func (b *StreamBroker) CreateRoom(roomID uuid.UUID, ownerID uuid.UUID) error {
+	return createRedisRoom(b.pool, roomID, ownerID)
+}
+
+// JoinRoom adds the given user to the members of an existing room.
+func (b *StreamBroker) JoinRoom(roomID uuid.UUID, userID uuid.UUID) error {
+	return joinRedisRoom(b.pool, roomID, userID)
+}
+
+// LeaveRoom removes the given user from the members of a room.
+func (b *StreamBroker) LeaveRoom(roomID uuid.UUID, userID uuid.UUID) error {
+	return leaveRedisRoom(b.pool, roomID, userID)
+}
+
+// RoomMembers returns the IDs of the members of a room.
+func (b *StreamBroker) RoomMembers(roomID uuid.UUID) ([]uuid.UUID, error) {
+	return redisRoomMembers(b.pool, roomID)
+}
+
+// NextSequence returns the next sequence number of the given conversation, shared by all the nodes.
+func (b *StreamBroker) NextSequence(conversationID uuid.UUID) (uint64, error) {
+	return nextRedisSequence(b.pool, conversationID)
+}
+
+// ClaimSentMessage claims the given message for all the nodes, and returns its acknowledgement if it was already sent.
+func (b *StreamBroker) ClaimSentMessage(senderID uuid.UUID, messageID uuid.UUID, ttl time.Duration) (*AckMessagePayload, error) {
+	return claimRedisSentMessage(b.pool, senderID, messageID, ttl)
+}
+
+// RecordSentMessage records the acknowledgement of the given message for all the nodes.
+func (b *StreamBroker) RecordSentMessage(senderID uuid.UUID, messageID uuid.UUID, ack AckMessagePayload, ttl time.Duration) error {
+	return recordRedisSentMessage(b.pool, senderID, messageID, ack, ttl)
+}
+
+// ForgetSentMessage removes the claim or the acknowledgement of the given message.
+func (b *StreamBroker) ForgetSentMessage(senderID uuid.UUID, messageID uuid.UUID) error {
+	return forgetRedisSentMessage(b.pool, senderID, messageID)
+}
+
+// SaveSession creates or refreshes the given session, shared by all the nodes.
+func (b *StreamBroker) SaveSession(session SessionState, ttl time.Duration) error {
+	return saveRedisSession(b.pool, session, ttl)
+}
+
+// BufferMessage appends the given message to the buffer of the given session, shared by all the nodes.
+func (b *StreamBroker) BufferMessage(session SessionState, message *BrokerMessage, size int, ttl time.Duration) (uint64, error) {
+	return bufferRedisMessage(b.pool, session, message, size, ttl)
+}
+
+// LoadSession returns the session of the given token.
+func (b *StreamBroker) LoadSession(token string) (SessionState, error) {
+	return loadRedisSession(b.pool, token)
+}
+
+// ResumeSession gives the session of the given token to the given owner, and returns its buffered messages.
+func (b *StreamBroker) ResumeSession(token string, userID uuid.UUID, owner string, after uint64, ttl time.Duration) (SessionState, []BufferedMessage, error) {
+	return resumeRedisSession(b.pool, token, userID, owner, after, ttl)
+}
+
+// CloseSession deletes the given session and its buffer.
+func (b *StreamBroker) CloseSession(session SessionState) error {
+	return closeRedisSession(b.pool, session)
+}
+
+// Poll reads the stream of the node and transmits its entries to the sessions of their recipients. It also refreshes
+// the registration of the node, delivers again the entries that weren't acknowledged in time, and routes again the
+// entries of the dead nodes. Reading is resumed automatically if the connection is lost.
+func (b *StreamBroker) Poll(ctx context.Context) error {
+	go b.maintain(ctx)
+	for ctx.Err() == nil {
+		if err := b.read(ctx); err != nil {
+			b.Log.WithError(err).Warn("Lost the connection to the Redis stream, reconnecting")
+			select {
+			case <-time.After(DefaultReconnectMinDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+	return nil
+}
+
+// read reads the new entries of the stream of the node using a dedicated connection, until the given context is done.
+func (b *StreamBroker) read(ctx context.Context) error {
+	conn, err := b.dial(redis.DialReadTimeout(2 * streamReadBlock))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := b.setup(conn); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&b.reading, 1)
+	defer atomic.StoreInt32(&b.reading, 0)
+	key := streamKey(b.nodeID.String())
+	for ctx.Err() == nil {
+		entries, err := readStreamEntries(conn.Do(
+			"XREADGROUP", "GROUP", streamGroup, b.nodeID.String(),
+			"COUNT", streamBatchSize,
+			"BLOCK", int(streamReadBlock/time.Millisecond),
+			"STREAMS", key, ">",
+		))
+		if err != nil {
+			return err
+		}
+		pollBacklog.set(float64(len(entries)))
+		for _, entry := range entries {
+			b.dispatch(key, entry)
+		}
+	}
+	return nil
+}
+
+// maintain refreshes the registration of the node, claims its stale entries and recovers the streams of the dead nodes
+// periodically, until the given context is done.
+func (b *StreamBroker) maintain(ctx context.Context) {
+	ticker := time.NewTicker(b.NodeTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			conn := b.pool.Get()
+			if err := b.refresh(conn); err != nil {
+				b.Log.Error(err)
+			}
+			if err := b.claimStale(conn); err != nil {
+				b.Log.Error(err)
+			}
+			if err := b.recoverDeadNodes(conn); err != nil {
+				b.Log.Error(err)
+			}
+			conn.Close()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// A streamEntry is an entry read from a stream. It holds either a message or a presence event.
+type streamEntry struct {
+	id       string
+	message  *BrokerMessage
+	presence *PresenceMessagePayload
+}
+
+// readStreamEntries parses the reply of XREADGROUP.
+func readStreamEntries(reply interface{}, err error) ([]streamEntry, error) {
+	streams, err := redis.Values(reply, err)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []streamEntry
+	for _, stream := range streams {
+		fields, err := redis.Values(stream, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, errUnexpectedReply(stream)
+		}
+		streamEntries, err := parseStreamEntries(fields[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, streamEntries...)
+	}
+	return entries, nil
+}
+
+// parseStreamEntries parses a list of stream entries, as returned by XCLAIM. The entries that were deleted or can't be
+// decoded have a nil message and a nil presence event.
+func parseStreamEntries(reply interface{}, err error) ([]streamEntry, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]streamEntry, 0, len(values))
+	for _, value := range values {
+		fields, err := redis.Values(value, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, errUnexpectedReply(value)
+		}
+		id, err := redis.String(fields[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		entry := streamEntry{id: id}
+		data, _ := redis.StringMap(fields[1], nil)
+		if payload, ok := data["message"]; ok {
+			message := new(BrokerMessage)
+			if err := json.Unmarshal([]byte(payload), message); err == nil {
+				entry.message = message
+			}
+		}
+		if payload, ok := data["presence"]; ok {
+			presence := new(PresenceMessagePayload)
+			if err := json.Unmarshal([]byte(payload), presence); err == nil {
+				entry.presence = presence
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// errUnexpectedReply returns the error reporting an unexpected reply from Redis.
+func errUnexpectedReply(reply interface{}) error {
+	return fmt.Errorf("redis: unexpected reply %v", reply)
+}
+
+// dispatch transmits an entry of the stream of the node to the sessions of its recipient on which it wasn't written yet.
+// The entry is acknowledged once it was written on all of them. If the recipient isn't connected to this node anymore,
+// the message is routed again, unless it was already written on one of their sessions. Presence events are transmitted
+// to the Clients subscribed to them and acknowledged right away.
+func (b *StreamBroker) dispatch(key string, entry streamEntry) {
+	if entry.presence != nil {
+		for _, client := range b.presence.subscribers(entry.presence.UserID) {
+			client.deliverPresence(*entry.presence)
+		}
+		go b.ack(key, entry.id)
+		return
+	}
+	if entry.message == nil {
+		b.Log.WithField("entry", entry.id).Error("Discarding invalid stream entry")
+		go b.ack(key, entry.id)
+		return
+	}
+	recipientID := entry.message.RecipientID
+	sessions := b.clients.sessions(recipientID)
+	b.deliveriesMu.Lock()
+	if b.deliveries == nil {
+		b.deliveries = make(map[string]map[*Client]struct{})
+	}
+	written, ok := b.deliveries[entry.id]
+	if !ok {
+		written = make(map[*Client]struct{})
+		b.deliveries[entry.id] = written
+	}
+	var missing []*Client
+	for _, client := range sessions {
+		if _, ok := written[client]; !ok {
+			missing = append(missing, client)
+		}
+	}
+	delivered := len(written) != 0
+	b.deliveriesMu.Unlock()
+	switch {
+	case len(sessions) == 0 && !delivered:
+		go b.reroute(key, entry)
+		return
+	case len(missing) == 0:
+		go b.ack(key, entry.id)
+		return
+	}
+	for _, client := range missing {
+		client := client
+		message := *entry.message
+		message.written = func() {
+			if b.markWritten(entry.id, recipientID, client) {
+				b.ack(key, entry.id)
+			}
+		}
+		client.deliver(&message)
+	}
+}
+
+// markWritten records that the entry of the given ID was written on the given session of its recipient, and reports
+// whether it was written on all their sessions.
+func (b *StreamBroker) markWritten(id string, recipientID uuid.UUID, client *Client) bool {
+	b.deliveriesMu.Lock()
+	defer b.deliveriesMu.Unlock()
+	written, ok := b.deliveries[id]
+	if !ok {
+		return false
+	}
+	written[client] = struct{}{}
+	for _, session := range b.clients.sessions(recipientID) {
+		if _, ok := written[session]; !ok {
+			return false
+		}
+	}
+	delete(b.deliveries, id)
+	return true
+}
+
+// reroute sends again the message of an entry that can't be delivered by this node, and acknowledges it.
+func (b *StreamBroker) reroute(key string, entry streamEntry) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	if len(b.clients.sessions(entry.message.RecipientID)) == 0 {
+		if _, err := conn.Do("ZREM", userNodesKey(entry.message.RecipientID), b.nodeID.String()); err != nil {
+			b.Log.Error(err)
+			return
+		}
+	}
+	if err := b.Send(entry.message.RecipientID, entry.message); err != nil {
+		b.Log.Error(err)
+		return
+	}
+	b.ack(key, entry.id)
+}
+
+// ack acknowledges and deletes the given entry.
+func (b *StreamBroker) ack(key string, id string) {
+	b.deliveriesMu.Lock()
+	delete(b.deliveries, id)
+	b.deliveriesMu.Unlock()
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("XACK", key, streamGroup, id); err != nil {
+		b.Log.Error(err)
+		return
+	}
+	if _, err := conn.Do("XDEL", key, id); err != nil {
+		b.Log.Error(err)
+	}
+}
+
+// pendingEntries returns the IDs of the pending entries of the given stream that were delivered at least minIdle ago.
+func pendingEntries(conn redis.Conn, key string, minIdle time.Duration) ([]interface{}, error) {
+	pending, err := redis.Values(conn.Do("XPENDING", key, streamGroup, "-", "+", streamBatchSize))
+	if err != nil {
+		return nil, err
+	}
+	var ids []interface{}
+	for _, value := range pending {
+		var id, consumer string
+		var idle, deliveries int64
+		fields, err := redis.Values(value, nil)
+		if err == nil {
+			_, err = redis.Scan(fields, &id, &consumer, &idle, &deliveries)
+		}
+		if err != nil {
+			return nil, errUnexpectedReply(value)
+		}
+		if time.Duration(idle)*time.Millisecond >= minIdle {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// claim claims the given pending entries of the given stream for this node.
+func (b *StreamBroker) claim(conn redis.Conn, key string, minIdle time.Duration, ids []interface{}) ([]streamEntry, error) {
+	args := append([]interface{}{key, streamGroup, b.nodeID.String(), int64(minIdle / time.Millisecond)}, ids...)
+	return parseStreamEntries(conn.Do("XCLAIM", args...))
+}
+
+// claimStale delivers again the entries of the stream of the node that weren't acknowledged for ClaimIdle.
+func (b *StreamBroker) claimStale(conn redis.Conn) error {
+	key := streamKey(b.nodeID.String())
+	ids, err := pendingEntries(conn, key, b.ClaimIdle)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	entries, err := b.claim(conn, key, b.ClaimIdle, ids)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		b.dispatch(key, entry)
+	}
+	return nil
+}
+
+// recoverDeadNodes routes again the entries of the streams of the nodes whose registration expired. Each dead node is
+// recovered by the first node removing it from the registered nodes.
+func (b *StreamBroker) recoverDeadNodes(conn redis.Conn) error {
+	nodes, err := redis.Strings(conn.Do("ZRANGEBYSCORE", streamNodesKey, "-inf", time.Now().Unix()-1))
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node == b.nodeID.String() {
+			continue
+		}
+		removed, err := redis.Int(conn.Do("ZREM", streamNodesKey, node))
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			continue
+		}
+		b.Log.WithField("node", node).Warn("Recovering the stream of a dead node")
+		if err := b.recoverStream(conn, streamKey(node)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverStream routes again all the messages of the given stream, claiming the pending entries, and deletes it. The
+// presence events are dropped, as the node that was watching them is dead.
+func (b *StreamBroker) recoverStream(conn redis.Conn, key string) error {
+	for {
+		ids, err := pendingEntries(conn, key, 0)
+		if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var entries []streamEntry
+		if len(ids) != 0 {
+			entries, err = b.claim(conn, key, 0, ids)
+		} else {
+			entries, err = readStreamEntries(conn.Do(
+				"XREADGROUP", "GROUP", streamGroup, b.nodeID.String(),
+				"COUNT", streamBatchSize,
+				"STREAMS", key, ">",
+			))
+		}
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if entry.message != nil {
+				if err := b.Send(entry.message.RecipientID, entry.message); err != nil {
+					return err
+				}
+			}
+			if _, err := conn.Do("XACK", key, streamGroup, entry.id); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+// CheckHealth is the implementation of HealthChecker.CheckHealth for StreamBroker. It fails if the Redis server doesn't
+// answer to a PING, or if the stream of the node isn't being read.
+func (b *StreamBroker) CheckHealth() error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&b.reading) == 0 {
+		return ErrSubscriptionClosed
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package texto
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStreamBroker_Cluster(t *testing.T) {
+	for _, addr := range []string{"redis+cluster://localhost:7000", "rediss+cluster://localhost:7000"} {
+		_, err := NewStreamBroker(newLogger(), addr)
+		assert.Equal(t, ErrStreamCluster, err, addr)
+	}
+}
+
+func TestStreamBroker_Send(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	broker := StreamBroker{
+		Log:         newLogger(),
+		MailboxTTL:  time.Hour,
+		MailboxSize: 10,
+		pool:        newMockPool(mockConn),
+	}
+	message := &BrokerMessage{
+		MessageID:   uuid.NewV4(),
+		SenderID:    uuid.NewV4(),
+		RecipientID: uuid.NewV4(),
+		Text:        "Lorem ipsum dolor sit amet...",
+	}
+	node := uuid.NewV4().String()
+	nodesKey := "texto:usernodes:{" + message.RecipientID.String() + "}"
+	mockConn.Command("ZRANGE", nodesKey, 0, -1).Expect([]interface{}{[]byte(node)})
+	marshaled, _ := json.Marshal(message)
+	send := mockConn.Script(
+		[]byte(streamScriptPrelude+streamSendScriptSource),
+		5,
+		"texto:nodes",
+		"texto:stream:"+node,
+		nodesKey,
+		"texto:mailbox:{"+message.RecipientID.String()+"}",
+		"texto:room:{"+message.RecipientID.String()+"}",
+		redigomock.NewAnyInt(),
+		1,
+		node,
+		marshaled,
+		10,
+		3600,
+	).Expect(int64(-3)).Expect(int64(1)).Expect(int64(-1)).Expect(int64(-3))
+	assert.Nil(t, broker.Send(message.RecipientID, message))
+	assert.Equal(t, 2, mockConn.Stats(send))
+	assert.Equal(t, ErrRoomRecipient, broker.Send(message.RecipientID, message))
+	assert.Equal(t, errStreamNodesChanged, broker.Send(message.RecipientID, message))
+	assert.Equal(t, 3+maxStreamRouteAttempts, mockConn.Stats(send))
+}
+
+func TestStreamBroker_SendRoom(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	broker := StreamBroker{
+		Log:         newLogger(),
+		MailboxTTL:  time.Hour,
+		MailboxSize: 10,
+		pool:        newMockPool(mockConn),
+	}
+	var _ RoomBroker = &broker
+	roomID := uuid.NewV4()
+	sender := uuid.NewV4()
+	member := uuid.NewV4()
+	key := "texto:room:{" + roomID.String() + "}"
+	message := &BrokerMessage{MessageID: uuid.NewV4(), SenderID: sender, RecipientID: roomID, RoomID: roomID, Text: "Hello"}
+	copied := *message
+	copied.RecipientID = member
+	marshaled, _ := json.Marshal(&copied)
+	node := uuid.NewV4().String()
+	nodesKey := "texto:usernodes:{" + member.String() + "}"
+
+	mockConn.Command("SMEMBERS", key).Expect([]interface{}{[]byte(sender.String()), []byte(member.String())})
+	mockConn.Command("ZRANGE", nodesKey, 0, -1).Expect([]interface{}{[]byte(node)})
+	send := mockConn.Script(
+		[]byte(streamScriptPrelude+streamSendRoomScriptSource),
+		5,
+		"texto:nodes",
+		"texto:stream:"+node,
+		key,
+		nodesKey,
+		"texto:mailbox:{"+member.String()+"}",
+		redigomock.NewAnyInt(),
+		1,
+		node,
+		sender.String(),
+		10,
+		3600,
+		member.String(),
+		marshaled,
+	).Expect(int64(-3)).Expect(int64(1)).Expect(int64(-2)).Expect(int64(-1))
+	assert.Nil(t, broker.SendRoom(message))
+	assert.Equal(t, 2, mockConn.Stats(send))
+	assert.Equal(t, ErrNotRoomMember, broker.SendRoom(message))
+	assert.Equal(t, ErrUnknownRoom, broker.SendRoom(message))
+}
+
+func TestStreamBroker_RegisterUnregister(t *testing.T) {
+	log := newLogger()
+	mockConn := redigomock.NewConn()
+	broker := StreamBroker{
+		Log:         log,
+		PresenceTTL: time.Minute,
+		pool:        newMockPool(mockConn),
+		nodeID:      uuid.NewV4(),
+	}
+	client := NewClient(log, nil, &broker)
+	watcher := uuid.NewV4().String()
+	watchersKey := "texto:watchers:{" + client.ID.String() + "}"
+	mockConn.Command("SMEMBERS", watchersKey).Expect([]interface{}{[]byte(watcher)})
+	online, _ := json.Marshal(PresenceMessagePayload{UserID: client.ID, Status: PresenceOnline})
+	register := mockConn.Script(
+		[]byte(streamScriptPrelude+streamRegisterScriptSource),
+		7,
+		"texto:nodes",
+		"texto:stream:"+watcher,
+		"texto:stream:"+broker.nodeID.String(),
+		"texto:usernodes:{"+client.ID.String()+"}",
+		"texto:mailbox:{"+client.ID.String()+"}",
+		"texto:sessions:{"+client.ID.String()+"}",
+		watchersKey,
+		redigomock.NewAnyInt(),
+		2,
+		watcher,
+		broker.nodeID.String(),
+		broker.nodeID.String(),
+		client.SessionID.String(),
+		60,
+		online,
+	).Expect(int64(-3)).Expect(int64(0))
+	assert.Nil(t, broker.Register(client))
+	assert.Equal(t, 2, mockConn.Stats(register))
+
+	second := NewClient(log, nil, &broker)
+	second.ID = client.ID
+	broker.clients.add(second)
+	unregister := mockConn.Script(
+		[]byte(streamScriptPrelude+streamUnregisterScriptSource),
+		6,
+		"texto:nodes",
+		"texto:stream:"+watcher,
+		"texto:usernodes:{"+client.ID.String()+"}",
+		"texto:sessions:{"+client.ID.String()+"}",
+		"texto:lastseen:{"+client.ID.String()+"}",
+		watchersKey,
+		redigomock.NewAnyInt(),
+		1,
+		watcher,
+		broker.nodeID.String(),
+		0,
+		client.SessionID.String(),
+		redigomock.NewAnyInt(),
+		redigomock.NewAnyData(),
+	).Expect(int64(0))
+	assert.Nil(t, broker.Unregister(client))
+	assert.Equal(t, 1, mockConn.Stats(unregister))
+	last := mockConn.Script(
+		[]byte(streamScriptPrelude+streamUnregisterScriptSource),
+		6,
+		"texto:nodes",
+		"texto:stream:"+watcher,
+		"texto:usernodes:{"+client.ID.String()+"}",
+		"texto:sessions:{"+client.ID.String()+"}",
+		"texto:lastseen:{"+client.ID.String()+"}",
+		watchersKey,
+		redigomock.NewAnyInt(),
+		1,
+		watcher,
+		broker.nodeID.String(),
+		1,
+		second.SessionID.String(),
+		redigomock.NewAnyInt(),
+		redigomock.NewAnyData(),
+	).Expect(int64(1))
+	assert.Nil(t, broker.Unregister(second))
+	assert.Equal(t, 1, mockConn.Stats(last))
+}
+
+// A closeNotifyingConn is a connection signaling on a channel when it is closed.
+type closeNotifyingConn struct {
+	redis.Conn
+	closed chan struct{}
+}
+
+func (c closeNotifyingConn) Close() error {
+	c.closed <- struct{}{}
+	return c.Conn.Close()
+}
+
+func TestStreamBroker_Presence(t *testing.T) {
+	log := newLogger()
+	mockConn := redigomock.NewConn()
+	broker := StreamBroker{
+		Log:    log,
+		pool:   newMockPool(mockConn),
+		nodeID: uuid.NewV4(),
+	}
+	var _ PresenceBroker = &broker
+	client := NewClient(log, nil, &broker)
+	userID := uuid.NewV4()
+	key := streamKey(broker.nodeID.String())
+	watchersKey := "texto:watchers:{" + userID.String() + "}"
+	watch := mockConn.Command("SADD", watchersKey, broker.nodeID.String()).Expect(int64(1))
+	mockConn.Command("ZCOUNT", "texto:sessions:{"+userID.String()+"}", redigomock.NewAnyInt(), "+inf").Expect(int64(1))
+	presences, err := broker.SubscribePresence(client, []uuid.UUID{userID})
+	assert.Nil(t, err)
+	if assert.Len(t, presences, 1) {
+		assert.Equal(t, PresenceOnline, presences[0].Status)
+	}
+	assert.Equal(t, 1, mockConn.Stats(watch))
+
+	mockConn.Command("ZADD", streamNodesKey, redigomock.NewAnyInt(), broker.nodeID.String()).Expect(int64(0))
+	assert.Nil(t, broker.refresh(mockConn))
+	assert.Equal(t, 2, mockConn.Stats(watch))
+
+	event, _ := json.Marshal(PresenceMessagePayload{UserID: userID, Status: PresenceOffline})
+	entries, err := parseStreamEntries([]interface{}{
+		[]interface{}{[]byte("1-0"), []interface{}{[]byte("presence"), event}},
+	}, nil)
+	if !assert.Nil(t, err) || !assert.Len(t, entries, 1) {
+		return
+	}
+	ack := mockConn.Command("XACK", key, streamGroup, "1-0")
+	del := mockConn.Command("XDEL", key, "1-0")
+	unwatch := mockConn.Command("SREM", watchersKey, broker.nodeID.String()).Expect(int64(1))
+	closed := make(chan struct{}, 1)
+	broker.pool = newMockPool(closeNotifyingConn{mockConn, closed})
+	broker.dispatch(key, entries[0])
+	select {
+	case received := <-client.outboundChan:
+		assert.Equal(t, PresenceKind, received.Kind)
+	case <-time.After(time.Second):
+		t.Fatal("presence event was not delivered")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("presence event was not acknowledged")
+	}
+	broker.pool = newMockPool(mockConn)
+	assert.Equal(t, 1, mockConn.Stats(ack))
+	assert.Equal(t, 1, mockConn.Stats(del))
+
+	assert.Nil(t, broker.UnsubscribePresence(client, []uuid.UUID{userID}))
+	assert.Equal(t, 1, mockConn.Stats(unwatch))
+	assert.Empty(t, broker.presence.subscribers(userID))
+}
+
+func TestStreamBroker_Dispatch(t *testing.T) {
+	log := newLogger()
+	mockConn := redigomock.NewConn()
+	broker := StreamBroker{
+		Log:    log,
+		pool:   newMockPool(mockConn),
+		nodeID: uuid.NewV4(),
+	}
+	key := streamKey(broker.nodeID.String())
+	first := NewClient(log, nil, &broker)
+	second := NewClient(log, nil, &broker)
+	second.ID = first.ID
+	broker.clients.add(first)
+	broker.clients.add(second)
+	message := &BrokerMessage{
+		MessageID:   uuid.NewV4(),
+		SenderID:    uuid.NewV4(),
+		RecipientID: first.ID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	}
+	entries, err := readStreamEntries([]interface{}{
+		[]interface{}{[]byte(key), []interface{}{
+			[]interface{}{[]byte("1-0"), []interface{}{[]byte("message"), marshal(t, message)}},
+			[]interface{}{[]byte("2-0"), []interface{}{[]byte("message"), []byte("{")}},
+		}},
+	}, nil)
+	if !assert.Nil(t, err) || !assert.Len(t, entries, 2) {
+		return
+	}
+	assert.Equal(t, "1-0", entries[0].id)
+	assert.Equal(t, message.Text, entries[0].message.Text)
+	assert.Nil(t, entries[1].message)
+
+	ack := mockConn.Command("XACK", key, streamGroup, "1-0")
+	del := mockConn.Command("XDEL", key, "1-0")
+	broker.dispatch(key, entries[0])
+	for _, client := range []*Client{first, second} {
+		select {
+		case received := <-client.outboundChan:
+			assert.Equal(t, ReceiveMessageKind, received.Kind)
+			assert.Equal(t, 0, mockConn.Stats(ack))
+			received.written()
+		case <-time.After(time.Second):
+			t.Fatal("message was not delivered")
+		}
+	}
+	assert.Equal(t, 1, mockConn.Stats(ack))
+	assert.Equal(t, 1, mockConn.Stats(del))
+	assert.Empty(t, broker.deliveries)
+}
+
+func TestStreamBroker_DispatchAgain(t *testing.T) {
+	log := newLogger()
+	mockConn := redigomock.NewConn()
+	broker := StreamBroker{
+		Log:    log,
+		pool:   newMockPool(mockConn),
+		nodeID: uuid.NewV4(),
+	}
+	key := streamKey(broker.nodeID.String())
+	first := NewClient(log, nil, &broker)
+	second := NewClient(log, nil, &broker)
+	second.ID = first.ID
+	broker.clients.add(first)
+	broker.clients.add(second)
+	entry := streamEntry{id: "1-0", message: &BrokerMessage{
+		MessageID:   uuid.NewV4(),
+		SenderID:    uuid.NewV4(),
+		RecipientID: first.ID,
+		Text:        "Lorem ipsum dolor sit amet...",
+	}}
+	ack := mockConn.Command("XACK", key, streamGroup, "1-0")
+	mockConn.Command("XDEL", key, "1-0")
+	mockConn.Command("XACK", key, streamGroup, "2-0")
+	mockConn.Command("XDEL", key, "2-0")
+
+	// The message is dropped from the send queue of the second session, and the entry is claimed again.
+	broker.dispatch(key, entry)
+	(<-first.outboundChan).written()
+	<-second.outboundChan
+	assert.Equal(t, 0, mockConn.Stats(ack))
+	broker.dispatch(key, entry)
+	assert.Empty(t, first.outboundChan)
+	if assert.Len(t, second.outboundChan, 1) {
+		(<-second.outboundChan).written()
+	}
+	assert.Equal(t, 1, mockConn.Stats(ack))
+
+	// The session that missed the message is gone when the entry is claimed again.
+	entry.id = "2-0"
+	broker.dispatch(key, entry)
+	(<-first.outboundChan).written()
+	<-second.outboundChan
+	broker.clients.remove(second)
+	broker.dispatch(key, entry)
+	assert.Empty(t, first.outboundChan)
+	deadline := time.Now().Add(time.Second)
+	for {
+		broker.deliveriesMu.Lock()
+		_, pending := broker.deliveries[entry.id]
+		broker.deliveriesMu.Unlock()
+		if !pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the entry wasn't acknowledged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamBroker_RecoverDeadNodes(t *testing.T) {
+	log := newLogger()
+	mockConn := redigomock.NewConn()
+	broker := StreamBroker{
+		Log:         log,
+		MailboxTTL:  time.Hour,
+		MailboxSize: 10,
+		pool:        newMockPool(mockConn),
+		nodeID:      uuid.NewV4(),
+	}
+	dead := uuid.NewV4().String()
+	key := streamKey(dead)
+	message := &BrokerMessage{
+		MessageID:   uuid.NewV4(),
+		SenderID:    uuid.NewV4(),
+		RecipientID: uuid.NewV4(),
+		Text:        "Lorem ipsum dolor sit amet...",
+	}
+	entry := []interface{}{[]byte("1-0"), []interface{}{[]byte("message"), marshal(t, message)}}
+	mockConn.GenericCommand("ZRANGEBYSCORE").Expect([]interface{}{[]byte(dead), []byte(broker.nodeID.String())})
+	mockConn.Command("ZREM", streamNodesKey, dead).Expect(int64(1))
+	mockConn.GenericCommand("XPENDING").
+		Expect([]interface{}{[]interface{}{[]byte("1-0"), []byte(dead), int64(100), int64(1)}}).
+		Expect([]interface{}{})
+	claim := mockConn.Command("XCLAIM", key, streamGroup, broker.nodeID.String(), int64(0), "1-0").
+		Expect([]interface{}{entry})
+	read := mockConn.GenericCommand("XREADGROUP").
+		Expect([]interface{}{[]interface{}{[]byte(key), []interface{}{entry}}}).
+		Expect(nil)
+	mockConn.GenericCommand("ZRANGE").Expect([]interface{}{})
+	send := mockConn.GenericCommand("EVALSHA").Expect(int64(0))
+	ack := mockConn.Command("XACK", key, streamGroup, "1-0")
+	del := mockConn.Command("DEL", key)
+
+	assert.Nil(t, broker.recoverDeadNodes(mockConn))
+	assert.Equal(t, 1, mockConn.Stats(claim))
+	assert.Equal(t, 2, mockConn.Stats(read))
+	assert.Equal(t, 2, mockConn.Stats(send))
+	assert.Equal(t, 2, mockConn.Stats(ack))
+	assert.Equal(t, 1, mockConn.Stats(del))
+}
+
+func TestStreamBroker_CheckHealth(t *testing.T) {
+	mockConn := redigomock.NewConn()
+	mockConn.Command("PING").Expect("PONG")
+	broker := StreamBroker{
+		Log:  newLogger(),
+		pool: newMockPool(mockConn),
+	}
+	assert.Equal(t, ErrSubscriptionClosed, broker.CheckHealth())
+	broker.reading = 1
+	assert.Nil(t, broker.CheckHealth())
+}
+
+// marshal returns the JSON encoding of the given value.
+func marshal(t *testing.T, value interface{}) []byte {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}